@@ -0,0 +1,301 @@
+// Package anonymize replaces label values with pseudonyms, so that dumps can be
+// shared without the hostnames, addresses and names they contain.
+package anonymize
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pingcap/errors"
+	"github.com/prometheus/tsdb/labels"
+)
+
+// Mode is the way pseudonyms are generated.
+type Mode string
+
+const (
+	// Hash derives pseudonyms from a keyed hash of the value, the same key
+	// always gives the same pseudonyms.
+	Hash Mode = "hash"
+	// Sequential numbers values in the order they are seen. Label sets must
+	// be passed in a deterministic order from a single goroutine for the
+	// pseudonyms to be reproducible, see OrderDependent.
+	Sequential Mode = "sequential"
+)
+
+// KeySize is the size of the keys generated by GenerateKey.
+const KeySize = 32
+
+// seqPrefix is the prefix of sequential pseudonyms.
+const seqPrefix = "v"
+
+// Options selects the labels to anonymize and how.
+type Options struct {
+	// Labels are the labels whose values are replaced. If empty, the values
+	// of all labels except Keep and the metric name are replaced.
+	Labels []string
+	Keep   []string
+	Mode   Mode
+	// Key is used for the keyed hashes and to encrypt the mapping file. A
+	// random key is used if it is empty.
+	Key []byte
+	// Mapping holds the values by pseudonym of a previous run, as returned
+	// by LoadMapping. Its values keep their pseudonyms, new sequential ones
+	// are numbered after them.
+	Mapping map[string]string
+}
+
+// Anonymizer replaces label values consistently, a value gets the same
+// pseudonym in every series and label. It is safe for concurrent use.
+type Anonymizer struct {
+	labels map[string]struct{}
+	keep   map[string]struct{}
+	mode   Mode
+
+	hashKey    []byte
+	mappingKey []byte
+	randomKey  bool
+
+	mtx     sync.Mutex
+	mapping map[string]string
+	values  map[string]string
+	// next is the number of the next sequential pseudonym.
+	next int
+}
+
+// New creates an Anonymizer.
+func New(opts Options) (*Anonymizer, error) {
+	switch opts.Mode {
+	case Hash, Sequential:
+	default:
+		return nil, errors.Errorf("unknown anonymize mode %q", opts.Mode)
+	}
+
+	a := &Anonymizer{
+		labels:  toSet(opts.Labels),
+		keep:    toSet(append(opts.Keep, "__name__")),
+		mode:    opts.Mode,
+		mapping: map[string]string{},
+		values:  map[string]string{},
+		next:    1,
+	}
+	for p, v := range opts.Mapping {
+		a.mapping[p] = v
+		a.values[v] = p
+		if !strings.HasPrefix(p, seqPrefix) {
+			continue
+		}
+		if n, err := strconv.Atoi(p[len(seqPrefix):]); err == nil && n >= a.next {
+			a.next = n + 1
+		}
+	}
+
+	key := opts.Key
+	if len(key) == 0 {
+		var err error
+		if key, err = GenerateKey(); err != nil {
+			return nil, err
+		}
+		a.randomKey = true
+	}
+	a.hashKey = deriveKey(key, "hash")
+	a.mappingKey = deriveKey(key, "mapping")
+
+	return a, nil
+}
+
+// Labels returns lset with the values of the selected labels replaced.
+func (a *Anonymizer) Labels(lset labels.Labels) labels.Labels {
+	res := make(labels.Labels, 0, len(lset))
+	for _, l := range lset {
+		if a.selected(l.Name) {
+			l.Value = a.pseudonym(l.Value)
+		}
+		res = append(res, l)
+	}
+	return res
+}
+
+// OrderDependent returns whether the pseudonyms depend on the order values
+// are seen in, which is the case in Sequential mode.
+func (a *Anonymizer) OrderDependent() bool {
+	return a.mode == Sequential
+}
+
+func (a *Anonymizer) selected(name string) bool {
+	if len(a.labels) > 0 {
+		_, ok := a.labels[name]
+		return ok
+	}
+	_, ok := a.keep[name]
+	return !ok
+}
+
+func (a *Anonymizer) pseudonym(value string) string {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	if p, ok := a.values[value]; ok {
+		return p
+	}
+
+	var p string
+	switch a.mode {
+	case Hash:
+		h := hmac.New(sha256.New, a.hashKey)
+		h.Write([]byte(value))
+		p = hex.EncodeToString(h.Sum(nil)[:8])
+	case Sequential:
+		p = seqPrefix + strconv.Itoa(a.next)
+		a.next++
+	}
+	a.values[value] = p
+	a.mapping[p] = value
+
+	return p
+}
+
+// SaveMapping writes the pseudonyms and the values they replace into a file
+// encrypted with the key.
+func (a *Anonymizer) SaveMapping(path string) error {
+	if a.randomKey {
+		return errors.Errorf("the mapping can only be saved with a key file")
+	}
+
+	a.mtx.Lock()
+	b, err := json.Marshal(a.mapping)
+	a.mtx.Unlock()
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	gcm, err := newGCM(a.mappingKey)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return errors.Trace(err)
+	}
+
+	return errors.Trace(ioutil.WriteFile(path, gcm.Seal(nonce, nonce, b, nil), 0600))
+}
+
+// LoadMapping decrypts a mapping file written by SaveMapping and returns the
+// values by pseudonym.
+func LoadMapping(path string, key []byte) (map[string]string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	gcm, err := newGCM(deriveKey(key, "mapping"))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < gcm.NonceSize() {
+		return nil, errors.Errorf("mapping file %s is too short", path)
+	}
+	plain, err := gcm.Open(nil, b[:gcm.NonceSize()], b[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "decrypt mapping file, wrong key?")
+	}
+
+	mapping := map[string]string{}
+	if err := json.Unmarshal(plain, &mapping); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return mapping, nil
+}
+
+// MappingPath returns the file next to keyFile that the mapping is kept in
+// between runs in Sequential mode.
+func MappingPath(keyFile string) string {
+	return keyFile + ".mapping"
+}
+
+// SortedPseudonyms returns the pseudonyms of a mapping in order.
+func SortedPseudonyms(mapping map[string]string) []string {
+	ps := make([]string, 0, len(mapping))
+	for p := range mapping {
+		ps = append(ps, p)
+	}
+	sort.Strings(ps)
+	return ps
+}
+
+// GenerateKey returns a new random key.
+func GenerateKey() ([]byte, error) {
+	key := make([]byte, KeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return key, nil
+}
+
+// ReadKeyFile reads a hex encoded key.
+func ReadKeyFile(path string) ([]byte, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	key, err := hex.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil {
+		return nil, errors.Wrapf(err, "decode key file %s", path)
+	}
+	if len(key) < 16 {
+		return nil, errors.Errorf("key in %s is shorter than 16 bytes", path)
+	}
+	return key, nil
+}
+
+// ReadOrCreateKeyFile reads a hex encoded key. If the file does not exist, a
+// new key is generated and written to it.
+func ReadOrCreateKeyFile(path string) ([]byte, error) {
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		return ReadKeyFile(path)
+	}
+
+	key, err := GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+	return key, errors.Trace(ioutil.WriteFile(path, []byte(hex.EncodeToString(key)+"\n"), 0600))
+}
+
+// deriveKey returns separate keys for hashing and encryption.
+func deriveKey(key []byte, purpose string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(purpose))
+	return h.Sum(nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	return gcm, errors.Trace(err)
+}
+
+func toSet(names []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		set[name] = struct{}{}
+	}
+	return set
+}
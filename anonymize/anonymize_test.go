@@ -0,0 +1,141 @@
+package anonymize
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/tsdb/labels"
+)
+
+var testKey = []byte("0123456789abcdef0123456789abcdef")
+
+func TestLabels(t *testing.T) {
+	in := labels.FromStrings("__name__", "up", "instance", "a:9100", "job", "node")
+
+	cases := []struct {
+		name string
+		opts Options
+		want labels.Labels
+	}{
+		{
+			name: "all labels but the metric name",
+			opts: Options{Mode: Sequential},
+			want: labels.FromStrings("__name__", "up", "instance", "v1", "job", "v2"),
+		},
+		{
+			name: "keep",
+			opts: Options{Mode: Sequential, Keep: []string{"job"}},
+			want: labels.FromStrings("__name__", "up", "instance", "v1", "job", "node"),
+		},
+		{
+			name: "selected labels",
+			opts: Options{Mode: Sequential, Labels: []string{"job"}},
+			want: labels.FromStrings("__name__", "up", "instance", "a:9100", "job", "v1"),
+		},
+		{
+			name: "mapping of a previous run",
+			opts: Options{Mode: Sequential, Mapping: map[string]string{"v7": "node", "v3": "b:9100"}},
+			want: labels.FromStrings("__name__", "up", "instance", "v8", "job", "v7"),
+		},
+	}
+	for _, c := range cases {
+		a, err := New(c.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := a.Labels(in); !got.Equals(c.want) {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		}
+		if !a.OrderDependent() {
+			t.Errorf("%s: sequential mode not order dependent", c.name)
+		}
+	}
+}
+
+func TestHash(t *testing.T) {
+	lset := labels.FromStrings("instance", "a:9100", "job", "a:9100")
+
+	a1, err := New(Options{Mode: Hash, Key: testKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a2, err := New(Options{Mode: Hash, Key: testKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a3, err := New(Options{Mode: Hash, Key: []byte("another key of sixteen bytes")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := a1.Labels(lset)
+	if got.Get("instance") != got.Get("job") {
+		t.Errorf("same value got different pseudonyms: %v", got)
+	}
+	if got.Get("instance") == "a:9100" {
+		t.Errorf("value not replaced: %v", got)
+	}
+	if other := a2.Labels(lset); !other.Equals(got) {
+		t.Errorf("same key: got %v and %v", got, other)
+	}
+	if other := a3.Labels(lset); other.Equals(got) {
+		t.Errorf("different keys: got %v twice", got)
+	}
+	if a1.OrderDependent() {
+		t.Errorf("hash mode order dependent")
+	}
+
+	if _, err := New(Options{Mode: "unknown"}); err == nil {
+		t.Errorf("unknown mode accepted")
+	}
+}
+
+func TestMapping(t *testing.T) {
+	dir, err := ioutil.TempDir("", "anonymize")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "mapping")
+
+	a, err := New(Options{Mode: Sequential, Key: testKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Labels(labels.FromStrings("instance", "a", "job", "b"))
+	if err := a.SaveMapping(path); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := LoadMapping(path, []byte("another key of sixteen bytes")); err == nil {
+		t.Fatalf("mapping decrypted with the wrong key")
+	}
+	mapping, err := LoadMapping(path, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mapping) != 2 || mapping["v1"] != "a" || mapping["v2"] != "b" {
+		t.Fatalf("got mapping %v", mapping)
+	}
+
+	// Reloaded, values keep their pseudonyms whatever order they come in.
+	a, err = New(Options{Mode: Sequential, Key: testKey, Mapping: mapping})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := a.Labels(labels.FromStrings("instance", "c", "job", "b", "zone", "a"))
+	want := labels.FromStrings("instance", "v3", "job", "v2", "zone", "v1")
+	if !got.Equals(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	random, err := New(Options{Mode: Sequential})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := random.SaveMapping(path); err == nil {
+		t.Fatalf("mapping saved with a random key")
+	}
+}
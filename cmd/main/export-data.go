@@ -1,13 +1,22 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"github.com/prometheus/tsdb"
+	"github.com/qiffang/prom-tools/anonymize"
 	db2 "github.com/qiffang/prom-tools/db"
+	"github.com/qiffang/prom-tools/progress"
+	"github.com/qiffang/prom-tools/relabel"
+	"github.com/qiffang/prom-tools/timeparse"
 	"gopkg.in/alecthomas/kingpin.v2"
-	"math"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
 )
 
 func main() {
@@ -15,22 +24,325 @@ func main() {
 	dumpCmd              := cli.Command("dump", "dump samples from a TSDB")
 	dbPath               := dumpCmd.Arg("db path", "database path").String()
 	dumpDir				 := dumpCmd.Flag("dump-dir", "dump directory").String()
-	dumpMinTime          := dumpCmd.Flag("min-time", "minimum timestamp to dump").Default(strconv.FormatInt(math.MinInt64, 10)).Int64()
-	dumpMaxTime          := dumpCmd.Flag("max-time", "maximum timestamp to dump").Default(strconv.FormatInt(math.MaxInt64, 10)).Int64()
+	dumpTime             := addTimeFlags(dumpCmd, "dump")
+	dumpDownConvert      := dumpCmd.Flag("down-convert", "rewrite blocks in newer formats instead of passing them through unchanged").Bool()
+	dumpRelabel          := dumpCmd.Flag("relabel-config", "YAML file with relabel_configs, all series are rewritten with them").String()
+	dumpAnonymize        := dumpCmd.Flag("anonymize", "replace label values with pseudonyms, all series are rewritten").Enum(string(anonymize.Hash), string(anonymize.Sequential))
+	dumpAnonLabels       := dumpCmd.Flag("anonymize-label", "label whose values are replaced, all labels but the metric name by default").Strings()
+	dumpAnonKeep         := dumpCmd.Flag("anonymize-keep", "label whose values are kept when all labels are replaced").Strings()
+	dumpAnonKey          := dumpCmd.Flag("anonymize-key-file", "file with the hex encoded key, created if it does not exist, sequential pseudonyms are kept next to it").String()
+	dumpAnonMapping      := dumpCmd.Flag("anonymize-mapping", "write the pseudonyms and their values encrypted with the key into this file").String()
+	dumpDownsample       := dumpCmd.Flag("downsample", "aggregate series to this resolution, e.g. 5m").Duration()
+	deleteCmd            := cli.Command("delete", "delete series from a TSDB that Prometheus is not running on")
+	deletePath           := deleteCmd.Arg("db path", "database path").String()
+	deleteMatch          := deleteCmd.Flag("match", "series selector, e.g. up{job=\"node\"}, may be repeated").Required().Strings()
+	deleteTime           := addTimeFlags(deleteCmd, "delete")
+	deleteCompact        := deleteCmd.Flag("compact", "rewrite the blocks so that the data is removed from disk, refused if selected data is in the head").Bool()
+	compactCmd           := cli.Command("compact", "compact the blocks of a TSDB that Prometheus is not running on")
+	compactPath          := compactCmd.Arg("db path", "database path").String()
+	compactMinRange      := compactCmd.Flag("block-range-min", "block range of the first level").Default("2h").Duration()
+	compactSteps         := compactCmd.Flag("block-range-steps", "number of levels").Default("3").Int()
+	compactFactor        := compactCmd.Flag("block-range-factor", "factor between the block ranges of two levels").Default("5").Int()
+	compactRetention     := compactCmd.Flag("retention", "remove blocks older than this, relative to the newest block").Duration()
+	dumpBlockRange       := dumpCmd.Flag("block-range", "re-cut the output into blocks of this range aligned to the epoch, e.g. 2h").Duration()
+	dumpDryRun           := dumpCmd.Flag("dry-run", "print what would be written with size estimates, without writing anything").Bool()
+	dumpParallelism      := dumpCmd.Flag("parallelism", "number of blocks linked or converted, or of block ranges rewritten, at the same time").Default(strconv.Itoa(runtime.NumCPU())).Int()
+	dumpProgress         := dumpCmd.Flag("progress", "how progress is reported, auto draws a bar on a terminal and writes log lines otherwise").Default(string(progress.Auto)).Enum(string(progress.Auto), string(progress.Bar), string(progress.Log), string(progress.None))
+	mappingCmd           := cli.Command("show-mapping", "decrypt and print an anonymization mapping file")
+	mappingPath          := mappingCmd.Arg("mapping file", "mapping file").Required().String()
+	mappingKey           := mappingCmd.Flag("key-file", "file with the hex encoded key").Required().String()
+	verifyCmd            := cli.Command("verify", "check blocks, head and WAL of a TSDB for corruption")
+	verifyPath           := verifyCmd.Arg("db path", "database path").String()
+	repairCmd            := cli.Command("repair", "write a repaired copy of the blocks of a TSDB into a new directory")
+	repairPath           := repairCmd.Arg("db path", "database path").String()
+	repairOutput         := repairCmd.Flag("output", "output directory for the repaired blocks").Required().String()
+	mergeCmd             := cli.Command("merge", "merge several TSDBs into a new one, deduplicating identical samples")
+	mergeInputs          := &mergeInputList{}
+	mergeCmd.Arg("db paths", "database paths, each optionally followed by --add-label flags").Required().SetValue(mergeInputs)
+	mergeCmd.Flag("add-label", "label name=value to add to every series of the preceding database path").SetValue(&mergeLabel{inputs: mergeInputs})
+	mergeOutput          := mergeCmd.Flag("output", "output directory for the merged blocks").Required().String()
+	mergeTime            := addTimeFlags(mergeCmd, "merge")
+	splitCmd             := cli.Command("split", "split a TSDB into one TSDB per value of a label")
+	splitPath            := splitCmd.Arg("db path", "database path").String()
+	splitBy              := splitCmd.Flag("by", "name of the label to split by").Required().String()
+	splitDropLabel       := splitCmd.Flag("drop-label", "remove the label from the series written").Bool()
+	splitOutput          := splitCmd.Flag("output", "output directory, a TSDB is written into a subdirectory per label value").Required().String()
+	splitTime            := addTimeFlags(splitCmd, "split")
 
 	switch kingpin.MustParse(cli.Parse(os.Args[1:])) {
 	case dumpCmd.FullCommand():
-		db ,err := db2.Open(*dbPath, *dumpMinTime, *dumpMaxTime)
+		mint, maxt := dumpTime.parse()
+		db ,err := db2.Open(*dbPath, db2.WithTimeRange(mint, maxt))
 		if err != nil {
 			exitWithError(err)
 		}
+		defer db.Close()
 
-		if err := db.Dump(*dumpDir); err != nil {
+		fmt.Println("formats found:")
+		for _, f := range db.Formats() {
+			fmt.Println("  " + f)
+		}
+
+		opts := db2.DumpOptions{
+			Dir:         *dumpDir,
+			DownConvert: *dumpDownConvert,
+			Downsample:  int64(*dumpDownsample / time.Millisecond),
+			BlockRange:  int64(*dumpBlockRange / time.Millisecond),
+			Parallelism: *dumpParallelism,
+		}
+		if *dumpRelabel != "" {
+			opts.Relabel, err = relabel.LoadFile(*dumpRelabel)
+			if err != nil {
+				exitWithError(err)
+			}
+		}
+
+		if *dumpAnonymize != "" {
+			keyFile := *dumpAnonKey
+			if *dumpDryRun {
+				// Do not create the key file.
+				keyFile = ""
+			}
+			opts.Anonymizer, err = newAnonymizer(*dumpAnonymize, keyFile, *dumpAnonLabels, *dumpAnonKeep)
+			if err != nil {
+				exitWithError(err)
+			}
+		}
+
+		if *dumpDryRun {
+			plan, err := db.Plan(opts)
+			if err != nil {
+				exitWithError(err)
+			}
+			printPlan(plan)
+			return
+		}
+
+		opts.Progress, err = progress.New(os.Stderr, "dump", progress.Mode(*dumpProgress))
+		if err != nil {
+			exitWithError(err)
+		}
+		if err := db.Dump(context.Background(), opts); err != nil {
+			exitWithError(err)
+		}
+		if opts.Anonymizer != nil && *dumpAnonMapping != "" {
+			if err := opts.Anonymizer.SaveMapping(*dumpAnonMapping); err != nil {
+				exitWithError(err)
+			}
+		}
+		if opts.Anonymizer != nil && opts.Anonymizer.OrderDependent() && *dumpAnonKey != "" {
+			// Kept for the next run to give the same values the same pseudonyms.
+			if err := opts.Anonymizer.SaveMapping(anonymize.MappingPath(*dumpAnonKey)); err != nil {
+				exitWithError(err)
+			}
+		}
+	case deleteCmd.FullCommand():
+		mint, maxt := deleteTime.parse()
+		reports, err := db2.Delete(*deletePath, db2.DeleteOptions{
+			Matchers: *deleteMatch,
+			MinTime:  mint,
+			MaxTime:  maxt,
+			Compact:  *deleteCompact,
+		})
+		printReports(reports)
+		if err != nil {
+			exitWithError(err)
+		}
+	case compactCmd.FullCommand():
+		ranges := tsdb.ExponentialBlockRanges(int64(*compactMinRange/time.Millisecond), *compactSteps, *compactFactor)
+		reports, err := db2.Compact(*compactPath, db2.CompactOptions{
+			BlockRanges: ranges,
+			Retention:   int64(*compactRetention / time.Millisecond),
+		})
+		printReports(reports)
+		if err != nil {
+			exitWithError(err)
+		}
+	case mappingCmd.FullCommand():
+		key, err := anonymize.ReadKeyFile(*mappingKey)
+		if err != nil {
 			exitWithError(err)
 		}
+		mapping, err := anonymize.LoadMapping(*mappingPath, key)
+		if err != nil {
+			exitWithError(err)
+		}
+		for _, p := range anonymize.SortedPseudonyms(mapping) {
+			fmt.Printf("%s\t%s\n", p, mapping[p])
+		}
+	case verifyCmd.FullCommand():
+		reports, err := db2.Verify(*verifyPath)
+		if err != nil {
+			exitWithError(err)
+		}
+
+		if !printReports(reports) {
+			os.Exit(1)
+		}
+	case repairCmd.FullCommand():
+		reports, err := db2.Repair(*repairPath, *repairOutput)
+		printReports(reports)
+		if err != nil {
+			exitWithError(err)
+		}
+	case mergeCmd.FullCommand():
+		mint, maxt := mergeTime.parse()
+		reports, err := db2.Merge(*mergeInputs, *mergeOutput, mint, maxt)
+		printReports(reports)
+		if err != nil {
+			exitWithError(err)
+		}
+	case splitCmd.FullCommand():
+		mint, maxt := splitTime.parse()
+		reports, err := db2.Split(*splitPath, *splitOutput, db2.SplitOptions{
+			By:        *splitBy,
+			DropLabel: *splitDropLabel,
+			MinTime:   mint,
+			MaxTime:   maxt,
+		})
+		printReports(reports)
+		if err != nil {
+			exitWithError(err)
+		}
+	}
+}
+
+// timeFlags are the flags selecting the time range of a command.
+type timeFlags struct {
+	min, max, last, tz *string
+}
+
+func addTimeFlags(cmd *kingpin.CmdClause, verb string) *timeFlags {
+	return &timeFlags{
+		min:  cmd.Flag("min-time", "minimum timestamp to "+verb+": RFC3339, 2006-01-02 15:04:05, Unix seconds or milliseconds, or now-6h").String(),
+		max:  cmd.Flag("max-time", "maximum timestamp to "+verb+", in the same formats as --min-time").String(),
+		last: cmd.Flag("last", verb+" the data of this duration up to now, e.g. 2h").String(),
+		tz:   cmd.Flag("tz", "time zone of timestamps without one, e.g. Asia/Shanghai or Local").Default("UTC").String(),
 	}
 }
 
+// parse returns the time range in milliseconds, it exits on invalid input.
+func (f *timeFlags) parse() (int64, int64) {
+	p, err := timeparse.New(*f.tz, func(format string, args ...interface{}) {
+		fmt.Fprintf(os.Stderr, "warning: "+format+"\n", args...)
+	})
+	if err != nil {
+		exitWithError(err)
+	}
+
+	mint, maxt, err := p.Range(*f.min, *f.max, *f.last)
+	if err != nil {
+		exitWithError(err)
+	}
+	return mint, maxt
+}
+
+func printPlan(plan *db2.DumpPlan) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ACTION\tBLOCK\tMIN TIME\tMAX TIME\tBYTES\tSERIES\tSAMPLES\tOUTPUT BYTES")
+	for _, b := range plan.Blocks {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%d\t%d\t%d\n",
+			b.Action, b.Name, b.MinTime, b.MaxTime, b.Bytes, b.Series, b.Samples, b.OutputBytes)
+	}
+	w.Flush()
+
+	fmt.Printf("total output: ~%d bytes, %d bytes of them hardlinked\n", plan.OutputBytes, plan.LinkedBytes)
+}
+
+// newAnonymizer creates an anonymizer with the key of keyFile. Sequential
+// pseudonyms of previous runs are reloaded from the mapping next to it.
+func newAnonymizer(mode, keyFile string, labels, keep []string) (*anonymize.Anonymizer, error) {
+	opts := anonymize.Options{
+		Labels: labels,
+		Keep:   keep,
+		Mode:   anonymize.Mode(mode),
+	}
+	if keyFile != "" {
+		key, err := anonymize.ReadOrCreateKeyFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		opts.Key = key
+
+		path := anonymize.MappingPath(keyFile)
+		if opts.Mode == anonymize.Sequential && db2.Exists(path) {
+			if opts.Mapping, err = anonymize.LoadMapping(path, key); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return anonymize.New(opts)
+}
+
+// mergeInputList collects the database paths of the merge command.
+type mergeInputList []db2.MergeInput
+
+func (l *mergeInputList) Set(dir string) error {
+	*l = append(*l, db2.MergeInput{Dir: dir, Labels: map[string]string{}})
+	return nil
+}
+
+func (l *mergeInputList) String() string {
+	dirs := make([]string, 0, len(*l))
+	for _, in := range *l {
+		dirs = append(dirs, in.Dir)
+	}
+	return strings.Join(dirs, " ")
+}
+
+func (l *mergeInputList) IsCumulative() bool {
+	return true
+}
+
+// mergeLabel adds a label to the database path given last. Kingpin sets
+// arguments and flags in command line order.
+type mergeLabel struct {
+	inputs *mergeInputList
+}
+
+func (m *mergeLabel) Set(value string) error {
+	if len(*m.inputs) == 0 {
+		return fmt.Errorf("--add-label %s must follow a database path", value)
+	}
+
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("invalid label %q, expected name=value", value)
+	}
+	(*m.inputs)[len(*m.inputs)-1].Labels[parts[0]] = parts[1]
+	return nil
+}
+
+func (m *mergeLabel) String() string {
+	return ""
+}
+
+func (m *mergeLabel) IsCumulative() bool {
+	return true
+}
+
+func printReports(reports []*db2.Report) bool {
+	ok := true
+	for _, r := range reports {
+		status := "OK"
+		if !r.OK() {
+			status = "FAIL"
+			ok = false
+		}
+
+		fmt.Printf("%-4s %s\n", status, r.Name)
+		for _, info := range r.Info {
+			fmt.Printf("     %s\n", info)
+		}
+		for _, p := range r.Problems {
+			fmt.Printf("     - %s\n", p)
+		}
+	}
+
+	return ok
+}
+
 func exitWithError(err error) {
 	fmt.Fprintln(os.Stderr, err)
 	os.Exit(1)
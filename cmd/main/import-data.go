@@ -7,11 +7,17 @@ import (
 	"github.com/grafana-tools/sdk"
 	"github.com/pkg/errors"
 	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+	"github.com/qiffang/prom-tools/grafana"
+	"github.com/qiffang/prom-tools/replay"
+	"github.com/qiffang/prom-tools/timeparse"
 	"github.com/tidwall/sjson"
 	"github.com/wushilin/stream"
 	"gopkg.in/alecthomas/kingpin.v2"
 	"io/ioutil"
+	"math"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
@@ -20,22 +26,215 @@ import (
 
 const (
 	datasource = "json-import"
+	// datasourceUID identifies the replay datasource across runs.
+	datasourceUID = "prom-tools-replay"
 )
 
 func main() {
 	cli := kingpin.New(filepath.Base(os.Args[0]), "CLI tool for import prometheus query data")
 	importCmd := cli.Command("import", "import Promtheus data")
 	dbPath := importCmd.Arg("data path", "json directory path").String()
-	grafanaUrl := importCmd.Flag("grafana-url", "grafana address").Default("http://localhost:3000").String()
-	grafanaUser := importCmd.Flag("grafana-user", "grafana user").Default("admin").String()
-	grafanaPwd := importCmd.Flag("grafana-pwd", "grafana password").Default("admin").String()
+	importGrafana := addGrafanaFlags(importCmd)
+	folder := importCmd.Flag("folder", "grafana folder the dashboards are put into, the General folder if empty").Default("Replay").String()
+	provisioningDir := importCmd.Flag("provisioning-dir", "write the datasource and the dashboards into this grafana provisioning directory instead of calling the grafana API, with credentials the datasource file is only readable by its group, which has to be the one grafana runs as").String()
+	provisioningPath := importCmd.Flag("provisioning-dashboards-path", "directory of the dashboard JSON files as grafana sees it, the one they are written to by default").String()
+	dashboardsDir := importCmd.Flag("dashboards", "directory of dashboard JSON files uploaded with their datasources set to the replay server, the dashboards directory of the data path by default, one panel per query is generated without dashboards").String()
+	rebaseTo := importCmd.Flag("rebase-to", "shift all samples so that the last one is at this time, now or a timestamp; annotations stored in grafana are not shifted").String()
+	importListen := addListenFlags(importCmd)
+	advertiseUrl := importCmd.Flag("advertise-url", "URL grafana reaches the server at, by default the listen address with 127.0.0.1 for an unspecified host").String()
+	datasourceName := importCmd.Flag("datasource-name", "name of the grafana datasource of the server, different ones let replays run at the same time").Default(datasource).String()
+	tlsSkipVerify := importCmd.Flag("tls-skip-verify", "let grafana accept any certificate of the server, e.g. a self-signed one").Bool()
+	recordCmd := cli.Command("record", "proxy a Prometheus and save its responses for replaying")
+	recordUpstream := recordCmd.Flag("upstream", "URL of the Prometheus").Required().URL()
+	recordDir := recordCmd.Flag("dir", "directory the responses are saved to").Required().String()
+	recordListen := addListenFlags(recordCmd)
+	snapshotCmd := cli.Command("snapshot", "run the panel queries of Grafana dashboards against a Prometheus and save the responses for replaying")
+	snapshotGrafana := addGrafanaFlags(snapshotCmd)
+	snapshotDashboards := snapshotCmd.Flag("dashboard", "dashboards whose title contains this, case insensitive, all if not given").Strings()
+	snapshotPrometheus := snapshotCmd.Flag("prometheus-url", "URL of the Prometheus").Required().URL()
+	snapshotTime := addTimeFlags(snapshotCmd, "snapshot")
+	snapshotStep := snapshotCmd.Flag("step", "resolution of the range queries, by default the range divided into 1000 steps but at least 15s").Duration()
+	snapshotDir := snapshotCmd.Flag("dir", "directory the responses and dashboards are saved to").Required().String()
+	cleanupCmd := cli.Command("cleanup", "remove the datasource, dashboards and folder import created from grafana")
+	cleanupGrafana := addGrafanaFlags(cleanupCmd)
+	cleanupFolder := cleanupCmd.Flag("folder", "grafana folder the dashboards were put into, removed if it is empty").Default("Replay").String()
+	cleanupDatasource := cleanupCmd.Flag("datasource-name", "name of the grafana datasource import created").Default(datasource).String()
 
 	switch kingpin.MustParse(cli.Parse(os.Args[1:])) {
 	case importCmd.FullCommand():
-		NewServer(*dbPath, *grafanaUrl, *grafanaUser, *grafanaPwd).start()
+		var rebase *model.Time
+		if *rebaseTo != "" {
+			p, err := timeparse.New("", log.Warnf)
+			checkErr(err, "create time parser failed")
+			ms, err := p.Parse(*rebaseTo)
+			checkErr(err, "parse --rebase-to failed")
+			t := model.Time(ms)
+			rebase = &t
+		}
+
+		if *dashboardsDir == "" && replay.HasDashboards(filepath.Join(*dbPath, replay.DashboardsDir)) {
+			*dashboardsDir = filepath.Join(*dbPath, replay.DashboardsDir)
+		}
+
+		checkErr(importListen.listen().Check(), "invalid flags")
+		if *advertiseUrl == "" {
+			u, err := importListen.listen().URL()
+			checkErr(err, "invalid --listen")
+			*advertiseUrl = u
+		}
+
+		NewServer(*dbPath, serverOptions{
+			dashboardsDir:  *dashboardsDir,
+			rebaseTo:       rebase,
+			grafana:        importGrafana.client(),
+			folder:         *folder,
+			provisioning:   *provisioningDir,
+			dashboardsPath: *provisioningPath,
+			listen:         importListen,
+			datasource:     createDasource(*datasourceName, *advertiseUrl, importListen, *tlsSkipVerify),
+		}).start()
+	case recordCmd.FullCommand():
+		r, err := replay.NewRecorder(*recordDir)
+		checkErr(err, "open record directory failed")
+
+		checkErr(recordListen.listen().Check(), "invalid flags")
+
+		newRecorder(*recordUpstream, r, recordListen).start()
+	case snapshotCmd.FullCommand():
+		mint, maxt := snapshotTime.parse()
+		if mint >= maxt {
+			checkErr(errors.New("--min-time must be before --max-time"), "invalid time range")
+		}
+
+		r, err := replay.NewRecorder(*snapshotDir)
+		checkErr(err, "open snapshot directory failed")
+
+		s := &replay.Snapshotter{
+			Prometheus: *snapshotPrometheus,
+			Client:     &http.Client{Timeout: 2 * time.Minute},
+			Recorder:   r,
+			Start:      model.Time(mint).Time(),
+			End:        model.Time(maxt).Time(),
+			Step:       *snapshotStep,
+		}
+		if s.Step <= 0 {
+			s.Step = s.End.Sub(s.Start) / 1000
+			if s.Step < 15*time.Second {
+				s.Step = 15 * time.Second
+			}
+		}
+		snapshot(s, snapshotGrafana.sdkClient(), *snapshotDashboards)
+	case cleanupCmd.FullCommand():
+		cleanup(cleanupGrafana.client(), *cleanupFolder, *cleanupDatasource)
+	}
+}
+
+type grafanaFlags struct {
+	url, user, pwd, token *string
+}
+
+func addGrafanaFlags(cmd *kingpin.CmdClause) grafanaFlags {
+	return grafanaFlags{
+		url:   cmd.Flag("grafana-url", "grafana address").Default("http://localhost:3000").String(),
+		user:  cmd.Flag("grafana-user", "grafana user").Default("admin").String(),
+		pwd:   cmd.Flag("grafana-pwd", "grafana password").Default("admin").String(),
+		token: cmd.Flag("grafana-token", "grafana API token, used instead of user and password").String(),
+	}
+}
+
+func (f grafanaFlags) client() *grafana.Client {
+	return grafana.NewClient(*f.url, *f.user, *f.pwd, *f.token)
+}
+
+func (f grafanaFlags) sdkClient() *sdk.Client {
+	// The client authenticates with basic auth if the key has a colon, with
+	// the API token otherwise.
+	key := *f.token
+	if key == "" {
+		key = fmt.Sprintf("%s:%s", *f.user, *f.pwd)
+	}
+	return sdk.NewClient(*f.url, key, sdk.DefaultHTTPClient)
+}
+
+// timeFlags are the flags selecting the time range of a command.
+type timeFlags struct {
+	min, max, last, tz *string
+}
+
+func addTimeFlags(cmd *kingpin.CmdClause, verb string) timeFlags {
+	return timeFlags{
+		min:  cmd.Flag("min-time", "minimum timestamp to "+verb+": RFC3339, 2006-01-02 15:04:05, Unix seconds or milliseconds, or now-6h, an hour before --max-time by default").String(),
+		max:  cmd.Flag("max-time", "maximum timestamp to "+verb+", in the same formats as --min-time, now by default").String(),
+		last: cmd.Flag("last", verb+" the data of this duration up to now, e.g. 2h").String(),
+		tz:   cmd.Flag("tz", "time zone of timestamps without one, e.g. Asia/Shanghai or Local").Default("UTC").String(),
+	}
+}
+
+// parse returns the time range in milliseconds, it exits on invalid input.
+func (f timeFlags) parse() (int64, int64) {
+	p, err := timeparse.New(*f.tz, log.Warnf)
+	checkErr(err, "create time parser failed")
+
+	mint, maxt, err := p.Range(*f.min, *f.max, *f.last)
+	checkErr(err, "parse time range failed")
+	if maxt == math.MaxInt64 {
+		maxt = timeparse.Millis(p.Now)
+	}
+	if mint == math.MinInt64 {
+		mint = maxt - time.Hour.Nanoseconds()/1e6
+	}
+	return mint, maxt
+}
+
+// listenFlags configure how the replay and record servers listen.
+type listenFlags struct {
+	addr, certFile, keyFile *string
+	// user and pwd or token protect the API if set.
+	user, pwd, token *string
+}
+
+func addListenFlags(cmd *kingpin.CmdClause) listenFlags {
+	return listenFlags{
+		addr:     cmd.Flag("listen", "address the server listens on").Default("0.0.0.0:8080").String(),
+		certFile: cmd.Flag("tls-cert-file", "certificate to serve HTTPS with").String(),
+		keyFile:  cmd.Flag("tls-key-file", "key of the certificate to serve HTTPS with").String(),
+		user:     cmd.Flag("auth-user", "require basic auth with this user").String(),
+		pwd:      cmd.Flag("auth-pwd", "password of the basic auth user").String(),
+		token:    cmd.Flag("auth-token", "require this bearer token").String(),
+	}
+}
+
+func (f listenFlags) listen() replay.Listen {
+	return replay.Listen{
+		Addr:     *f.addr,
+		CertFile: *f.certFile,
+		KeyFile:  *f.keyFile,
+		User:     *f.user,
+		Password: *f.pwd,
+		Token:    *f.token,
 	}
 }
 
+// engine returns an engine that requires the configured auth.
+func (f listenFlags) engine() *gin.Engine {
+	engine := gin.Default()
+	if l := f.listen(); l.Auth() {
+		engine.Use(func(c *gin.Context) {
+			if !l.Authenticate(c.Writer, c.Request) {
+				c.Abort()
+			}
+		})
+	}
+	return engine
+}
+
+func (f listenFlags) run(engine *gin.Engine) error {
+	if f.listen().TLS() {
+		return engine.RunTLS(*f.addr, *f.certFile, *f.keyFile)
+	}
+	return engine.Run(*f.addr)
+}
+
 type status string
 type errorType string
 
@@ -47,56 +246,260 @@ type response struct {
 }
 
 type server struct {
-	files       map[string]string
-	grafanaUrl  string
-	grafanaUser string
-	grafanaPwd  string
-	board       *sdk.Board
+	store   *replay.Store
+	series  *replay.SeriesSet
+	grafana *grafana.Client
+	folder  string
+	// provisioning and dashboardsPath are the ones of serverOptions.
+	provisioning   string
+	dashboardsPath string
+	listen         listenFlags
+	datasource     grafana.Datasource
+	board          *sdk.Board
+	// dashboards are the original dashboards, uploaded instead of board.
+	dashboards []map[string]interface{}
+	// offset is added to the timestamps of all samples served.
+	offset time.Duration
 }
 
-func NewServer(path string, grafanaUrl string, grafanaUser string, grafanaPwd string) server {
-	files := make(map[string]string, 0)
-	filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
-		if info.IsDir() {
-			return nil
+type serverOptions struct {
+	// dashboardsDir is the directory of the original dashboards, one panel
+	// per query is generated if empty.
+	dashboardsDir string
+	// rebaseTo is the time the last sample is shifted to if set.
+	rebaseTo *model.Time
+	grafana  *grafana.Client
+	// folder is the title of the folder of the dashboards, the General
+	// folder if empty.
+	folder string
+	// provisioning is the grafana provisioning directory the datasource and
+	// the dashboards are written to instead of calling the grafana API.
+	provisioning string
+	// dashboardsPath is the directory of the provisioned dashboards as
+	// grafana sees it.
+	dashboardsPath string
+	listen         listenFlags
+	// datasource is the grafana datasource of the server.
+	datasource grafana.Datasource
+}
+
+// NewServer loads the responses saved in path and the dashboards in
+// opts.dashboardsDir if set. The dashboards show the time range of the
+// responses. If opts.rebaseTo is set, all samples are shifted so that the last
+// one is at rebaseTo, and so is the range.
+func NewServer(path string, opts serverOptions) server {
+	store, err := replay.OpenStore(path)
+	checkErr(err, "open replay directory failed")
+
+	var (
+		series = replay.NewSeriesSet()
+		span   replay.Span
+	)
+	for _, e := range store.Entries() {
+		d, err := replay.ReadQueryFile(store.Path(e))
+		if err != nil {
+			log.Warnf("series of %s are not served by the metadata endpoints: %v", e.File, err)
+			continue
 		}
+		series.Add(d.Result)
+		span.Add(d.Result)
+	}
 
-		if filepath.Ext(path) == ".json" {
-			files[extract(strings.TrimSuffix(path, filepath.Ext(path)))] = path
+	for _, e := range store.Others() {
+		if err := addSeries(series, store.Path(e), e); err != nil {
+			log.Warnf("series of %s are not served by the metadata endpoints: %v", e.File, err)
 		}
+	}
 
-		return nil
-	})
+	s := server{
+		store:          store,
+		series:         series,
+		grafana:        opts.grafana,
+		folder:         opts.folder,
+		provisioning:   opts.provisioning,
+		dashboardsPath: opts.dashboardsPath,
+		listen:         opts.listen,
+		datasource:     opts.datasource,
+		board:          createDashboard(path),
+	}
+	if opts.rebaseTo != nil && span.OK {
+		s.offset = span.Offset(*opts.rebaseTo)
+		log.Infof("samples from %s to %s are shifted by %s", span.Min.Time().UTC(), span.Max.Time().UTC(), s.offset)
+	}
+	// Show the range of the responses rather than one relative to now.
+	var from, to string
+	if span.OK {
+		from, to = span.Dashboard(s.offset)
+		s.board.Time = sdk.Time{From: from, To: to}
+	}
 
-	return server{
-		files:       files,
-		grafanaUrl:  grafanaUrl,
-		grafanaUser: grafanaUser,
-		grafanaPwd:  grafanaPwd,
-		board:       createDashboard(),
+	if opts.dashboardsDir != "" {
+		s.dashboards, err = replay.ReadDashboards(opts.dashboardsDir)
+		checkErr(err, "read dashboards failed")
+		if len(s.dashboards) == 0 {
+			log.Warnf("no dashboards in %s, one panel per query is generated", opts.dashboardsDir)
+		}
+	}
+	for _, board := range s.dashboards {
+		replay.RewriteDatasources(board, opts.datasource.Name)
+		// The replayed dashboards must not replace the originals if they are
+		// uploaded to the Grafana they were taken from, nor the ones of other
+		// replays.
+		key, _ := board["uid"].(string)
+		if key == "" {
+			key = fmt.Sprint(board["title"])
+		}
+		if opts.datasource.Name != datasource {
+			key = opts.datasource.Name + " " + key
+		}
+		board["uid"] = grafana.StableUID(key)
+		if span.OK {
+			board["time"] = map[string]interface{}{"from": from, "to": to}
+		}
 	}
+
+	return s
 }
 
 func (s server) start() {
 	s.initGrafana()
-	engine := gin.Default()
+	engine := s.listen.engine()
 
 	engine.GET("/api/v1/query", s.fakeQuery)
-	engine.GET("/api/v1/query_range", s.fakeQuery)
+	engine.POST("/api/v1/query", s.fakeQuery)
+	engine.GET("/api/v1/query_range", s.fakeQueryRange)
+	engine.POST("/api/v1/query_range", s.fakeQueryRange)
+	engine.GET("/api/v1/series", s.fakeSeries)
+	engine.POST("/api/v1/series", s.fakeSeries)
+	engine.GET("/api/v1/labels", s.fakeLabels)
+	engine.POST("/api/v1/labels", s.fakeLabels)
+	engine.GET("/api/v1/label/:name/values", s.fakeLabelValues)
+	engine.GET("/api/v1/metadata", s.fakeMetadata)
+
+	log.Fatal("StartServer server failed", s.listen.run(engine).Error())
+}
 
-	log.Fatal("StartServer server failed", engine.Run("0.0.0.0:8080").Error())
+// addSeries adds the series of a recorded series or label values response to
+// set.
+func addSeries(set *replay.SeriesSet, path string, e *replay.Entry) error {
+	var data interface{}
+	switch {
+	case e.Endpoint == "series":
+		data = &[]model.Metric{}
+	case strings.HasPrefix(e.Endpoint, "label/") && strings.HasSuffix(e.Endpoint, "/values"):
+		data = &[]string{}
+	default:
+		return nil
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, &response{Data: data}); err != nil {
+		return err
+	}
+
+	switch data := data.(type) {
+	case *[]model.Metric:
+		for _, m := range *data {
+			set.AddMetric(m)
+		}
+	case *[]string:
+		name := model.LabelName(strings.TrimSuffix(strings.TrimPrefix(e.Endpoint, "label/"), "/values"))
+		for _, v := range *data {
+			set.AddMetric(model.Metric{name: model.LabelValue(v)})
+		}
+	}
+	return nil
+}
+
+// recorder proxies the API of a Prometheus and saves the responses.
+type recorder struct {
+	proxy  *replay.Proxy
+	listen listenFlags
+}
+
+func newRecorder(upstream *url.URL, r *replay.Recorder, listen listenFlags) recorder {
+	return recorder{
+		proxy: &replay.Proxy{
+			Upstream: upstream,
+			Recorder: r,
+			Client:   &http.Client{Timeout: 5 * time.Minute},
+			// The credentials of the recorder are not the ones of the upstream.
+			DropAuth: listen.listen().Auth(),
+		},
+		listen: listen,
+	}
+}
+
+func (r recorder) start() {
+	engine := r.listen.engine()
+	engine.Any("/api/v1/*endpoint", gin.WrapH(r.proxy))
+
+	log.Fatal("StartServer server failed", r.listen.run(engine).Error())
+}
+
+// snapshot saves the responses of the panel queries of the dashboards whose
+// title contains one of titles.
+func snapshot(s *replay.Snapshotter, c *sdk.Client, titles []string) {
+	boardmetas, err := c.SearchDashboards("", false)
+	checkErr(err, "get board metas failed")
+
+	var total replay.SnapshotStats
+	for _, meta := range boardmetas {
+		if !matchTitle(meta.Title, titles) {
+			continue
+		}
+
+		raw, _, err := c.GetRawDashboard(meta.URI)
+		checkErr(err, fmt.Sprintf("get board %s failed", meta.URI))
+
+		name := meta.UID
+		if name == "" {
+			name = meta.Slug
+		}
+		stats, err := s.Dashboard(name, raw)
+		checkErr(err, fmt.Sprintf("snapshot board %s failed", meta.Title))
+		log.Infof("dashboard %q: %d queries, %d failed", meta.Title, stats.Queries, stats.Failed)
+
+		total.Queries += stats.Queries
+		total.Failed += stats.Failed
+	}
+	log.Infof("snapshot done: %d queries, %d failed", total.Queries, total.Failed)
+}
+
+func matchTitle(title string, titles []string) bool {
+	if len(titles) == 0 {
+		return true
+	}
+	for _, t := range titles {
+		if strings.Contains(strings.ToLower(title), strings.ToLower(t)) {
+			return true
+		}
+	}
+	return false
 }
 
 func (s server) initGrafana() {
+	if len(s.dashboards) > 0 {
+		s.AddDashboard()
+		return
+	}
+
 	row := s.board.AddRow("Import json format")
 
-	stream.FromMapKeys(s.files).Map(func(query string) string {
+	stream.FromArray(s.store.Entries()).Map(func(e *replay.Entry) string {
+		query := e.Query
 		str, err := sjson.Set(template, "targets.0.expr", query)
 		checkErr(err, "replace expr failed")
 
 		str, err = sjson.Set(str, "title", query)
 		checkErr(err, "replace title failed")
 
+		str, err = sjson.Set(str, "datasource", s.datasource.Name)
+		checkErr(err, "replace datasource failed")
+
 		return str
 	}).Filter(func(graph string) bool {
 		return graph != ""
@@ -115,46 +518,208 @@ func (s server) initGrafana() {
 	s.AddDashboard()
 }
 
+// fakeQuery answers an instant query with the sample of every series of the
+// saved response nearest to the time.
 func (s server) fakeQuery(c *gin.Context) {
-	queryFile, ok := s.files[c.Query("query")]
+	d, ok := s.load(c)
+	if !ok {
+		return
+	}
+
+	ts := model.Now()
+	if t := formValue(c, "time"); t != "" {
+		var err error
+		if ts, err = replay.ParseTime(t); err != nil {
+			badData(c, err)
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, response{Status: "success", Data: result(replay.Instant(d.Result, ts))})
+}
+
+// fakeQueryRange answers a range query with the saved response cut down to
+// the time range and resampled to the step.
+func (s server) fakeQueryRange(c *gin.Context) {
+	d, ok := s.load(c)
 	if !ok {
-		log.Error("file does not exist", "query="+c.Query("query"))
-		c.JSON(http.StatusBadRequest, errors.New("file does not exist"))
 		return
 	}
 
-	b, err := ioutil.ReadFile(queryFile)
+	start, err := replay.ParseTime(formValue(c, "start"))
 	if err != nil {
-		log.Error("query failed", "file="+queryFile, err)
-		c.JSON(http.StatusBadRequest, err)
+		badData(c, err)
+		return
+	}
+	end, err := replay.ParseTime(formValue(c, "end"))
+	if err != nil {
+		badData(c, err)
+		return
+	}
+	if end.Before(start) {
+		badData(c, errors.New("end timestamp must not be before start time"))
+		return
+	}
+	step, err := replay.ParseDuration(formValue(c, "step"))
+	if err != nil {
+		badData(c, err)
+		return
+	}
+	if err := replay.CheckRange(start, end, step); err != nil {
+		badData(c, err)
 		return
 	}
 
-	var r response
-	if err = json.Unmarshal(b, &r); err != nil {
+	c.JSON(http.StatusOK, response{Status: "success", Data: result(replay.Range(d.Result, start, end, step))})
+}
+
+// load reads the saved response of the query.
+func (s server) load(c *gin.Context) (*replay.QueryData, bool) {
+	query := formValue(c, "query")
+	e := s.store.Lookup(query)
+	if e == nil {
+		badData(c, errors.New("file does not exist"))
+		return nil, false
+	}
+
+	queryFile := s.store.Path(e)
+	d, err := replay.ReadQueryFile(queryFile)
+	if err != nil {
 		log.Error("read file failed", "file="+queryFile, err)
-		c.JSON(http.StatusBadRequest, err)
+		c.JSON(http.StatusInternalServerError, response{Status: "error", ErrorType: "internal", Error: err.Error()})
+		return nil, false
+	}
+	replay.Shift(d.Result, s.offset)
+
+	return d, true
+}
+
+func result(v model.Value) replay.QueryData {
+	return replay.QueryData{ResultType: v.Type(), Result: v}
+}
+
+// fakeSeries answers series requests from the series of all loaded files,
+// regardless of the time range.
+func (s server) fakeSeries(c *gin.Context) {
+	matches := formArray(c, "match[]")
+	if len(matches) == 0 {
+		badData(c, errors.New("no match[] parameter provided"))
 		return
 	}
 
-	c.JSON(http.StatusOK, r)
+	series, err := s.series.Select(matches...)
+	if err != nil {
+		badData(c, err)
+		return
+	}
+	if series == nil {
+		series = []model.Metric{}
+	}
+
+	c.JSON(http.StatusOK, response{Status: "success", Data: series})
+}
+
+func (s server) fakeLabels(c *gin.Context) {
+	names, err := s.series.LabelNames(formArray(c, "match[]")...)
+	if err != nil {
+		badData(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, response{Status: "success", Data: names})
+}
+
+func (s server) fakeLabelValues(c *gin.Context) {
+	values, err := s.series.LabelValues(c.Param("name"), formArray(c, "match[]")...)
+	if err != nil {
+		badData(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, response{Status: "success", Data: values})
+}
+
+func (s server) fakeMetadata(c *gin.Context) {
+	c.JSON(http.StatusOK, response{Status: "success", Data: s.series.Metadata(c.Query("metric"))})
+}
+
+// formValue returns the value of key in the URL or in a POSTed form.
+func formValue(c *gin.Context, key string) string {
+	if v, ok := c.GetQuery(key); ok {
+		return v
+	}
+	return c.PostForm(key)
 }
 
+// formArray returns the values of key in the URL and in a POSTed form.
+func formArray(c *gin.Context, key string) []string {
+	return append(c.QueryArray(key), c.PostFormArray(key)...)
+}
+
+func badData(c *gin.Context, err error) {
+	log.Error("bad request ", c.Request.URL, ": ", err)
+	c.JSON(http.StatusBadRequest, response{Status: "error", ErrorType: "bad_data", Error: err.Error()})
+}
+
+// AddDashboard creates the datasource and the dashboards, or updates them if a
+// previous run created them. With a provisioning directory the files are
+// written there instead.
 func (s server) AddDashboard() {
-	c := sdk.NewClient(s.grafanaUrl, fmt.Sprintf("%s:%s", s.grafanaUser, s.grafanaPwd), sdk.DefaultHTTPClient)
+	if s.provisioning != "" {
+		p := grafana.Provisioning{
+			Dir:            s.provisioning,
+			Datasource:     s.datasource,
+			Folder:         s.folder,
+			Dashboards:     s.boards(),
+			DashboardsPath: s.dashboardsPath,
+		}
+		checkErr(p.Write(), "error on write provisioning files")
+		log.Infof("datasource and %d dashboards written to %s, restart grafana to load them", len(p.Dashboards), s.provisioning)
+		return
+	}
+
+	boards := s.boards()
+	checkErr(s.grafana.Provision(s.datasource, s.folder, boards), "error on provision grafana")
+	log.Infof("datasource %s and %d dashboards uploaded", s.datasource.Name, len(boards))
+}
 
-	if _, err := c.CreateDatasource(createDasource()); err != nil {
-		checkErr(err, "error on create dasource")
+// boards returns the dashboards to provision, tagged with the datasource for
+// cleanup.
+func (s server) boards() []map[string]interface{} {
+	boards := s.dashboards
+	if len(boards) == 0 {
+		b, err := json.Marshal(s.board)
+		checkErr(err, "encode dashboard failed")
+		var board map[string]interface{}
+		checkErr(json.Unmarshal(b, &board), "encode dashboard failed")
+		boards = append(boards, board)
 	}
 
-	if err := c.SetDashboard(*s.board, false); err != nil {
-		checkErr(err, fmt.Sprintf("error on create dashboard %s", s.board.Title))
+	for _, board := range boards {
+		tags, _ := board["tags"].([]interface{})
+		board["tags"] = append(tags, grafana.Tag, s.datasource.Name)
 	}
+	return boards
 }
 
-func createDashboard() *sdk.Board {
-	board := sdk.NewBoard(fmt.Sprintf("Import json format dashboard - %d", time.Now().Unix()))
-	board.ID = uint(time.Now().Unix())
+// cleanup removes the dashboards, the datasource and the folder, if it is
+// empty then, that import created with the datasource name.
+func cleanup(c *grafana.Client, folder string, name string) {
+	deleted, err := c.Cleanup(grafana.Datasource{Name: name, UID: datasourceUIDOf(name)}, name, folder)
+	for _, d := range deleted {
+		log.Infof("%s deleted", d)
+	}
+	checkErr(err, "cleanup failed")
+}
+
+// createDashboard returns the dashboard generated for the responses in path,
+// its UID is the same for the same path.
+func createDashboard(path string) *sdk.Board {
+	abs, err := filepath.Abs(path)
+	checkErr(err, "resolve data path failed")
+
+	board := sdk.NewBoard(fmt.Sprintf("Import json format dashboard - %s", filepath.Base(abs)))
+	board.UID = grafana.StableUID(abs)
 	board.Time = sdk.Time{
 		From: "now-5d",
 		To:   "now",
@@ -163,13 +728,29 @@ func createDashboard() *sdk.Board {
 	return board
 }
 
-func createDasource() sdk.Datasource {
-	return sdk.Datasource{
-		Name:   datasource,
+// datasourceUIDOf returns the UID of the datasource name import creates.
+func datasourceUIDOf(name string) string {
+	if name == datasource {
+		return datasourceUID
+	}
+	return grafana.StableUID("datasource " + name)
+}
+
+// createDasource returns the datasource name of the server at url, with the
+// credentials the server requires.
+func createDasource(name string, url string, listen listenFlags, tlsSkipVerify bool) grafana.Datasource {
+	ds := grafana.Datasource{
+		UID:    datasourceUIDOf(name),
+		Name:   name,
 		Type:   "prometheus",
 		Access: "proxy",
-		URL:    "http://127.0.0.1:8080",
+		URL:    url,
 	}
+	if tlsSkipVerify {
+		ds.JSONData = map[string]interface{}{"tlsSkipVerify": true}
+	}
+	listen.listen().Credentials(&ds)
+	return ds
 }
 
 func checkErr(err error, msg string) {
@@ -178,15 +759,6 @@ func checkErr(err error, msg string) {
 	}
 }
 
-func extract(path string) string {
-	for i := len(path) - 1; i >= 0; i-- {
-		if path[i] == filepath.Separator {
-			return path[i+1:]
-		}
-	}
-	return path
-}
-
 var template = `
 {
   "aliasColors": {},
@@ -16,6 +16,9 @@ import (
 	"fmt"
 	"github.com/prometheus/prometheus/storage"
 	"github.com/prometheus/tsdb/labels"
+	"github.com/qiffang/prom-tools/anonymize"
+	"github.com/qiffang/prom-tools/progress"
+	"github.com/qiffang/prom-tools/relabel"
 	"io"
 	"runtime"
 	"runtime/pprof"
@@ -30,11 +33,56 @@ func main() {
 		importCmd      = cli.Command("import", "run importtool")
 		importDataPath = importCmd.Flag("input", "input file with samples data").String()
 		writeOutPath   = importCmd.Flag("output", "set the output path").Default("benchout").String()
+		relabelPath    = importCmd.Flag("relabel-config", "YAML file with relabel_configs applied to every series").String()
+		anonMode       = importCmd.Flag("anonymize", "replace label values with pseudonyms").Enum(string(anonymize.Hash), string(anonymize.Sequential))
+		anonLabels     = importCmd.Flag("anonymize-label", "label whose values are replaced, all labels but the metric name by default").Strings()
+		anonKeep       = importCmd.Flag("anonymize-keep", "label whose values are kept when all labels are replaced").Strings()
+		anonKeyFile    = importCmd.Flag("anonymize-key-file", "file with the hex encoded key, created if it does not exist, sequential pseudonyms are kept next to it").String()
+		anonMapping    = importCmd.Flag("anonymize-mapping", "write the pseudonyms and their values encrypted with the key into this file").String()
+		progressMode   = importCmd.Flag("progress", "how progress is reported, auto draws a bar on a terminal and writes log lines otherwise").Default(string(progress.Auto)).Enum(string(progress.Auto), string(progress.Bar), string(progress.Log), string(progress.None))
 	)
 
 	switch kingpin.MustParse(cli.Parse(os.Args[1:])) {
 	case importCmd.FullCommand():
-		err := run(*writeOutPath, *importDataPath)
+		var anon *anonymize.Anonymizer
+		if *anonMode != "" {
+			opts := anonymize.Options{
+				Labels: *anonLabels,
+				Keep:   *anonKeep,
+				Mode:   anonymize.Mode(*anonMode),
+			}
+			if *anonKeyFile != "" {
+				key, err := anonymize.ReadOrCreateKeyFile(*anonKeyFile)
+				if err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					os.Exit(1)
+				}
+				opts.Key = key
+
+				// Sequential pseudonyms of previous runs are kept.
+				path := anonymize.MappingPath(*anonKeyFile)
+				if _, err := os.Stat(path); err == nil && opts.Mode == anonymize.Sequential {
+					if opts.Mapping, err = anonymize.LoadMapping(path, key); err != nil {
+						fmt.Fprintln(os.Stderr, err)
+						os.Exit(1)
+					}
+				}
+			}
+
+			var err error
+			if anon, err = anonymize.New(opts); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		}
+
+		err := run(*writeOutPath, *importDataPath, *relabelPath, anon, progress.Mode(*progressMode))
+		if err == nil && anon != nil && *anonMapping != "" {
+			err = anon.SaveMapping(*anonMapping)
+		}
+		if err == nil && anon != nil && anon.OrderDependent() && *anonKeyFile != "" {
+			err = anon.SaveMapping(anonymize.MappingPath(*anonKeyFile))
+		}
 		if err != nil {
 			fmt.Fprintln(os.Stderr, err)
 			os.Exit(1)
@@ -47,6 +95,10 @@ type writeBenchmark struct {
 	samplesFile string
 	cleanup     bool
 
+	relabelConfigs []*relabel.Config
+	anonymizer     *anonymize.Anonymizer
+	progress       *progress.Tracker
+
 	storage *tsdb.DB
 
 	cpuprof   *os.File
@@ -56,12 +108,25 @@ type writeBenchmark struct {
 	logger    log.Logger
 }
 
-func run(outPath, samplesFile string) error {
+func run(outPath, samplesFile, relabelPath string, anonymizer *anonymize.Anonymizer, progressMode progress.Mode) error {
+	tracker, err := progress.New(os.Stderr, "import", progressMode)
+	if err != nil {
+		return err
+	}
 	b := &writeBenchmark{
 		outPath:     outPath,
 		samplesFile: samplesFile,
+		anonymizer:  anonymizer,
+		progress:    tracker,
 		logger:      log.NewLogfmtLogger(log.NewSyncWriter(os.Stderr)),
 	}
+	if relabelPath != "" {
+		cfgs, err := relabel.LoadFile(relabelPath)
+		if err != nil {
+			return err
+		}
+		b.relabelConfigs = cfgs
+	}
 	if b.outPath == "" {
 		dir, err := ioutil.TempDir("", "tsdb_bench")
 		if err != nil {
@@ -147,8 +212,24 @@ func (b *writeBenchmark) ingestScrapes(series []Series) (uint64, error) {
 	var mu sync.Mutex
 	var total uint64
 
+	b.progress.Start("series", len(series), 0)
+	defer b.progress.Finish()
+
+	if b.anonymizer != nil && b.anonymizer.OrderDependent() {
+		// The shards are ingested concurrently, pseudonyms are handed out
+		// in input order beforehand.
+		for _, s := range series {
+			if lset, ok := b.labels(s); ok {
+				b.anonymizer.Labels(lset)
+			}
+		}
+	}
+
+	// Series relabeled into the same label set are appended one after the
+	// other once the shards are done, so that their samples are in order.
+	ser, merged := b.mergeRelabeled(series)
+
 	var wg sync.WaitGroup
-	ser := series
 	for len(ser) > 0 {
 		l := 1000
 		if len(ser) < 1000 {
@@ -167,16 +248,86 @@ func (b *writeBenchmark) ingestScrapes(series []Series) (uint64, error) {
 			mu.Lock()
 			total += n
 			mu.Unlock()
+			b.progress.Add(len(batch), 0)
 			wg.Done()
 		}()
 	}
 	wg.Wait()
 
+	for _, group := range merged {
+		n, err := b.ingestScrapesShard(group)
+		if err != nil {
+			fmt.Println(" err", err)
+		}
+		total += n
+		b.progress.Add(len(group), 0)
+	}
+
 	fmt.Println("ingestion completed")
 
 	return total, nil
 }
 
+// labels returns the relabeled labels of s, false if s is dropped.
+func (b *writeBenchmark) labels(s Series) (labels.Labels, bool) {
+	if len(b.relabelConfigs) == 0 {
+		return s.Mets, true
+	}
+	lset := relabel.Process(s.Mets, b.relabelConfigs...)
+	return lset, len(lset) > 0
+}
+
+// mergeRelabeled returns the series that keep a label set of their own and the
+// groups of series that are relabeled into the same label set, sorted by
+// timestamp. Of samples with the same timestamp the first one read is kept.
+func (b *writeBenchmark) mergeRelabeled(series []Series) ([]Series, [][]Series) {
+	if len(b.relabelConfigs) == 0 {
+		// The series read are unique.
+		return series, nil
+	}
+
+	var (
+		order  []uint64
+		groups = map[uint64][]Series{}
+	)
+	var unique []Series
+	for _, s := range series {
+		lset, ok := b.labels(s)
+		if !ok {
+			// Skipped by the shards.
+			unique = append(unique, s)
+			continue
+		}
+		h := lset.Hash()
+		if _, ok := groups[h]; !ok {
+			order = append(order, h)
+		}
+		groups[h] = append(groups[h], s)
+	}
+
+	var merged [][]Series
+	for _, h := range order {
+		group := groups[h]
+		if len(group) == 1 {
+			unique = append(unique, group[0])
+			continue
+		}
+
+		sort.SliceStable(group, func(i, j int) bool { return group[i].Timestamp < group[j].Timestamp })
+		res := group[:1]
+		for _, s := range group[1:] {
+			if s.Timestamp != res[len(res)-1].Timestamp {
+				res = append(res, s)
+			}
+		}
+		lset, _ := b.labels(group[0])
+		logrus.Warnf("%d series are relabeled into %s, merged into %d samples", len(group), lset, len(res))
+		merged = append(merged, res)
+	}
+
+	return unique, merged
+}
+
 func (b *writeBenchmark) ingestScrapesShard(series []Series) (uint64, error) {
 	//ts := baset
 
@@ -190,8 +341,16 @@ func (b *writeBenchmark) ingestScrapesShard(series []Series) (uint64, error) {
 	scrape := make([]*sample, 0, len(series))
 
 	for _, s := range series {
+		lset, ok := b.labels(s)
+		if !ok {
+			continue
+		}
+		if b.anonymizer != nil {
+			lset = b.anonymizer.Labels(lset)
+		}
+
 		scrape = append(scrape, &sample{
-			labels:    s.Mets,
+			labels:    lset,
 			value:     s.Value,
 			timestamp: s.Timestamp,
 		})
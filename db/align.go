@@ -0,0 +1,132 @@
+package db
+
+import (
+	"context"
+	"github.com/oklog/ulid"
+	"github.com/pingcap/errors"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/tsdb"
+	"github.com/prometheus/tsdb/labels"
+	"github.com/qiffang/prom-tools/progress"
+)
+
+// alignment is what dumpAligned does with the blocks and the head.
+type alignment struct {
+	link, rewrite []*block
+	head          bool
+}
+
+// covers returns whether b is linked or rewritten.
+func (a *alignment) covers(b *block) bool {
+	for _, bs := range [][]*block{a.link, a.rewrite} {
+		for _, o := range bs {
+			if o == b {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// alignedPlan splits the native blocks within the time range of db into the
+// blocks that have the boundaries of blockRange and can be hardlinked and the
+// ones that have to be rewritten, together with the head if it is set. The
+// chunk encodings of the blocks to rewrite are read, blocks that turn out not
+// to be readable are left to dumpBlocks.
+func (db *DB) alignedPlan(blockRange int64) (*alignment, error) {
+	var (
+		a       = &alignment{}
+		blocks  []*block
+		windows = map[int64]struct{}{}
+	)
+	mark := func(mint, maxt int64) {
+		for t := alignDown(mint, blockRange); t < maxt; t += blockRange {
+			windows[t] = struct{}{}
+		}
+	}
+	aligned := func(b *block) bool {
+		return b.meta.MinTime == alignDown(b.meta.MinTime, blockRange) && b.meta.MaxTime-b.meta.MinTime == blockRange
+	}
+
+	for _, b := range db.blocks {
+		if !b.format.native() || !db.metaOverlap(b.meta) {
+			continue
+		}
+		blocks = append(blocks, b)
+		if !aligned(b) {
+			mark(b.meta.MinTime, b.meta.MaxTime)
+		}
+	}
+	a.head = db.head != nil && db.overlap(db.head.MinTime(), db.head.MaxTime())
+	if a.head {
+		// The maximum time of the head is inclusive.
+		mark(db.head.MinTime(), db.head.MaxTime()+1)
+	}
+
+	for _, b := range blocks {
+		if _, ok := windows[b.meta.MinTime]; !ok && aligned(b) {
+			a.link = append(a.link, b)
+			continue
+		}
+		ok, err := b.readable()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			log.Warnf("block %s (%s) cannot be re-cut", b.meta.ULID, b.format)
+			continue
+		}
+		a.rewrite = append(a.rewrite, b)
+	}
+
+	return a, nil
+}
+
+// dumpAligned writes the native blocks and the head into blocks aligned to
+// blockRange as planned by alignedPlan. Blocks that are aligned already are
+// hardlinked unless other data falls into their range, everything else is
+// rewritten.
+func (db *DB) dumpAligned(ctx context.Context, dumpdir string, blockRange int64, a *alignment, p *progress.Tracker) error {
+	for _, b := range a.link {
+		if err := link(b.meta.ULID.String(), b.dir, dumpdir); err != nil {
+			return errors.Wrap(err, "link block fail")
+		}
+		p.Add(1, blockSize(b))
+	}
+	if len(a.rewrite) == 0 && !a.head {
+		return nil
+	}
+
+	w, err := newAlignedBlockWriter(db.compactor, dumpdir, blockRange)
+	if err != nil {
+		return err
+	}
+	var uids []ulid.ULID
+	ranges := db.timeRanges(a.rewrite, a.head, blockRange)
+	err = db.eachRange(ctx, a.rewrite, a.head, ranges, 1, func(r *readers, tr timeRange) error {
+		err := r.eachSeries(ctx, tr.mint, tr.maxt, func(lset labels.Labels, it tsdb.SeriesIterator) error {
+			_, err := w.add(lset, it)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		ids, err := w.flush(nil)
+		uids = append(uids, ids...)
+		return err
+	})
+	if err != nil {
+		return errors.Wrap(err, "re-cut blocks")
+	}
+
+	for _, b := range a.rewrite {
+		p.Add(1, blockSize(b))
+	}
+	if a.head {
+		log.Infof("%d blocks and the head re-cut into %d aligned blocks", len(a.rewrite), len(uids))
+	} else {
+		log.Infof("%d blocks re-cut into %d aligned blocks", len(a.rewrite), len(uids))
+	}
+
+	return nil
+}
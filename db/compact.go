@@ -0,0 +1,258 @@
+package db
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/oklog/ulid"
+	"github.com/pingcap/errors"
+	"github.com/prometheus/tsdb"
+	"github.com/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/tsdb/fileutil"
+)
+
+// CompactOptions controls how Compact rewrites the blocks.
+type CompactOptions struct {
+	// BlockRanges are the block ranges in milliseconds of the compaction
+	// levels, as returned by tsdb.ExponentialBlockRanges.
+	BlockRanges []int64
+	// Retention drops blocks that end more than Retention milliseconds before
+	// the end of the newest block. Zero keeps all blocks.
+	Retention int64
+}
+
+// DefaultBlockRanges are the block ranges used if none are configured.
+func DefaultBlockRanges() []int64 {
+	return tsdb.ExponentialBlockRanges(minBlockRange, 3, 5)
+}
+
+// Compact compacts the blocks of dbpath in place, the way Prometheus does:
+// blocks beyond the retention are removed, tombstones are applied, overlapping
+// blocks are merged and adjacent blocks are compacted into the larger block
+// ranges. Unlike Prometheus the newest block is compacted as well. Prometheus
+// must not be running on dbpath.
+func Compact(dbpath string, opts CompactOptions) ([]*Report, error) {
+	if dbpath == "" {
+		return nil, errors.Errorf("empty prometheus data directory")
+	}
+	if len(opts.BlockRanges) == 0 {
+		opts.BlockRanges = DefaultBlockRanges()
+	}
+	if !sort.SliceIsSorted(opts.BlockRanges, func(i, j int) bool { return opts.BlockRanges[i] < opts.BlockRanges[j] }) {
+		return nil, errors.Errorf("block ranges %v are not ascending", opts.BlockRanges)
+	}
+
+	lock, _, err := fileutil.Flock(filepath.Join(dbpath, lockName))
+	if err != nil {
+		return nil, errors.Wrap(err, "lock data directory, is Prometheus still running?")
+	}
+	defer lock.Release()
+
+	compactor, err := newCompactor(opts.BlockRanges)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		reports []*Report
+		steps   = []struct {
+			name string
+			fn   func(*tsdb.LeveledCompactor, string, CompactOptions, *Report) error
+		}{
+			{"retention", applyRetention},
+			{"tombstones", cleanTombstones},
+			{overlapsName, func(c *tsdb.LeveledCompactor, dir string, _ CompactOptions, r *Report) error {
+				merged, err := mergeOverlapping(c, dir)
+				r.Info = merged.Info
+				return err
+			}},
+			{"levels", compactLevels},
+		}
+	)
+	for _, step := range steps {
+		r := &Report{Name: step.name}
+		reports = append(reports, r)
+
+		if err := step.fn(compactor, dbpath, opts, r); err != nil {
+			return reports, errors.Wrapf(err, "compact %s", step.name)
+		}
+	}
+
+	return reports, nil
+}
+
+// nativeBlocks reads the blocks of dir sorted by time. Blocks this tsdb
+// version cannot read are reported and left out.
+func nativeBlocks(dir string, r *Report) ([]*block, error) {
+	dirs, err := blockDirs(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "find blocks fail")
+	}
+
+	blocks := make([]*block, 0, len(dirs))
+	for _, d := range dirs {
+		meta, _, err := readMetaFile(d)
+		if err != nil {
+			return nil, errors.Wrap(err, "read meta file failed")
+		}
+		format, err := readBlockFormat(d, meta)
+		if err != nil {
+			return nil, errors.Wrapf(err, "read format of block %s failed", meta.ULID)
+		}
+		b := &block{dir: d, meta: meta, format: format}
+		// Compaction rewrites the blocks, so the chunk encodings are checked.
+		ok, err := b.readable()
+		if err != nil {
+			r.infof("block %s skipped: %v", meta.ULID, err)
+			continue
+		}
+		if !ok {
+			r.infof("block %s (%s) skipped", meta.ULID, format)
+			continue
+		}
+		blocks = append(blocks, b)
+	}
+	sort.Slice(blocks, func(i, j int) bool {
+		return blocks[i].meta.MinTime < blocks[j].meta.MinTime
+	})
+
+	return blocks, nil
+}
+
+func applyRetention(_ *tsdb.LeveledCompactor, dir string, opts CompactOptions, r *Report) error {
+	if opts.Retention <= 0 {
+		return nil
+	}
+
+	blocks, err := nativeBlocks(dir, r)
+	if err != nil {
+		return err
+	}
+
+	newest := int64(math.MinInt64)
+	for _, b := range blocks {
+		newest = max(newest, b.meta.MaxTime)
+	}
+	for _, b := range blocks {
+		if b.meta.MaxTime >= newest-opts.Retention {
+			continue
+		}
+		if err := os.RemoveAll(b.dir); err != nil {
+			return errors.Trace(err)
+		}
+		r.infof("removed %s ending at %s", b.meta.ULID, formatTime(b.meta.MaxTime))
+	}
+
+	return nil
+}
+
+func cleanTombstones(c *tsdb.LeveledCompactor, dir string, _ CompactOptions, r *Report) error {
+	blocks, err := nativeBlocks(dir, r)
+	if err != nil {
+		return err
+	}
+
+	for _, b := range blocks {
+		if b.meta.Stats.NumTombstones == 0 {
+			continue
+		}
+
+		ob, err := tsdb.OpenBlock(nil, b.dir, chunkenc.NewPool())
+		if err != nil {
+			return errors.Wrapf(err, "open block %s", b.meta.ULID)
+		}
+		uid, err := ob.CleanTombstones(dir, c)
+		ob.Close()
+		if err != nil {
+			return errors.Wrapf(err, "clean tombstones of %s", b.meta.ULID)
+		}
+		if uid == nil {
+			continue
+		}
+
+		if err := os.RemoveAll(b.dir); err != nil {
+			return errors.Trace(err)
+		}
+		if *uid == (ulid.ULID{}) {
+			r.infof("removed %s, no data left", b.meta.ULID)
+		} else {
+			r.infof("rewrote %s as %s", b.meta.ULID, uid)
+		}
+	}
+
+	return nil
+}
+
+// compactLevels compacts, level by level, the blocks that lie within the same
+// aligned range of the level into one block.
+func compactLevels(c *tsdb.LeveledCompactor, dir string, opts CompactOptions, r *Report) error {
+	for _, rng := range opts.BlockRanges[1:] {
+		blocks, err := nativeBlocks(dir, &Report{})
+		if err != nil {
+			return err
+		}
+
+		for _, group := range splitByRange(blocks, rng) {
+			if len(group) < 2 {
+				continue
+			}
+
+			var (
+				dirs = make([]string, 0, len(group))
+				ids  = make([]string, 0, len(group))
+			)
+			for _, b := range group {
+				dirs = append(dirs, b.dir)
+				ids = append(ids, b.meta.ULID.String())
+			}
+
+			uid, err := c.Compact(dir, dirs, nil)
+			if err != nil {
+				return errors.Wrapf(err, "compact blocks %v", ids)
+			}
+			for _, d := range dirs {
+				if err := os.RemoveAll(d); err != nil {
+					return errors.Trace(err)
+				}
+			}
+			r.infof("compacted %v into %s (%s)", ids, uid, time.Duration(rng)*time.Millisecond)
+		}
+	}
+
+	return nil
+}
+
+// splitByRange groups the blocks, sorted by time, that lie completely within
+// the same range aligned to rng. Blocks that cross a range boundary are not
+// in any group.
+func splitByRange(blocks []*block, rng int64) [][]*block {
+	var (
+		groups [][]*block
+		cur    []*block
+		start  int64
+	)
+	for _, b := range blocks {
+		t := alignDown(b.meta.MinTime, rng)
+		if b.meta.MaxTime > t+rng {
+			continue
+		}
+		if len(cur) > 0 && t != start {
+			groups = append(groups, cur)
+			cur = nil
+		}
+		start = t
+		cur = append(cur, b)
+	}
+	if len(cur) > 0 {
+		groups = append(groups, cur)
+	}
+
+	return groups
+}
+
+func formatTime(t int64) string {
+	return time.Unix(0, t*int64(time.Millisecond)).UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,220 @@
+package db
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/oklog/ulid"
+	"github.com/pingcap/errors"
+	"github.com/prometheus/tsdb"
+	"github.com/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/tsdb/fileutil"
+	"github.com/prometheus/tsdb/labels"
+	"github.com/qiffang/prom-tools/selector"
+)
+
+const lockName = "lock"
+
+// DeleteOptions selects the series and the time range to delete.
+type DeleteOptions struct {
+	// Matchers are series selectors, series matching any of them are deleted.
+	Matchers []string
+	MinTime  int64
+	MaxTime  int64
+	// Compact rewrites the blocks with tombstones so that the data is removed
+	// from disk. It is refused if selected data is in the head.
+	Compact bool
+}
+
+// Delete writes tombstones for the selected series into the blocks and the WAL
+// of dbpath, the same way the admin API of Prometheus does. Prometheus must
+// not be running on dbpath.
+func Delete(dbpath string, opts DeleteOptions) ([]*Report, error) {
+	if len(opts.Matchers) == 0 {
+		return nil, errors.Errorf("no series selected")
+	}
+	sets := make([][]labels.Matcher, 0, len(opts.Matchers))
+	for _, s := range opts.Matchers {
+		ms, err := selector.Parse(s)
+		if err != nil {
+			return nil, err
+		}
+		if matchesAll(ms) {
+			// Most likely a mistake.
+			return nil, errors.Errorf("selector %q matches every series", s)
+		}
+		sets = append(sets, ms)
+	}
+
+	lock, _, err := fileutil.Flock(filepath.Join(dbpath, lockName))
+	if err != nil {
+		return nil, errors.Wrap(err, "lock data directory, is Prometheus still running?")
+	}
+	defer lock.Release()
+
+	db, err := Open(dbpath, WithTimeRange(opts.MinTime, opts.MaxTime), withWALWrites())
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	if opts.Compact {
+		if err := checkHeadCompact(db, sets, opts); err != nil {
+			return nil, err
+		}
+	}
+
+	var reports []*Report
+	for _, b := range db.blocks {
+		if !db.metaOverlap(b.meta) {
+			continue
+		}
+		r := &Report{Name: b.meta.ULID.String()}
+		reports = append(reports, r)
+
+		native := b.format.native()
+		if native && opts.Compact {
+			// Compacting rewrites the chunks.
+			if native, err = b.readable(); err != nil {
+				return reports, err
+			}
+		}
+		if !native {
+			r.problemf("%s cannot be written, skipped", b.format)
+			continue
+		}
+		if err := deleteFromBlock(db.compactor, b, sets, opts, r); err != nil {
+			return reports, errors.Wrapf(err, "delete from block %s", r.Name)
+		}
+	}
+
+	if db.head != nil && db.overlap(db.head.MinTime(), db.head.MaxTime()) {
+		r := &Report{Name: walName}
+		reports = append(reports, r)
+
+		n, err := countSeries(db.head, sets, opts)
+		if err != nil {
+			return reports, err
+		}
+		for _, ms := range sets {
+			if err := db.head.Delete(opts.MinTime, opts.MaxTime, ms...); err != nil {
+				return reports, errors.Wrap(err, "delete from head")
+			}
+		}
+		r.infof("%d series, tombstones written", n)
+	}
+	if db.walErr != nil {
+		r := &Report{Name: walName}
+		r.problemf("%v, skipped", db.walErr)
+		reports = append(reports, r)
+	}
+
+	return reports, nil
+}
+
+// checkHeadCompact returns an error if selected data is in the head or the
+// WAL cannot be read, compacting only removes data from the blocks.
+func checkHeadCompact(db *DB, sets [][]labels.Matcher, opts DeleteOptions) error {
+	if db.walErr != nil {
+		return errors.Annotatef(db.walErr, "the WAL cannot be read, selected data in it would not be removed by compacting")
+	}
+	if db.head == nil || !db.overlap(db.head.MinTime(), db.head.MaxTime()) {
+		return nil
+	}
+	n, err := countSeries(db.head, sets, opts)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return errors.Errorf("%d selected series have samples in the head, which compacting cannot remove from the WAL; "+
+			"delete without compacting or wait until Prometheus has cut the time range into a block", n)
+	}
+	return nil
+}
+
+func deleteFromBlock(c *tsdb.LeveledCompactor, b *block, sets [][]labels.Matcher, opts DeleteOptions, r *Report) error {
+	ob, err := tsdb.OpenBlock(nil, b.dir, chunkenc.NewPool())
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	n, err := countSeries(ob, sets, opts)
+	if err != nil {
+		ob.Close()
+		return err
+	}
+	if n == 0 {
+		r.infof("no series matched")
+		return errors.Trace(ob.Close())
+	}
+
+	for _, ms := range sets {
+		if err := ob.Delete(opts.MinTime, opts.MaxTime, ms...); err != nil {
+			ob.Close()
+			return errors.Trace(err)
+		}
+	}
+	r.infof("%d series, tombstones written", n)
+
+	if !opts.Compact {
+		return errors.Trace(ob.Close())
+	}
+
+	uid, err := ob.CleanTombstones(filepath.Dir(b.dir), c)
+	ob.Close()
+	if err != nil {
+		return errors.Wrap(err, "rewrite block")
+	}
+	if uid == nil {
+		// The matched series have no chunks in the time range.
+		return nil
+	}
+	if err := os.RemoveAll(b.dir); err != nil {
+		return errors.Trace(err)
+	}
+	if *uid == (ulid.ULID{}) {
+		r.infof("no data left, block removed")
+	} else {
+		r.infof("rewritten as %s", uid)
+	}
+
+	return nil
+}
+
+// countSeries returns the number of series selected by any of the matcher sets
+// that have samples in the time range.
+func countSeries(b tsdb.BlockReader, sets [][]labels.Matcher, opts DeleteOptions) (int, error) {
+	q, err := tsdb.NewBlockQuerier(b, opts.MinTime, opts.MaxTime)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	defer q.Close()
+
+	seen := map[uint64]struct{}{}
+	for _, ms := range sets {
+		ss, err := q.Select(ms...)
+		if err != nil {
+			return 0, errors.Trace(err)
+		}
+		for ss.Next() {
+			if ss.At().Iterator().Next() {
+				seen[ss.At().Labels().Hash()] = struct{}{}
+			}
+		}
+		if err := ss.Err(); err != nil {
+			return 0, errors.Trace(err)
+		}
+	}
+
+	return len(seen), nil
+}
+
+// matchesAll returns whether ms select every series.
+func matchesAll(ms []labels.Matcher) bool {
+	for _, m := range ms {
+		if !m.Matches("") {
+			return false
+		}
+	}
+	return true
+}
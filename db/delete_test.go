@@ -0,0 +1,61 @@
+package db
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/tsdb"
+	"github.com/prometheus/tsdb/labels"
+)
+
+func TestDeleteCompactHead(t *testing.T) {
+	dir, err := ioutil.TempDir("", "delete")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A block with old data and a head with new data in the WAL.
+	writeTestBlock(t, dir, []labels.Labels{labels.FromStrings("__name__", "up", "job", "a")}, []int64{1000, 2000})
+	st, err := tsdb.Open(dir, nil, nil, &tsdb.Options{BlockRanges: DefaultBlockRanges(), NoLockfile: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := st.Appender()
+	for _, ts := range []int64{10000, 11000} {
+		if _, err := app.Add(labels.FromStrings("__name__", "up", "job", "a"), ts, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := app.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		matcher    string
+		mint, maxt int64
+		err        string
+	}{
+		// The head holds selected data.
+		{matcher: `{job="a"}`, mint: math.MinInt64, maxt: math.MaxInt64, err: "have samples in the head"},
+		// The head does not overlap the time range.
+		{matcher: `{job="a"}`, mint: 0, maxt: 5000},
+		// No selected series in the head.
+		{matcher: `{job="b"}`, mint: math.MinInt64, maxt: math.MaxInt64},
+	}
+	for _, c := range cases {
+		_, err := Delete(dir, DeleteOptions{Matchers: []string{c.matcher}, MinTime: c.mint, MaxTime: c.maxt, Compact: true})
+		switch {
+		case c.err == "" && err != nil:
+			t.Errorf("%s [%d, %d]: %v", c.matcher, c.mint, c.maxt, err)
+		case c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)):
+			t.Errorf("%s [%d, %d]: got error %v, want %q", c.matcher, c.mint, c.maxt, err, c.err)
+		}
+	}
+}
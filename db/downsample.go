@@ -0,0 +1,147 @@
+package db
+
+import (
+	"math"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/tsdb/labels"
+)
+
+// Aggregations written per resolution window by downsample.
+const (
+	aggrMin      = "min"
+	aggrMax      = "max"
+	aggrSum      = "sum"
+	aggrCount    = "count"
+	aggrLast     = "last"
+	aggrIncrease = "increase"
+)
+
+type sample struct {
+	t int64
+	v float64
+}
+
+// sliceIterator iterates over samples held in memory.
+type sliceIterator struct {
+	samples []sample
+	i       int
+}
+
+func newSliceIterator(samples []sample) *sliceIterator {
+	return &sliceIterator{samples: samples, i: -1}
+}
+
+func (it *sliceIterator) Next() bool {
+	it.i++
+	return it.i < len(it.samples)
+}
+
+func (it *sliceIterator) At() (int64, float64) {
+	s := it.samples[it.i]
+	return s.t, s.v
+}
+
+func (it *sliceIterator) Err() error {
+	return nil
+}
+
+// aggregatedSeries is a downsampled series of one aggregation.
+type aggregatedSeries struct {
+	labels  labels.Labels
+	samples []sample
+}
+
+// isCounter guesses from the metric name whether a series is a counter.
+func isCounter(name string) bool {
+	for _, suffix := range []string{"_total", "_count", "_sum", "_bucket"} {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// downsample aggregates the samples of a series per resolution window. The
+// aggregates are named <metric>:<aggregation>_<resolution> and timestamped
+// with the last sample of their window. The increase, which accounts for
+// counter resets, is only written for series that look like counters. NaN
+// values such as staleness markers are skipped.
+func downsample(lset labels.Labels, it sampleIterator, resolution int64) ([]aggregatedSeries, error) {
+	var (
+		counter = isCounter(lset.Get("__name__"))
+		aggrs   = map[string][]sample{}
+
+		window               = int64(math.MinInt64)
+		n                    int
+		lastT                int64
+		min, max, sum        float64
+		last, prev, increase float64
+		seen                 bool
+	)
+	emit := func() {
+		if n == 0 {
+			return
+		}
+		aggrs[aggrMin] = append(aggrs[aggrMin], sample{lastT, min})
+		aggrs[aggrMax] = append(aggrs[aggrMax], sample{lastT, max})
+		aggrs[aggrSum] = append(aggrs[aggrSum], sample{lastT, sum})
+		aggrs[aggrCount] = append(aggrs[aggrCount], sample{lastT, float64(n)})
+		aggrs[aggrLast] = append(aggrs[aggrLast], sample{lastT, last})
+		if counter {
+			aggrs[aggrIncrease] = append(aggrs[aggrIncrease], sample{lastT, increase})
+		}
+	}
+
+	for it.Next() {
+		t, v := it.At()
+		if math.IsNaN(v) {
+			continue
+		}
+
+		if w := alignDown(t, resolution); w != window {
+			emit()
+			window, n = w, 0
+			min, max, sum, increase = v, v, 0, 0
+		}
+
+		n++
+		lastT, last = t, v
+		sum += v
+		min = math.Min(min, v)
+		max = math.Max(max, v)
+
+		// The increase from the last sample of the previous window is
+		// counted in this one, so that the increases add up.
+		if seen {
+			if v >= prev {
+				increase += v - prev
+			} else {
+				increase += v
+			}
+		}
+		prev, seen = v, true
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	emit()
+
+	suffix := "_" + model.Duration(time.Duration(resolution)*time.Millisecond).String()
+	res := make([]aggregatedSeries, 0, len(aggrs))
+	for _, aggr := range []string{aggrMin, aggrMax, aggrSum, aggrCount, aggrLast, aggrIncrease} {
+		samples, ok := aggrs[aggr]
+		if !ok {
+			continue
+		}
+		name := lset.Get("__name__") + ":" + aggr + suffix
+		res = append(res, aggregatedSeries{
+			labels:  withLabels(lset, map[string]string{"__name__": name}),
+			samples: samples,
+		})
+	}
+
+	return res, nil
+}
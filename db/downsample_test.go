@@ -0,0 +1,122 @@
+package db
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/tsdb/labels"
+)
+
+func TestDownsample(t *testing.T) {
+	cases := []struct {
+		name    string
+		lset    labels.Labels
+		samples []sample
+		// want are the samples per aggregated series name.
+		want map[string][]sample
+	}{
+		{
+			name: "gauge",
+			lset: labels.FromStrings("__name__", "temp", "job", "a"),
+			samples: []sample{
+				{0, 3}, {20000, 1}, {40000, 2},
+				{60000, 5}, {90000, 4},
+				// An empty window is skipped.
+				{180000, 7},
+			},
+			want: map[string][]sample{
+				"temp:min_1m":   {{40000, 1}, {90000, 4}, {180000, 7}},
+				"temp:max_1m":   {{40000, 3}, {90000, 5}, {180000, 7}},
+				"temp:sum_1m":   {{40000, 6}, {90000, 9}, {180000, 7}},
+				"temp:count_1m": {{40000, 3}, {90000, 2}, {180000, 1}},
+				"temp:last_1m":  {{40000, 2}, {90000, 4}, {180000, 7}},
+			},
+		},
+		{
+			name: "counter with reset",
+			lset: labels.FromStrings("__name__", "requests_total", "job", "a"),
+			samples: []sample{
+				{0, 10}, {30000, 15},
+				// Reset to 0 and counted up to 3 again.
+				{60000, 20}, {90000, 3},
+				{120000, 8},
+			},
+			want: map[string][]sample{
+				"requests_total:min_1m":      {{30000, 10}, {90000, 3}, {120000, 8}},
+				"requests_total:max_1m":      {{30000, 15}, {90000, 20}, {120000, 8}},
+				"requests_total:sum_1m":      {{30000, 25}, {90000, 23}, {120000, 8}},
+				"requests_total:count_1m":    {{30000, 2}, {90000, 2}, {120000, 1}},
+				"requests_total:last_1m":     {{30000, 15}, {90000, 3}, {120000, 8}},
+				"requests_total:increase_1m": {{30000, 5}, {90000, 8}, {120000, 5}},
+			},
+		},
+		{
+			name:    "stale markers",
+			lset:    labels.FromStrings("__name__", "up"),
+			samples: []sample{{0, 1}, {10000, math.NaN()}, {20000, 1}, {70000, math.NaN()}},
+			want: map[string][]sample{
+				"up:min_1m":   {{20000, 1}},
+				"up:max_1m":   {{20000, 1}},
+				"up:sum_1m":   {{20000, 2}},
+				"up:count_1m": {{20000, 2}},
+				"up:last_1m":  {{20000, 1}},
+			},
+		},
+		{
+			name: "no samples",
+			lset: labels.FromStrings("__name__", "up"),
+			want: map[string][]sample{},
+		},
+	}
+	for _, c := range cases {
+		aggrs, err := downsample(c.lset, newSliceIterator(c.samples), 60000)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got := map[string][]sample{}
+		for _, a := range aggrs {
+			// All other labels are kept.
+			if want := withLabels(c.lset, map[string]string{"__name__": a.labels.Get("__name__")}); !a.labels.Equals(want) {
+				t.Errorf("%s: got labels %s, want %s", c.name, a.labels, want)
+			}
+			got[a.labels.Get("__name__")] = a.samples
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestIncreaseAddsUp(t *testing.T) {
+	// The increases of all windows add up to the increase of the whole
+	// series, although windows end between samples.
+	var samples []sample
+	v := 0.0
+	for ts := int64(0); ts < 600000; ts += 15000 {
+		v += 2
+		if ts == 300000 {
+			v = 1
+		}
+		samples = append(samples, sample{ts, v})
+	}
+
+	aggrs, err := downsample(labels.FromStrings("__name__", "x_total"), newSliceIterator(samples), 120000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sum float64
+	for _, a := range aggrs {
+		if a.labels.Get("__name__") != "x_total:increase_2m" {
+			continue
+		}
+		for _, s := range a.samples {
+			sum += s.v
+		}
+	}
+	// 39 increases of 2, one of them replaced by the reset to 1.
+	if sum != 77 {
+		t.Errorf("got a total increase of %v, want 77", sum)
+	}
+}
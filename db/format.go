@@ -0,0 +1,530 @@
+package db
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pingcap/errors"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/tsdb"
+	"github.com/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/tsdb/chunks"
+	"github.com/prometheus/tsdb/index"
+	"github.com/prometheus/tsdb/labels"
+	"github.com/prometheus/tsdb/wal"
+)
+
+const (
+	// chunkSegmentHeaderSize is the magic number, the format version and padding.
+	chunkSegmentHeaderSize = 8
+	outOfOrderHint         = "from-out-of-order"
+)
+
+var encodingNames = map[chunkenc.Encoding]string{
+	chunkenc.EncNone: "none",
+	chunkenc.EncXOR:  "XOR",
+	2:                "histogram",
+	3:                "float histogram",
+}
+
+func encodingName(e chunkenc.Encoding) string {
+	if name, ok := encodingNames[e]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", e)
+}
+
+// blockFormat describes the on-disk formats a block was written with.
+type blockFormat struct {
+	metaVersion  int
+	indexVersion int
+	outOfOrder   bool
+
+	mtx sync.Mutex
+	// encodings counts the chunk encodings, nil until readEncodings is called.
+	encodings map[chunkenc.Encoding]int
+}
+
+// readBlockFormat reads the meta file hints and the index version. The chunk
+// encodings are only read by readEncodings.
+func readBlockFormat(dir string, meta *tsdb.BlockMeta) (*blockFormat, error) {
+	f := &blockFormat{metaVersion: meta.Version}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, metaName))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var hints struct {
+		Compaction struct {
+			Hints []string `json:"hints"`
+		} `json:"compaction"`
+	}
+	if err := json.Unmarshal(b, &hints); err != nil {
+		return nil, errors.Trace(err)
+	}
+	for _, h := range hints.Compaction.Hints {
+		if h == outOfOrderHint {
+			f.outOfOrder = true
+		}
+	}
+
+	ix, err := os.Open(filepath.Join(dir, indexName))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer ix.Close()
+
+	header := make([]byte, index.HeaderLen)
+	if _, err := io.ReadFull(ix, header); err != nil {
+		return nil, errors.Wrap(err, "read index header")
+	}
+	if binary.BigEndian.Uint32(header) != index.MagicIndex {
+		return nil, errors.Errorf("invalid index magic number %x", header[:4])
+	}
+	f.indexVersion = int(header[4])
+
+	return f, nil
+}
+
+// readEncodings counts the chunk encodings of the block in dir unless they
+// have been counted already. It touches every chunk segment, so it is only
+// called for blocks that are rewritten.
+func (f *blockFormat) readEncodings(dir string) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if f.encodings != nil {
+		return nil
+	}
+
+	files, err := ioutil.ReadDir(chunkDir(dir))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	encodings := map[chunkenc.Encoding]int{}
+	for _, fi := range files {
+		if _, err := strconv.ParseUint(fi.Name(), 10, 64); err != nil {
+			continue
+		}
+		if err := countEncodings(filepath.Join(chunkDir(dir), fi.Name()), encodings); err != nil {
+			return errors.Wrapf(err, "read chunk segment %s", fi.Name())
+		}
+	}
+	f.encodings = encodings
+
+	return nil
+}
+
+// countEncodings seeks through a chunk segment only reading the chunk headers.
+func countEncodings(fn string, encodings map[chunkenc.Encoding]int) error {
+	f, err := os.Open(fn)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	size := fi.Size()
+
+	// The length and the encoding byte.
+	head := make([]byte, binary.MaxVarintLen32+1)
+	for off := int64(chunkSegmentHeaderSize); off < size; {
+		n, err := f.ReadAt(head, off)
+		if n == 0 {
+			return errors.Wrapf(err, "read chunk at offset %d", off)
+		}
+		l, ln := binary.Uvarint(head[:n])
+		if ln <= 0 {
+			return errors.Errorf("reading chunk length at offset %d failed", off)
+		}
+		// Segments may be preallocated and padded with zeros.
+		if l == 0 {
+			return nil
+		}
+		if ln >= n {
+			return errors.Errorf("reading chunk encoding at offset %d failed", off)
+		}
+		next := off + int64(ln) + 1 + int64(l) + crc32.Size
+		if l > uint64(size) || next > size {
+			return errors.Annotatef(errChunkLength, "length %d at offset %d, segment size %d", l, off, size)
+		}
+		encodings[chunkenc.Encoding(head[ln])]++
+		off = next
+	}
+
+	return nil
+}
+
+// native reports whether the block can be read by the tsdb version this tool
+// is built with. The chunk encodings are only checked once they have been read.
+func (f *blockFormat) native() bool {
+	if f.metaVersion != 1 || (f.indexVersion != index.FormatV1 && f.indexVersion != index.FormatV2) {
+		return false
+	}
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	for enc := range f.encodings {
+		if enc != chunkenc.EncXOR {
+			return false
+		}
+	}
+	return true
+}
+
+// convertible reports whether the block can be down-converted into a native one.
+func (f *blockFormat) convertible() bool {
+	return f.indexVersion == index.FormatV1 || f.indexVersion == index.FormatV2
+}
+
+func (f *blockFormat) String() string {
+	f.mtx.Lock()
+	encs := make([]string, 0, len(f.encodings))
+	for enc, n := range f.encodings {
+		encs = append(encs, fmt.Sprintf("%s(%d)", encodingName(enc), n))
+	}
+	read := f.encodings != nil
+	f.mtx.Unlock()
+	sort.Strings(encs)
+
+	s := fmt.Sprintf("meta v%d, index v%d", f.metaVersion, f.indexVersion)
+	if read {
+		s += ", chunks " + strings.Join(encs, " ")
+	}
+	if f.outOfOrder {
+		s += ", out-of-order"
+	}
+	return s
+}
+
+// unsupportedSeries returns the series of a block that have chunks this tsdb
+// version cannot decode.
+func unsupportedSeries(dir string) ([]uint64, error) {
+	ir, err := index.NewFileReader(filepath.Join(dir, indexName))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer ir.Close()
+
+	cr, err := newChunkVerifier(chunkDir(dir))
+	if err != nil {
+		return nil, err
+	}
+	defer cr.Close()
+
+	all, err := ir.Postings(index.AllPostingsKey())
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var (
+		refs []uint64
+		lset labels.Labels
+		chks []chunks.Meta
+	)
+	for all.Next() {
+		if err := ir.Series(all.At(), &lset, &chks); err != nil {
+			return nil, errors.Trace(err)
+		}
+		for _, c := range chks {
+			enc, err := cr.encoding(c)
+			if err != nil {
+				return nil, err
+			}
+			if enc != chunkenc.EncXOR {
+				refs = append(refs, all.At())
+				break
+			}
+		}
+	}
+
+	return refs, errors.Trace(all.Err())
+}
+
+// writeMetaFile writes meta as a version 1 meta file.
+func writeMetaFile(dir string, meta *tsdb.BlockMeta) error {
+	m := *meta
+	m.Version = 1
+
+	b, err := json.MarshalIndent(&m, "", "\t")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	path := filepath.Join(dir, metaName)
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0666); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(os.Rename(tmp, path))
+}
+
+// convertBlock writes a copy of a block that this tsdb version can read. The
+// meta file is rewritten as version 1 and series with chunk encodings that
+// cannot be decoded are dropped, it returns their number.
+func convertBlock(c *tsdb.LeveledCompactor, b *block, dumpdir string) (int, error) {
+	if !b.format.convertible() {
+		return 0, errors.Errorf("index v%d cannot be converted", b.format.indexVersion)
+	}
+
+	id := b.meta.ULID.String()
+	if err := link(id, b.dir, dumpdir); err != nil {
+		return 0, err
+	}
+	tmp := filepath.Join(dumpdir, id)
+	// The meta file is a hardlink, replace it instead of writing through it.
+	if err := os.Remove(filepath.Join(tmp, metaName)); err != nil {
+		return 0, errors.Trace(err)
+	}
+	if err := writeMetaFile(tmp, b.meta); err != nil {
+		return 0, errors.Wrap(err, "write meta file")
+	}
+
+	refs, err := unsupportedSeries(tmp)
+	if err != nil {
+		return 0, errors.Wrap(err, "find unsupported series")
+	}
+	if len(refs) == 0 {
+		log.Infof("block %s: dropped 0 series with unsupported chunk encodings", id)
+		return 0, nil
+	}
+
+	ob, err := tsdb.OpenBlock(nil, tmp, chunkenc.NewPool())
+	if err != nil {
+		return 0, errors.Wrap(err, "open converted block")
+	}
+	uid, err := c.Write(dumpdir, &withoutSeries{BlockReader: ob, refs: refs}, b.meta.MinTime, b.meta.MaxTime, b.meta)
+	ob.Close()
+	if err != nil {
+		return 0, errors.Wrap(err, "write converted block")
+	}
+	log.Warnf("block %s: dropped %d series with unsupported chunk encodings, written as %s", id, len(refs), uid)
+
+	return len(refs), errors.Trace(os.RemoveAll(tmp))
+}
+
+// walReadable reads the checkpoint and all segments of the WAL and returns an
+// error if a record cannot be decoded, e.g. because it is compressed or has a
+// type that was introduced after this tsdb version. The head must not be
+// loaded from such a WAL, loading it repairs the WAL by truncating it.
+func walReadable(dir string) error {
+	if !Exists(dir) {
+		return nil
+	}
+
+	ranges, err := walRanges(dir)
+	if err != nil {
+		return err
+	}
+	for _, sr := range ranges {
+		sgmReader, err := wal.NewSegmentsRangeReader(sr)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		var (
+			dec tsdb.RecordDecoder
+			r   = wal.NewReader(sgmReader)
+		)
+		for r.Next() {
+			if dec.Type(r.Record()) == tsdb.RecordInvalid {
+				sgmReader.Close()
+				return errors.Errorf("unknown record type %d in segment %d", r.Record()[0], r.Segment())
+			}
+		}
+		sgmReader.Close()
+		if err := r.Err(); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	return nil
+}
+
+// walRanges returns the segments of the last checkpoint and the ones after it,
+// which are what Prometheus loads the head from.
+func walRanges(dir string) ([]wal.SegmentRange, error) {
+	var ranges []wal.SegmentRange
+
+	start := -1
+	cpdir, cpidx, err := tsdb.LastCheckpoint(dir)
+	switch {
+	case err == tsdb.ErrNotFound:
+	case err != nil:
+		return nil, errors.Trace(err)
+	default:
+		ranges = append(ranges, wal.SegmentRange{Dir: cpdir, First: -1, Last: -1})
+		start = cpidx + 1
+	}
+
+	return append(ranges, wal.SegmentRange{Dir: dir, First: start, Last: -1}), nil
+}
+
+// replayWAL appends the samples of the WAL in dir to h and then deletes what
+// its tombstones cover, like the head does when it loads its own WAL, but
+// without writing to dir. Samples before minValidTime are skipped, as are
+// samples of unknown series and ones that are out of order.
+func replayWAL(h *tsdb.Head, dir string, minValidTime int64) error {
+	ranges, err := walRanges(dir)
+	if err != nil {
+		return err
+	}
+
+	var (
+		dec     tsdb.RecordDecoder
+		series  []tsdb.RefSeries
+		samples []tsdb.RefSample
+		lsets   = map[uint64]labels.Labels{}
+		stones  []walStone
+	)
+	for _, sr := range ranges {
+		sgmReader, err := wal.NewSegmentsRangeReader(sr)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		r := wal.NewReader(sgmReader)
+		for r.Next() {
+			rec := r.Record()
+			switch dec.Type(rec) {
+			case tsdb.RecordSeries:
+				series, err = dec.Series(rec, series[:0])
+				for _, s := range series {
+					lsets[s.Ref] = s.Labels
+				}
+			case tsdb.RecordSamples:
+				samples, err = dec.Samples(rec, samples[:0])
+				if err == nil {
+					err = appendWALSamples(h, lsets, samples, minValidTime)
+				}
+			case tsdb.RecordTombstones:
+				stones, err = decodeWALStones(rec, stones)
+			}
+			if err != nil {
+				sgmReader.Close()
+				return errors.Wrapf(err, "segment %d", r.Segment())
+			}
+		}
+		sgmReader.Close()
+		if err := r.Err(); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	for _, s := range stones {
+		lset, ok := lsets[s.ref]
+		if !ok || s.maxt < minValidTime {
+			continue
+		}
+		ms, err := exactMatchers(h, lset)
+		if err != nil {
+			return err
+		}
+		if err := h.Delete(s.mint, s.maxt, ms...); err != nil {
+			return errors.Wrap(err, "apply tombstones")
+		}
+	}
+
+	return nil
+}
+
+func appendWALSamples(h *tsdb.Head, lsets map[uint64]labels.Labels, samples []tsdb.RefSample, minValidTime int64) error {
+	app := h.Appender()
+	for _, s := range samples {
+		lset, ok := lsets[s.Ref]
+		if !ok || s.T < minValidTime {
+			continue
+		}
+		_, err := app.Add(lset, s.T, s.V)
+		switch errors.Cause(err) {
+		case nil, tsdb.ErrOutOfOrderSample, tsdb.ErrAmendSample:
+		default:
+			app.Rollback()
+			return errors.Wrapf(err, "append sample of %s", lset)
+		}
+	}
+	return errors.Trace(app.Commit())
+}
+
+// walStone is a deleted interval of a series of the WAL.
+type walStone struct {
+	ref        uint64
+	mint, maxt int64
+}
+
+// decodeWALStones appends the intervals of a tombstones record to stones, the
+// decoder of tsdb does not export them.
+func decodeWALStones(rec []byte, stones []walStone) ([]walStone, error) {
+	b := rec[1:]
+	for len(b) > 0 {
+		if len(b) < 8 {
+			return stones, errors.Errorf("decode tombstones: short record")
+		}
+		s := walStone{ref: binary.BigEndian.Uint64(b)}
+		b = b[8:]
+
+		var n int
+		if s.mint, n = binary.Varint(b); n <= 0 {
+			return stones, errors.Errorf("decode tombstones: invalid minimum time")
+		}
+		b = b[n:]
+		if s.maxt, n = binary.Varint(b); n <= 0 {
+			return stones, errors.Errorf("decode tombstones: invalid maximum time")
+		}
+		b = b[n:]
+
+		stones = append(stones, s)
+	}
+	return stones, nil
+}
+
+// exactMatchers returns matchers that select the series lset of h and no
+// series with further labels.
+func exactMatchers(h *tsdb.Head, lset labels.Labels) ([]labels.Matcher, error) {
+	ir, err := h.Index()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer ir.Close()
+	names, err := ir.LabelNames()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	ms := make([]labels.Matcher, 0, len(names))
+	for _, name := range names {
+		ms = append(ms, labels.NewEqualMatcher(name, lset.Get(name)))
+	}
+	return ms, nil
+}
+
+// linkWAL hardlinks the WAL segments and checkpoints unchanged.
+func linkWAL(dir, dumpdir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dumpdir, walName, rel)
+
+		if info.IsDir() {
+			return os.MkdirAll(target, 0777)
+		}
+		return errors.Wrapf(os.Link(path, target), "link %s", rel)
+	})
+}
@@ -0,0 +1,140 @@
+package db
+
+import (
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/tsdb/labels"
+)
+
+// corruptChunkLength overwrites the length of the first chunk of the block in
+// bdir with l.
+func corruptChunkLength(t *testing.T, bdir string, l uint64) {
+	// The first chunk follows the 8 byte segment header.
+	f, err := os.OpenFile(filepath.Join(chunkDir(bdir), "000001"), os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(buf, l)
+	if _, err := f.WriteAt(buf[:n], chunkSegmentHeaderSize); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadEncodings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "format")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	bdir := writeTestBlock(t, dir, []labels.Labels{
+		labels.FromStrings("__name__", "up", "job", "a"),
+		labels.FromStrings("__name__", "up", "job", "b"),
+	}, []int64{1000, 2000, 3000})
+	meta, _, err := readMetaFile(bdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := readBlockFormat(bdir, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.encodings != nil {
+		t.Fatalf("chunk encodings read by readBlockFormat")
+	}
+	if err := f.readEncodings(bdir); err != nil {
+		t.Fatal(err)
+	}
+	if f.encodings[chunkenc.EncXOR] != 2 || len(f.encodings) != 1 {
+		t.Fatalf("got encodings %v, want 2 XOR chunks", f.encodings)
+	}
+	if !f.native() {
+		t.Fatalf("block %s not native", f)
+	}
+
+	corruptChunkLength(t, bdir, 1<<30)
+	f, err = readBlockFormat(bdir, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.readEncodings(bdir); err == nil {
+		t.Fatalf("corrupt chunk length not detected")
+	}
+}
+
+func TestOpenSkipsChunksOutsideRange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "format")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	lsets := []labels.Labels{labels.FromStrings("__name__", "up")}
+	old := writeTestBlock(t, dir, lsets, []int64{1000, 2000})
+	writeTestBlock(t, dir, lsets, []int64{10000, 11000})
+	corruptChunkLength(t, old, 1<<30)
+
+	db, err := Open(dir, WithTimeRange(5000, 20000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	out := filepath.Join(dir, "out")
+	err = db.Dump(context.Background(), DumpOptions{Dir: out, Downsample: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirs, err := blockDirs(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dirs) != 1 {
+		t.Fatalf("dumped %d blocks, want 1", len(dirs))
+	}
+}
+
+func TestFormats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "format")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	lsets := []labels.Labels{labels.FromStrings("__name__", "up")}
+	writeTestBlock(t, dir, lsets, []int64{1000, 2000})
+	broken := writeTestBlock(t, dir, lsets, []int64{10000, 11000})
+	corruptChunkLength(t, broken, 1<<30)
+
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	formats := db.Formats()
+	if len(formats) != 3 {
+		t.Fatalf("got formats %v, want two blocks and the WAL", formats)
+	}
+	for _, f := range formats[:2] {
+		want := "chunks XOR(1)"
+		if strings.HasPrefix(f, filepath.Base(broken)) {
+			want = "chunks not readable"
+		}
+		if !strings.Contains(f, want) {
+			t.Errorf("got format %q, want %q", f, want)
+		}
+	}
+}
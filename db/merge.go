@@ -0,0 +1,138 @@
+package db
+
+import (
+	"context"
+	"sort"
+
+	"github.com/oklog/ulid"
+	"github.com/pingcap/errors"
+	"github.com/prometheus/tsdb"
+	"github.com/prometheus/tsdb/labels"
+)
+
+// MergeInput is a data directory to merge and the labels added to all of its series.
+type MergeInput struct {
+	Dir    string
+	Labels map[string]string
+}
+
+// Merge writes the series of all inputs within [mint, maxt] into outdir. Each
+// input is written into blocks aligned to the minimum block range, which are
+// then vertically compacted with the blocks of the other inputs covering the
+// same range. Samples with the same series and timestamp, as scraped by HA
+// pairs, are kept only once.
+func Merge(inputs []MergeInput, outdir string, mint, maxt int64) ([]*Report, error) {
+	if len(inputs) == 0 {
+		return nil, errors.Errorf("no data directories to merge")
+	}
+	for _, in := range inputs {
+		if err := checkOutputDir(in.Dir, outdir); err != nil {
+			return nil, err
+		}
+	}
+
+	compactor, err := newCompactor(tsdb.ExponentialBlockRanges(minBlockRange, 3, 5))
+	if err != nil {
+		return nil, err
+	}
+
+	var reports []*Report
+	for _, in := range inputs {
+		r := &Report{Name: in.Dir}
+		reports = append(reports, r)
+
+		if err := mergeInput(compactor, in, outdir, mint, maxt, r); err != nil {
+			return reports, errors.Wrapf(err, "merge %s", in.Dir)
+		}
+	}
+
+	r, err := mergeOverlapping(compactor, outdir)
+	if err != nil {
+		return reports, err
+	}
+
+	return append(reports, r), nil
+}
+
+func mergeInput(c *tsdb.LeveledCompactor, in MergeInput, outdir string, mint, maxt int64, r *Report) error {
+	db, err := Open(in.Dir, WithTimeRange(mint, maxt))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if db.walErr != nil {
+		r.problemf("%s: %v, skipped", walName, db.walErr)
+	}
+
+	w, err := newAlignedBlockWriter(c, outdir, minBlockRange)
+	if err != nil {
+		return err
+	}
+
+	var (
+		samples int
+		uids    []ulid.ULID
+		ranges  = db.timeRanges(db.blocks, true, minBlockRange)
+	)
+	err = db.eachRange(context.Background(), db.blocks, true, ranges, 1, func(rd *readers, tr timeRange) error {
+		add := func(lset labels.Labels, it sampleIterator) error {
+			n, err := w.add(lset, it)
+			if err != nil {
+				return err
+			}
+			samples += n
+			return nil
+		}
+		var err error
+		if len(in.Labels) > 0 {
+			// Series that only differed in a replaced label are merged.
+			_, err = rd.eachRelabeled(context.Background(), tr.mint, tr.maxt, func(lset labels.Labels) labels.Labels {
+				return withLabels(lset, in.Labels)
+			}, add)
+		} else {
+			err = rd.eachSeries(context.Background(), tr.mint, tr.maxt, func(lset labels.Labels, it tsdb.SeriesIterator) error {
+				return add(lset, it)
+			})
+		}
+		if err != nil {
+			return err
+		}
+		ids, err := w.flush(nil)
+		uids = append(uids, ids...)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(in.Labels) > 0 {
+		r.infof("labels %s", labels.FromMap(in.Labels))
+	}
+	r.infof("%d series, %d samples written into %d blocks", w.numSeries(), samples, len(uids))
+
+	return nil
+}
+
+// withLabels returns lset with the extra labels set. Extra labels replace
+// labels of the same name, an empty value removes the label.
+func withLabels(lset labels.Labels, extra map[string]string) labels.Labels {
+	if len(extra) == 0 {
+		return lset
+	}
+
+	res := make(labels.Labels, 0, len(lset)+len(extra))
+	for _, l := range lset {
+		if _, ok := extra[l.Name]; !ok {
+			res = append(res, l)
+		}
+	}
+	for name, value := range extra {
+		if value != "" {
+			res = append(res, labels.Label{Name: name, Value: value})
+		}
+	}
+	sort.Sort(res)
+
+	return res
+}
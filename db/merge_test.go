@@ -0,0 +1,138 @@
+package db
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/tsdb/labels"
+)
+
+func TestMerge(t *testing.T) {
+	lset := labels.FromStrings("__name__", "up", "job", "node")
+
+	cases := []struct {
+		name   string
+		labels []map[string]string
+		// want are the samples per series of the merged data.
+		want map[string]int
+	}{
+		{
+			// Samples of HA pairs at the same timestamps are kept once.
+			name:   "duplicates",
+			labels: []map[string]string{{}, {}},
+			want:   map[string]int{lset.String(): 4},
+		},
+		{
+			name:   "add label",
+			labels: []map[string]string{{"replica": "a"}, {"replica": "b"}},
+			want: map[string]int{
+				labels.FromStrings("__name__", "up", "job", "node", "replica", "a").String(): 3,
+				labels.FromStrings("__name__", "up", "job", "node", "replica", "b").String(): 3,
+			},
+		},
+		{
+			name:   "replace label",
+			labels: []map[string]string{{"job": "a"}, {}},
+			want: map[string]int{
+				labels.FromStrings("__name__", "up", "job", "a").String():    3,
+				labels.FromStrings("__name__", "up", "job", "node").String(): 3,
+			},
+		},
+		{
+			name:   "remove label",
+			labels: []map[string]string{{"job": ""}, {}},
+			want: map[string]int{
+				labels.FromStrings("__name__", "up").String():                3,
+				labels.FromStrings("__name__", "up", "job", "node").String(): 3,
+			},
+		},
+	}
+	for _, c := range cases {
+		dir, err := ioutil.TempDir("", "merge")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		var inputs []MergeInput
+		for i, ls := range c.labels {
+			in := filepath.Join(dir, string('a'+rune(i)))
+			if err := os.Mkdir(in, 0777); err != nil {
+				t.Fatal(err)
+			}
+			// The inputs overlap by two samples.
+			start := int64(i+1) * 1000
+			writeTestBlock(t, in, []labels.Labels{lset}, []int64{start, start + 1000, start + 2000})
+			inputs = append(inputs, MergeInput{Dir: in, Labels: ls})
+		}
+
+		out := filepath.Join(dir, "out")
+		reports, err := Merge(inputs, out, math.MinInt64, math.MaxInt64)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if len(reports) != len(inputs)+1 {
+			t.Errorf("%s: got %d reports, want one per input and the merge", c.name, len(reports))
+		}
+
+		got := readTestBlocks(t, out)
+		if len(got) != len(c.want) {
+			t.Errorf("%s: got series %v, want %v", c.name, got, c.want)
+		}
+		for s, n := range c.want {
+			if got[s] != n {
+				t.Errorf("%s: series %s has %d samples, want %d", c.name, s, got[s], n)
+			}
+		}
+	}
+}
+
+func TestMergeErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "merge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	in := filepath.Join(dir, "in")
+	if err := os.Mkdir(in, 0777); err != nil {
+		t.Fatal(err)
+	}
+	writeTestBlock(t, in, testSeries(1), []int64{1000})
+	full := filepath.Join(dir, "full")
+	if err := os.Mkdir(full, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(full, "file"), nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name   string
+		inputs []string
+		out    string
+		// reports is the number of reports returned with the error.
+		reports int
+	}{
+		{name: "no inputs", out: filepath.Join(dir, "out1")},
+		{name: "output is an input", inputs: []string{in}, out: in},
+		{name: "output not empty", inputs: []string{in}, out: full},
+		{name: "missing input", inputs: []string{in, filepath.Join(dir, "missing")}, out: filepath.Join(dir, "out2"), reports: 2},
+	}
+	for _, c := range cases {
+		var inputs []MergeInput
+		for _, d := range c.inputs {
+			inputs = append(inputs, MergeInput{Dir: d})
+		}
+		reports, err := Merge(inputs, c.out, math.MinInt64, math.MaxInt64)
+		if err == nil {
+			t.Errorf("%s: no error", c.name)
+		}
+		if len(reports) != c.reports {
+			t.Errorf("%s: got %d reports, want %d", c.name, len(reports), c.reports)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package db
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/pingcap/errors"
+	"github.com/prometheus/tsdb"
+	"github.com/prometheus/tsdb/labels"
+)
+
+// Actions of a dump plan.
+const (
+	ActionLink        = "link"
+	ActionPassThrough = "pass through"
+	ActionConvert     = "convert"
+	ActionRewrite     = "rewrite"
+	ActionCompact     = "compact"
+	ActionSkip        = "skip"
+)
+
+// defaultBytesPerSample is used to estimate the size of the head if there are
+// no blocks to take the average from.
+const defaultBytesPerSample = 2
+
+// PlannedBlock is what Dump would do with a block, the head or the WAL.
+type PlannedBlock struct {
+	Name    string
+	Action  string
+	MinTime int64
+	MaxTime int64
+	// Bytes is the size on disk, zero for the head.
+	Bytes int64
+	// Series, Samples and OutputBytes are estimated for the data within the
+	// time range that is written.
+	Series      int64
+	Samples     int64
+	OutputBytes int64
+}
+
+// DumpPlan lists what Dump would write without writing anything.
+type DumpPlan struct {
+	Blocks      []PlannedBlock
+	OutputBytes int64
+	// LinkedBytes is the part of OutputBytes that is hardlinked and does not
+	// take space on the same filesystem.
+	LinkedBytes int64
+}
+
+// Plan returns what Dump would do with the same options.
+func (db *DB) Plan(opts DumpOptions) (*DumpPlan, error) {
+	var (
+		p         = &DumpPlan{}
+		rewritten = len(opts.Relabel) > 0 || opts.Anonymizer != nil || opts.Downsample > 0
+		rewrite   = map[*block]bool{}
+		linked    = map[*block]bool{}
+	)
+	if opts.BlockRange > 0 && !rewritten {
+		a, err := db.alignedPlan(opts.BlockRange)
+		if err != nil {
+			return nil, err
+		}
+		for _, b := range a.rewrite {
+			rewrite[b] = true
+		}
+		for _, b := range a.link {
+			linked[b] = true
+		}
+	}
+
+	var blockBytes, blockSamples int64
+	for _, b := range db.blocks {
+		if !db.metaOverlap(b.meta) {
+			continue
+		}
+
+		size, err := dirSize(b.dir)
+		if err != nil {
+			return nil, err
+		}
+		blockBytes += size
+		blockSamples += int64(b.meta.Stats.NumSamples)
+
+		pb := PlannedBlock{
+			Name:        b.meta.ULID.String(),
+			MinTime:     b.meta.MinTime,
+			MaxTime:     b.meta.MaxTime,
+			Bytes:       size,
+			Series:      int64(b.meta.Stats.NumSeries),
+			Samples:     int64(b.meta.Stats.NumSamples),
+			OutputBytes: size,
+		}
+		// Like Dump, the chunk encodings are only read for blocks that are
+		// rewritten or might be converted.
+		native := b.format.native()
+		if native && (rewritten || opts.DownConvert && !linked[b]) {
+			if native, err = b.readable(); err != nil {
+				return nil, err
+			}
+		}
+		switch {
+		case !native && rewritten:
+			pb.Action = ActionSkip
+		case !native && opts.DownConvert:
+			pb.Action = ActionConvert
+		case !native:
+			pb.Action = ActionPassThrough
+		case rewritten || rewrite[b]:
+			// Only the samples within the time range are rewritten.
+			f := db.fraction(b.meta.MinTime, b.meta.MaxTime)
+			pb.Action = ActionRewrite
+			pb.Samples = int64(float64(pb.Samples) * f)
+			pb.OutputBytes = int64(float64(size) * f)
+		default:
+			pb.Action = ActionLink
+		}
+		if pb.Action == ActionSkip {
+			pb.Series, pb.Samples, pb.OutputBytes = 0, 0, 0
+		}
+		if pb.Action == ActionLink || pb.Action == ActionPassThrough {
+			p.LinkedBytes += pb.OutputBytes
+		}
+		p.Blocks = append(p.Blocks, pb)
+	}
+
+	switch {
+	case db.head != nil && db.overlap(db.head.MinTime(), db.head.MaxTime()):
+		series, samples, err := db.countHead()
+		if err != nil {
+			return nil, err
+		}
+
+		bytesPerSample := float64(defaultBytesPerSample)
+		if blockSamples > 0 {
+			bytesPerSample = float64(blockBytes) / float64(blockSamples)
+		}
+		pb := PlannedBlock{
+			Name:        "head",
+			Action:      ActionCompact,
+			MinTime:     db.head.MinTime(),
+			MaxTime:     db.head.MaxTime(),
+			Series:      series,
+			Samples:     samples,
+			OutputBytes: int64(float64(samples) * bytesPerSample),
+		}
+		if rewritten || opts.BlockRange > 0 {
+			pb.Action = ActionRewrite
+		}
+		p.Blocks = append(p.Blocks, pb)
+	case db.walErr != nil:
+		size, err := dirSize(filepath.Join(db.dbpath, walName))
+		if err != nil {
+			return nil, err
+		}
+		pb := PlannedBlock{
+			Name:        walName,
+			Action:      ActionPassThrough,
+			Bytes:       size,
+			OutputBytes: size,
+		}
+		if rewritten {
+			pb.Action, pb.OutputBytes = ActionSkip, 0
+		}
+		p.LinkedBytes += pb.OutputBytes
+		p.Blocks = append(p.Blocks, pb)
+	}
+
+	for _, pb := range p.Blocks {
+		p.OutputBytes += pb.OutputBytes
+	}
+
+	return p, nil
+}
+
+// fraction returns the part of [mint, maxt) within the time range of db.
+func (db *DB) fraction(mint, maxt int64) float64 {
+	if maxt <= mint {
+		return 0
+	}
+	start, end := max(mint, db.start), maxt
+	if db.end < maxt-1 {
+		end = db.end + 1
+	}
+	if end <= start {
+		return 0
+	}
+	return float64(end-start) / float64(maxt-mint)
+}
+
+// countHead counts the series and samples of the head within the time range.
+func (db *DB) countHead() (series, samples int64, err error) {
+	q, err := tsdb.NewBlockQuerier(db.head, db.start, db.end)
+	if err != nil {
+		return 0, 0, errors.Trace(err)
+	}
+	defer q.Close()
+
+	// Matches series without a metric name as well.
+	ss, err := q.Select(labels.NewMustRegexpMatcher("__name__", ".*"))
+	if err != nil {
+		return 0, 0, errors.Trace(err)
+	}
+	for ss.Next() {
+		it := ss.At().Iterator()
+		n := int64(0)
+		for it.Next() {
+			n++
+		}
+		if err := it.Err(); err != nil {
+			return 0, 0, errors.Trace(err)
+		}
+		if n > 0 {
+			series++
+			samples += n
+		}
+	}
+
+	return series, samples, errors.Trace(ss.Err())
+}
+
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, errors.Trace(err)
+}
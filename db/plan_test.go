@@ -0,0 +1,133 @@
+package db
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/tsdb"
+	"github.com/prometheus/tsdb/labels"
+)
+
+// dirState returns the size, mode and modification time of every file and
+// directory below dir.
+func dirState(t *testing.T, dir string) map[string]string {
+	res := map[string]string{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		res[path] = fmt.Sprintf("%d %s %s", info.Size(), info.Mode(), info.ModTime())
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestPlanHead(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeTestBlock(t, dir, []labels.Labels{labels.FromStrings("__name__", "up", "job", "a")}, []int64{1000, 2000})
+	st, err := tsdb.Open(dir, nil, nil, &tsdb.Options{BlockRanges: DefaultBlockRanges(), NoLockfile: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The samples of the later commits are older than the newest one of
+	// the first, a series has no metric name and one sample is deleted.
+	commits := []struct {
+		lset labels.Labels
+		ts   []int64
+	}{
+		{lset: labels.FromStrings("__name__", "up", "job", "a"), ts: []int64{10000, 12000}},
+		{lset: labels.FromStrings("job", "b"), ts: []int64{11000}},
+		{lset: labels.FromStrings("__name__", "up", "job", "c"), ts: []int64{10000, 11000}},
+	}
+	for _, c := range commits {
+		app := st.Appender()
+		for _, ts := range c.ts {
+			if _, err := app.Add(c.lset, ts, 1); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := app.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := st.Delete(11000, 11000, labels.NewEqualMatcher("job", "c")); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	before := dirState(t, dir)
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := db.Plan(DumpOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	after := dirState(t, dir)
+	for path, s := range before {
+		if after[path] != s {
+			t.Errorf("%s changed from %s to %s", path, s, after[path])
+		}
+	}
+	for path := range after {
+		if _, ok := before[path]; !ok {
+			t.Errorf("%s created", path)
+		}
+	}
+
+	if len(p.Blocks) != 2 {
+		t.Fatalf("got %d planned blocks, want the block and the head", len(p.Blocks))
+	}
+	head := p.Blocks[1]
+	if head.Action != ActionCompact || head.Series != 3 || head.Samples != 4 {
+		t.Errorf("got head %s with %d series and %d samples, want %s with 3 series and 4 samples",
+			head.Action, head.Series, head.Samples, ActionCompact)
+	}
+	if head.MinTime != 10000 || head.MaxTime != 12000 {
+		t.Errorf("got head [%d, %d], want [10000, 12000]", head.MinTime, head.MaxTime)
+	}
+}
+
+func TestPlanWithoutWAL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeTestBlock(t, dir, testSeries(2), []int64{1000, 2000})
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	p, err := db.Plan(DumpOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Blocks) != 1 || p.Blocks[0].Action != ActionLink {
+		t.Errorf("got planned blocks %v, want the linked block", p.Blocks)
+	}
+	if Exists(filepath.Join(dir, walName)) {
+		t.Errorf("WAL directory created")
+	}
+}
@@ -3,17 +3,22 @@ package db
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"github.com/oklog/ulid"
 	"github.com/pingcap/errors"
 	"github.com/prometheus/common/log"
 	"github.com/prometheus/tsdb"
 	"github.com/prometheus/tsdb/chunkenc"
 	"github.com/prometheus/tsdb/wal"
-	"github.com/wushilin/stream"
+	"github.com/qiffang/prom-tools/anonymize"
+	"github.com/qiffang/prom-tools/progress"
+	"github.com/qiffang/prom-tools/relabel"
 	"io/ioutil"
 	"math"
 	"os"
 	"path/filepath"
+	"sort"
+	"sync"
 	"time"
 )
 
@@ -25,7 +30,19 @@ const (
 	minBlockRange = int64(2*time.Hour) / 1e6
 )
 
-type promdb struct {
+var (
+	// ErrEmptyPath is returned if no data directory is given.
+	ErrEmptyPath = errors.New("empty prometheus data directory")
+	// ErrNoBlocks is returned by Open if the data directory has neither
+	// blocks nor a WAL.
+	ErrNoBlocks = errors.New("no blocks and no WAL found")
+	// ErrMetaVersion is returned for meta files of an unknown version.
+	ErrMetaVersion = errors.New("unsupported meta file version")
+)
+
+// DB is a Prometheus data directory opened for reading. The head is loaded
+// from the WAL when it is opened, blocks are read when they are needed.
+type DB struct {
 	dbpath string
 
 	compactor *tsdb.LeveledCompactor
@@ -33,102 +50,446 @@ type promdb struct {
 	end       int64
 	blocks    []*block
 	head      *tsdb.Head
+	// walErr is set if the head could not be loaded from the WAL.
+	walErr error
 }
 
 type block struct {
-	dir  string
-	meta *tsdb.BlockMeta
+	dir    string
+	meta   *tsdb.BlockMeta
+	format *blockFormat
+}
+
+// readable reads the chunk encodings of b if needed and returns whether b can
+// be read by the tsdb version this tool is built with.
+func (b *block) readable() (bool, error) {
+	if err := b.format.readEncodings(b.dir); err != nil {
+		return false, errors.Wrapf(err, "read chunks of block %s", b.meta.ULID)
+	}
+	return b.format.native(), nil
+}
+
+// BlockInfo describes a block of the data directory.
+type BlockInfo struct {
+	Dir    string
+	Meta   tsdb.BlockMeta
+	Format string
+	// Native is false for blocks in formats newer than this package reads.
+	Native bool
+}
+
+// DumpOptions controls how blocks are written by Dump.
+type DumpOptions struct {
+	// Dir is the directory the blocks are written to.
+	Dir string
+	// DownConvert rewrites blocks in formats newer than the ones this tool
+	// is built with, instead of passing them through unchanged.
+	DownConvert bool
+	// Relabel rewrites all series with the relabel configs instead of
+	// hardlinking the blocks. Series dropped by them are not written.
+	Relabel []*relabel.Config
+	// Anonymizer replaces label values after relabeling, all series are
+	// rewritten as with Relabel.
+	Anonymizer *anonymize.Anonymizer
+	// Downsample is the resolution in milliseconds series are aggregated to,
+	// all series are rewritten as with Relabel.
+	Downsample int64
+	// Parallelism is the number of blocks linked or converted, or of block
+	// ranges rewritten, at the same time, 1 if it is not set.
+	Parallelism int
+	// Progress is started and finished by Dump if it is set.
+	Progress *progress.Tracker
+	// BlockRange re-cuts the output into blocks of this range in milliseconds
+	// aligned to the epoch, like the blocks Prometheus writes. Blocks that
+	// already have these boundaries are hardlinked.
+	BlockRange int64
+}
+
+type options struct {
+	start       int64
+	end         int64
+	blockRanges []int64
+	writeWAL    bool
+}
+
+// Option configures Open.
+type Option func(*options)
+
+// WithTimeRange limits the DB to the data between mint and maxt in
+// milliseconds, both inclusive. By default all data is used.
+func WithTimeRange(mint, maxt int64) Option {
+	return func(o *options) {
+		o.start, o.end = mint, maxt
+	}
 }
 
-func Open(dbpath string, startTimeInMilliSec int64, endTimeInMilliSec int64) (*promdb, error) {
+// WithBlockRanges sets the block ranges in milliseconds of the compactor
+// that writes blocks, DefaultBlockRanges by default.
+func WithBlockRanges(ranges []int64) Option {
+	return func(o *options) {
+		o.blockRanges = ranges
+	}
+}
+
+// withWALWrites opens the WAL for writing, so that deletions from the head
+// are logged to it. Loading the head then cuts a new segment and repairs a
+// corrupted WAL.
+func withWALWrites() Option {
+	return func(o *options) {
+		o.writeWAL = true
+	}
+}
+
+// Open opens the data directory dbpath and loads the head from the WAL. A WAL
+// that cannot be read is left alone. The directory is not modified, the WAL is
+// only read.
+func Open(dbpath string, opts ...Option) (*DB, error) {
 	if dbpath == "" {
-		return nil, errors.Errorf("empty prometheus data directory")
+		return nil, ErrEmptyPath
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	compactor, err := tsdb.NewLeveledCompactor(ctx, nil, nil, tsdb.ExponentialBlockRanges(minBlockRange, 3, 5), chunkenc.NewPool())
-	if err != nil {
-		cancel()
-		return nil, errors.Wrap(err, "create leveled compactor")
+	o := &options{
+		start:       math.MinInt64,
+		end:         math.MaxInt64,
+		blockRanges: DefaultBlockRanges(),
+	}
+	for _, opt := range opts {
+		opt(o)
 	}
 
-	dirs, err := blockDirs(dbpath)
+	compactor, err := newCompactor(o.blockRanges)
 	if err != nil {
-		return nil, errors.Trace(errors.Wrap(err, "find blocks fail"))
+		return nil, err
 	}
 
-	head, err := openHead(dbpath)
+	dirs, err := blockDirs(dbpath)
 	if err != nil {
-		return nil, errors.Wrap(err, "open head block fail")
+		return nil, errors.Wrap(err, "find blocks fail")
+	}
+	if len(dirs) == 0 && !Exists(filepath.Join(dbpath, walName)) {
+		return nil, errors.Annotatef(ErrNoBlocks, "open %s", dbpath)
 	}
 
 	minValidTime := int64(math.MinInt64)
 
-	blocks := make([]*block, len(dirs))
-	stream.FromArray(dirs).
-		Map(func(dir string) *block {
-			meta, _, err := readMetaFile(dir)
-			if err != nil {
-				panic(errors.Wrap(err, "read meta file failed"))
-			}
-			return &block{
-				dir:  dir,
-				meta: meta,
-			}
-		}).Peek(func(b *block) {
-		minValidTime = max(minValidTime, b.meta.MaxTime)
-	}).CollectTo(blocks)
+	blocks := make([]*block, 0, len(dirs))
+	for _, dir := range dirs {
+		meta, _, err := readMetaFile(dir)
+		if err != nil {
+			return nil, errors.Wrap(err, "read meta file failed")
+		}
+		format, err := readBlockFormat(dir, meta)
+		if err != nil {
+			return nil, errors.Wrapf(err, "read format of block %s failed", meta.ULID)
+		}
+		blocks = append(blocks, &block{
+			dir:    dir,
+			meta:   meta,
+			format: format,
+		})
+		minValidTime = max(minValidTime, meta.MaxTime)
+	}
+	sort.Slice(blocks, func(i, j int) bool {
+		return blocks[i].meta.MinTime < blocks[j].meta.MinTime
+	})
 
-	if initErr := head.Init(minValidTime); initErr != nil {
-		return nil, errors.Wrap(err, "init head fail")
+	var head *tsdb.Head
+	walErr := walReadable(filepath.Join(dbpath, walName))
+	if walErr != nil {
+		log.Warnf("WAL cannot be loaded, it will be passed through unchanged: %v", walErr)
+	} else {
+		head, err = openHead(dbpath, minValidTime, o.writeWAL)
+		if err != nil {
+			return nil, errors.Wrap(err, "open head block fail")
+		}
 	}
 
-	return &promdb{
+	return &DB{
 		dbpath:    dbpath,
-		start:     startTimeInMilliSec,
-		end:       endTimeInMilliSec,
+		start:     o.start,
+		end:       o.end,
 		compactor: compactor,
 		blocks:    blocks,
 		head:      head,
+		walErr:    walErr,
 	}, nil
 }
 
-func (db *promdb) Dump(dumpdir string) error {
+// Blocks describes the blocks of the data directory ordered by time,
+// including the ones outside of the time range.
+func (db *DB) Blocks() []BlockInfo {
+	infos := make([]BlockInfo, 0, len(db.blocks))
+	for _, b := range db.blocks {
+		infos = append(infos, BlockInfo{
+			Dir:    b.dir,
+			Meta:   *b.meta,
+			Format: b.format.String(),
+			Native: b.format.native(),
+		})
+	}
+	return infos
+}
+
+// Formats describes the formats of every block, including the chunk
+// encodings, and of the WAL. The chunk segments of all blocks are read.
+func (db *DB) Formats() []string {
+	formats := make([]string, 0, len(db.blocks)+1)
+	for _, b := range db.blocks {
+		ok, err := b.readable()
+		s := fmt.Sprintf("%s: %s", b.meta.ULID, b.format)
+		switch {
+		case err != nil:
+			s += fmt.Sprintf(", chunks not readable: %v", errors.Cause(err))
+		case !ok:
+			s += " (newer than supported)"
+		}
+		formats = append(formats, s)
+	}
+
+	if db.walErr != nil {
+		formats = append(formats, fmt.Sprintf("%s: not readable, %v", walName, db.walErr))
+	} else {
+		formats = append(formats, fmt.Sprintf("%s: readable", walName))
+	}
+
+	return formats
+}
+
+// Dump writes the blocks and the head within the time range into opts.Dir.
+// Blocks are hardlinked unless the options require them to be rewritten.
+func (db *DB) Dump(ctx context.Context, opts DumpOptions) error {
+	dumpdir := opts.Dir
+	if dumpdir == "" {
+		return errors.Errorf("empty dump directory")
+	}
 	if !Exists(dumpdir) {
 		if err := os.Mkdir(dumpdir, os.ModePerm); err != nil {
 			return errors.Wrap(err, "create dump directory failed")
 		}
 	}
 
-	//snapdir := filepath.Join(db.dbpath, "dump")
-	//name := fmt.Sprintf("%s-%x",
-	//	time.Now().UTC().Format("20060102T150405Z0700"),
-	//	rand.Int())
-	//tmpdir := filepath.Join(snapdir, name)
+	defer opts.Progress.Finish()
 
-	stream.FromArray(db.blocks).Filter(func(b *block) bool {
-		if db.metaOverlap(b.meta) {
-			return true
+	if len(opts.Relabel) > 0 || opts.Anonymizer != nil || opts.Downsample > 0 {
+		return db.dumpRewritten(ctx, dumpdir, opts)
+	}
+
+	var aligned *alignment
+	if opts.BlockRange > 0 {
+		var err error
+		if aligned, err = db.alignedPlan(opts.BlockRange); err != nil {
+			return err
 		}
+	}
 
-		return false
-	}).Each(func(b *block) {
-		if err := db.link(b.meta.ULID.String(), b.dir, dumpdir); err != nil {
-			panic(errors.Wrap(err, "link block fail"))
+	var (
+		blocks []*block
+		total  int
+		bytes  int64
+	)
+	for _, b := range db.blocks {
+		if !db.metaOverlap(b.meta) {
+			continue
 		}
-	})
+		total++
+		bytes += blockSize(b)
+		if aligned != nil && aligned.covers(b) {
+			// Written by dumpAligned.
+			continue
+		}
+		blocks = append(blocks, b)
+	}
+	opts.Progress.Start("blocks", total, bytes)
+
+	converted, dropped, err := db.dumpBlocks(ctx, blocks, dumpdir, opts)
+	if err != nil {
+		return err
+	}
+	if dropped > 0 {
+		log.Warnf("down-conversion dropped %d series with unsupported chunk encodings", dropped)
+	}
+
+	if converted {
+		// Blocks of out-of-order data overlap the regular ones.
+		r, err := mergeOverlapping(db.compactor, dumpdir)
+		if err != nil {
+			return errors.Wrap(err, "merge out-of-order blocks")
+		}
+		for _, info := range r.Info {
+			log.Info(info)
+		}
+	}
 
-	if db.overlap(db.head.MinTime(), db.head.MaxTime()) {
-		if err := db.dumpHead(dumpdir); err != nil {
+	if aligned != nil {
+		if err := db.dumpAligned(ctx, dumpdir, opts.BlockRange, aligned, opts.Progress); err != nil {
 			return err
 		}
 	}
 
+	switch {
+	case db.head != nil:
+		if opts.BlockRange == 0 && db.overlap(db.head.MinTime(), db.head.MaxTime()) {
+			if err := db.dumpHead(dumpdir); err != nil {
+				return err
+			}
+		}
+	case db.walErr != nil:
+		log.Infof("WAL passed through unchanged without applying the time range")
+		if err := linkWAL(filepath.Join(db.dbpath, walName), dumpdir); err != nil {
+			return errors.Wrap(err, "link WAL")
+		}
+	}
+
 	return nil
 }
 
-func openHead(dbpath string) (*tsdb.Head, error) {
-	wlog, err := wal.NewSize(nil, nil, filepath.Join(dbpath, "wal"), wal.DefaultSegmentSize)
+// dumpBlocks links or converts blocks into dumpdir with opts.Parallelism
+// workers. It returns whether out-of-order blocks were converted and the
+// number of series dropped by the conversion.
+func (db *DB) dumpBlocks(ctx context.Context, blocks []*block, dumpdir string, opts DumpOptions) (bool, int, error) {
+	parallelism := opts.Parallelism
+	if parallelism <= 0 {
+		parallelism = 1
+	}
+
+	wctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		mtx       sync.Mutex
+		wg        sync.WaitGroup
+		converted bool
+		dropped   int
+		firstErr  error
+		jobs      = make(chan *block)
+	)
+	for i := 0; i < parallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for b := range jobs {
+				if wctx.Err() != nil {
+					continue
+				}
+				n, err := dumpBlock(db.compactor, b, dumpdir, opts.DownConvert)
+				if err != nil {
+					mtx.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mtx.Unlock()
+					cancel()
+					continue
+				}
+				opts.Progress.Add(1, blockSize(b))
+
+				mtx.Lock()
+				dropped += n
+				if b.format.outOfOrder && opts.DownConvert {
+					converted = true
+				}
+				mtx.Unlock()
+			}
+		}()
+	}
+
+feed:
+	for _, b := range blocks {
+		select {
+		case jobs <- b:
+		case <-wctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if firstErr != nil {
+		return false, 0, firstErr
+	}
+	return converted, dropped, errors.Trace(ctx.Err())
+}
+
+// dumpBlock hardlinks b into dumpdir, or converts it if it is in a newer
+// format and downConvert is set. It returns the number of series dropped by
+// the conversion. The chunk encodings are only read for the conversion.
+func dumpBlock(c *tsdb.LeveledCompactor, b *block, dumpdir string, downConvert bool) (int, error) {
+	native := b.format.native()
+	if downConvert && native {
+		var err error
+		if native, err = b.readable(); err != nil {
+			return 0, err
+		}
+	}
+	if native || !downConvert {
+		if !native {
+			log.Infof("block %s (%s) passed through unchanged", b.meta.ULID, b.format)
+		}
+		return 0, errors.Wrap(link(b.meta.ULID.String(), b.dir, dumpdir), "link block fail")
+	}
+
+	n, err := convertBlock(c, b, dumpdir)
+	return n, errors.Wrapf(err, "convert block %s fail", b.meta.ULID)
+}
+
+// blockSize returns the size of b on disk, 0 if it cannot be read.
+func blockSize(b *block) int64 {
+	size, err := dirSize(b.dir)
+	if err != nil {
+		return 0
+	}
+	return size
+}
+
+// Close releases the WAL of the head.
+func (db *DB) Close() error {
+	if db.head == nil {
+		return nil
+	}
+	return errors.Trace(db.head.Close())
+}
+
+func newCompactor(ranges []int64) (*tsdb.LeveledCompactor, error) {
+	compactor, err := tsdb.NewLeveledCompactor(context.Background(), nil, nil, ranges, chunkenc.NewPool())
+	if err != nil {
+		return nil, errors.Wrap(err, "create leveled compactor")
+	}
+
+	return compactor, nil
+}
+
+// replayChunkRange is the chunk range of a head the WAL is replayed into. The
+// appender of the head rejects samples older than half of it before the newest
+// sample, while the records of the WAL are not in time order across series.
+const replayChunkRange = math.MaxInt64 / 4
+
+// openHead loads the head from the WAL of dbpath, nil if there is none. If
+// writable is not set the WAL is only read and the head has no WAL of its own.
+func openHead(dbpath string, minValidTime int64, writable bool) (*tsdb.Head, error) {
+	dir := filepath.Join(dbpath, walName)
+	if !Exists(dir) {
+		return nil, nil
+	}
+
+	if !writable {
+		head, err := tsdb.NewHead(nil, nil, nil, replayChunkRange)
+		if err != nil {
+			log.Error("init head chunk failed", err)
+			return nil, errors.Trace(err)
+		}
+		// Without a WAL this only sets the minimum valid time.
+		if err := head.Init(minValidTime); err != nil {
+			head.Close()
+			return nil, errors.Wrap(err, "init head fail")
+		}
+		if err := replayWAL(head, dir, minValidTime); err != nil {
+			head.Close()
+			return nil, errors.Wrap(err, "replay WAL fail")
+		}
+		return head, nil
+	}
+
+	wlog, err := wal.NewSize(nil, nil, dir, wal.DefaultSegmentSize)
 	if err != nil {
 		log.Error("open wal failed", err)
 		return nil, errors.Trace(err)
@@ -139,6 +500,10 @@ func openHead(dbpath string) (*tsdb.Head, error) {
 		log.Error("init head chunk failed", err)
 		return nil, errors.Trace(err)
 	}
+	if err := head.Init(minValidTime); err != nil {
+		head.Close()
+		return nil, errors.Wrap(err, "init head fail")
+	}
 
 	return head, nil
 }
@@ -151,11 +516,19 @@ func max(v1 int64, v2 int64) int64 {
 	return v2
 }
 
-func (db *promdb) metaOverlap(meta *tsdb.BlockMeta) bool {
+func min(v1 int64, v2 int64) int64 {
+	if v1 < v2 {
+		return v1
+	}
+
+	return v2
+}
+
+func (db *DB) metaOverlap(meta *tsdb.BlockMeta) bool {
 	return db.overlap(meta.MinTime, meta.MaxTime)
 }
 
-func (db *promdb) overlap(min int64, max int64) bool {
+func (db *DB) overlap(min int64, max int64) bool {
 	return !(db.end < min || db.start > max)
 }
 
@@ -169,14 +542,14 @@ func readMetaFile(dir string) (*tsdb.BlockMeta, int64, error) {
 	if err := json.Unmarshal(b, &m); err != nil {
 		return nil, 0, errors.Trace(err)
 	}
-	if m.Version != 1 {
-		return nil, 0, errors.Errorf("unexpected meta file version %d", m.Version)
+	if m.Version < 1 {
+		return nil, 0, errors.Annotatef(ErrMetaVersion, "version %d", m.Version)
 	}
 
 	return &m, int64(len(b)), nil
 }
 
-func (db *promdb) link(metaID string, dir, dumpdir string) error {
+func link(metaID string, dir, dumpdir string) error {
 	blockDir := filepath.Join(dumpdir, metaID)
 	if err := os.MkdirAll(blockDir, 0777); err != nil {
 		return errors.Wrap(err, "create dump block dir")
@@ -240,7 +613,7 @@ func blockDirs(dir string) ([]string, error) {
 
 func chunkDir(dir string) string { return filepath.Join(dir, chunksName) }
 
-func (db *promdb) dumpHead(dumpdir string) error {
+func (db *DB) dumpHead(dumpdir string) error {
 	_, err := db.compactor.Write(dumpdir, db.head, db.head.MinTime(), db.head.MaxTime(), nil)
 	return errors.Wrap(err, "dump head block")
 }
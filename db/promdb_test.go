@@ -0,0 +1,78 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/tsdb"
+	"github.com/prometheus/tsdb/labels"
+)
+
+func TestOpenDoesNotModify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "promdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	writeTestBlock(t, src, testSeries(2), []int64{1000, 2000})
+	st, err := tsdb.Open(src, nil, nil, &tsdb.Options{BlockRanges: DefaultBlockRanges(), NoLockfile: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := st.Appender()
+	if _, err := app.Add(labels.FromStrings("__name__", "up", "instance", "a"), 10000, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A segment that ends within a page, which is padded when the WAL is
+	// opened for writing.
+	segment := filepath.Join(src, walName, "00000000")
+	b, err := ioutil.ReadFile(segment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(segment, bytes.TrimRight(b, "\x00"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	before := dirState(t, src)
+	db, err := Open(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Dump(context.Background(), DumpOptions{Dir: filepath.Join(dir, "out")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	after := dirState(t, src)
+	for path, s := range before {
+		if after[path] != s {
+			t.Errorf("%s changed from %s to %s", path, s, after[path])
+		}
+	}
+	for path := range after {
+		if _, ok := before[path]; !ok {
+			t.Errorf("%s created", path)
+		}
+	}
+
+	got := readTestBlocks(t, filepath.Join(dir, "out"))
+	if n := got[labels.FromStrings("__name__", "up", "instance", "a").String()]; n != 3 {
+		t.Errorf("got %d samples of the block and the head, want 3", n)
+	}
+}
@@ -0,0 +1,419 @@
+package db
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/pingcap/errors"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/tsdb"
+	"github.com/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/tsdb/labels"
+)
+
+// Querier returns a querier for the data between mint and maxt, both
+// inclusive, of the blocks and the head. Blocks in formats this package cannot
+// read are skipped. The samples of a series are merged across blocks.
+func (db *DB) Querier(mint, maxt int64) (tsdb.Querier, error) {
+	return db.querier(db.blocks, true, mint, maxt)
+}
+
+// querier is like Querier but only reads the given blocks and, if head is
+// set, the head.
+func (db *DB) querier(blocks []*block, head bool, mint, maxt int64) (*querier, error) {
+	r, err := db.openReaders(blocks, head, mint, maxt)
+	if err != nil {
+		return nil, err
+	}
+	q, err := r.querier(mint, maxt)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	q.blocks = r.blocks
+
+	return q, nil
+}
+
+// readers are opened blocks and the head, which can be queried for one time
+// range after another without opening the blocks again.
+type readers struct {
+	blocks []*tsdb.Block
+	head   *tsdb.Head
+}
+
+// openReaders opens the given blocks that overlap [mint, maxt] in time order,
+// skipping the ones in formats this package cannot read. The head is added if
+// head is set and it overlaps as well.
+func (db *DB) openReaders(blocks []*block, head bool, mint, maxt int64) (*readers, error) {
+	r := &readers{}
+	overlap := func(min, max int64) bool {
+		return !(maxt < min || mint > max)
+	}
+
+	// In time order the series sets of the blocks are mostly appended to
+	// each other, instead of merged sample by sample.
+	blocks = append([]*block(nil), blocks...)
+	sort.Slice(blocks, func(i, j int) bool {
+		return blocks[i].meta.MinTime < blocks[j].meta.MinTime
+	})
+
+	for _, b := range blocks {
+		if !overlap(b.meta.MinTime, b.meta.MaxTime) {
+			continue
+		}
+		ok, err := b.readable()
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		if !ok {
+			log.Warnf("block %s (%s) cannot be read, skipped", b.meta.ULID, b.format)
+			continue
+		}
+
+		ob, err := tsdb.OpenBlock(nil, b.dir, chunkenc.NewPool())
+		if err != nil {
+			r.Close()
+			return nil, errors.Wrapf(err, "open block %s", b.meta.ULID)
+		}
+		r.blocks = append(r.blocks, ob)
+	}
+	if head && db.head != nil && overlap(db.head.MinTime(), db.head.MaxTime()) {
+		r.head = db.head
+	}
+
+	return r, nil
+}
+
+// querier returns a querier for [mint, maxt] of the readers that overlap it.
+// Closing it leaves the readers open.
+func (r *readers) querier(mint, maxt int64) (*querier, error) {
+	var brs []tsdb.BlockReader
+	for _, b := range r.blocks {
+		if b.OverlapsClosedInterval(mint, maxt) {
+			brs = append(brs, b)
+		}
+	}
+	if r.head != nil && r.head.MinTime() <= maxt && mint <= r.head.MaxTime() {
+		brs = append(brs, r.head)
+	}
+
+	q := &querier{}
+	for _, br := range brs {
+		bq, err := tsdb.NewBlockQuerier(br, mint, maxt)
+		if err != nil {
+			q.Close()
+			return nil, errors.Wrap(err, "create querier")
+		}
+		q.queriers = append(q.queriers, bq)
+	}
+
+	return q, nil
+}
+
+// eachSeries calls fn for every series with samples in [mint, maxt]. The
+// samples of a series are merged across the blocks and the head, duplicate
+// timestamps of overlapping blocks are passed once.
+func (r *readers) eachSeries(ctx context.Context, mint, maxt int64, fn func(labels.Labels, tsdb.SeriesIterator) error) error {
+	q, err := r.querier(mint, maxt)
+	if err != nil {
+		return err
+	}
+	defer q.Close()
+
+	// Matches series without a metric name as well.
+	set, err := q.Select(labels.NewMustRegexpMatcher("__name__", ".*"))
+	if err != nil {
+		return errors.Wrap(err, "select series")
+	}
+	for set.Next() {
+		if err := ctx.Err(); err != nil {
+			return errors.Trace(err)
+		}
+
+		s := set.At()
+		if err := fn(s.Labels(), s.Iterator()); err != nil {
+			return err
+		}
+	}
+
+	return errors.Wrap(set.Err(), "iterate series")
+}
+
+// eachRelabeled is like eachSeries but passes the label sets returned by
+// relabel, series it returns an empty label set for are skipped. Series that
+// are relabeled into the same label set are merged into one before fn is
+// called for them, where both have a sample at the same timestamp the one of
+// the series read first is kept. It returns the label sets that series were
+// merged into.
+func (r *readers) eachRelabeled(ctx context.Context, mint, maxt int64, relabel func(labels.Labels) labels.Labels, fn func(labels.Labels, sampleIterator) error) ([]labels.Labels, error) {
+	// The label sets are read first, the samples of series that are merged
+	// have to be buffered.
+	counts := map[uint64]int{}
+	err := r.eachSeries(ctx, mint, maxt, func(lset labels.Labels, _ tsdb.SeriesIterator) error {
+		if lset = relabel(lset); len(lset) > 0 {
+			counts[lset.Hash()]++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	type mergedSeries struct {
+		lset    labels.Labels
+		samples []sample
+	}
+	merged := map[uint64]*mergedSeries{}
+	err = r.eachSeries(ctx, mint, maxt, func(lset labels.Labels, it tsdb.SeriesIterator) error {
+		lset = relabel(lset)
+		if len(lset) == 0 {
+			return nil
+		}
+		h := lset.Hash()
+		if counts[h] < 2 {
+			return fn(lset, it)
+		}
+
+		m, ok := merged[h]
+		if !ok {
+			m = &mergedSeries{lset: lset}
+			merged[h] = m
+		}
+		for it.Next() {
+			t, v := it.At()
+			m.samples = append(m.samples, sample{t: t, v: v})
+		}
+		return errors.Wrapf(it.Err(), "iterate series %s", lset)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]*mergedSeries, 0, len(merged))
+	for _, m := range merged {
+		res = append(res, m)
+	}
+	sort.Slice(res, func(i, j int) bool { return labels.Compare(res[i].lset, res[j].lset) < 0 })
+	lsets := make([]labels.Labels, 0, len(res))
+	for _, m := range res {
+		sort.SliceStable(m.samples, func(i, j int) bool { return m.samples[i].t < m.samples[j].t })
+		samples := m.samples[:0]
+		for i, s := range m.samples {
+			if i == 0 || s.t != samples[len(samples)-1].t {
+				samples = append(samples, s)
+			}
+		}
+		if err := fn(m.lset, newSliceIterator(samples)); err != nil {
+			return nil, err
+		}
+		lsets = append(lsets, m.lset)
+	}
+
+	return lsets, nil
+}
+
+// Close closes the blocks, the head is left open.
+func (r *readers) Close() error {
+	var errs []error
+	for _, b := range r.blocks {
+		if err := b.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return errors.Errorf("close blocks: %v", errs)
+	}
+	return nil
+}
+
+// timeRange is a time range, both ends inclusive.
+type timeRange struct {
+	mint, maxt int64
+}
+
+// timeRanges splits the time range of db into ranges of blockRange, aligned
+// to multiples of it, and returns the ones that overlap the given blocks or,
+// if head is set, the head, oldest first.
+func (db *DB) timeRanges(blocks []*block, head bool, blockRange int64) []timeRange {
+	var data []timeRange
+	for _, b := range blocks {
+		if db.metaOverlap(b.meta) {
+			// The maximum time of a block is exclusive.
+			data = append(data, timeRange{b.meta.MinTime, b.meta.MaxTime - 1})
+		}
+	}
+	if head && db.head != nil && db.overlap(db.head.MinTime(), db.head.MaxTime()) {
+		data = append(data, timeRange{db.head.MinTime(), db.head.MaxTime()})
+	}
+	if len(data) == 0 {
+		return nil
+	}
+
+	mint, maxt := data[0].mint, data[0].maxt
+	for _, d := range data[1:] {
+		mint, maxt = min(mint, d.mint), max(maxt, d.maxt)
+	}
+	mint, maxt = max(mint, db.start), min(maxt, db.end)
+
+	var res []timeRange
+	for start := alignDown(mint, blockRange); start <= maxt; start += blockRange {
+		tr := timeRange{max(start, mint), min(start+blockRange-1, maxt)}
+		for _, d := range data {
+			if d.mint <= tr.maxt && tr.mint <= d.maxt {
+				res = append(res, tr)
+				break
+			}
+		}
+	}
+
+	return res
+}
+
+// eachRange opens the given blocks and, if head is set, the head once and
+// calls fn for one time range after another, so that callers can write out
+// the data of a range before the next one is read. With a parallelism above 1
+// that many ranges are processed at the same time.
+func (db *DB) eachRange(ctx context.Context, blocks []*block, head bool, ranges []timeRange, parallelism int, fn func(*readers, timeRange) error) error {
+	if len(ranges) == 0 {
+		return nil
+	}
+	if parallelism <= 0 {
+		parallelism = 1
+	}
+	r, err := db.openReaders(blocks, head, ranges[0].mint, ranges[len(ranges)-1].maxt)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	wctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		mtx      sync.Mutex
+		wg       sync.WaitGroup
+		firstErr error
+		jobs     = make(chan timeRange)
+	)
+	for i := 0; i < parallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for tr := range jobs {
+				if wctx.Err() != nil {
+					continue
+				}
+				if err := fn(r, tr); err != nil {
+					mtx.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mtx.Unlock()
+					cancel()
+				}
+			}
+		}()
+	}
+
+feed:
+	for _, tr := range ranges {
+		select {
+		case jobs <- tr:
+		case <-wctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	return errors.Trace(ctx.Err())
+}
+
+// querier merges the queriers of several blocks.
+type querier struct {
+	queriers []tsdb.Querier
+	blocks   []*tsdb.Block
+}
+
+func (q *querier) Select(ms ...labels.Matcher) (tsdb.SeriesSet, error) {
+	var set tsdb.SeriesSet
+	for _, bq := range q.queriers {
+		ss, err := bq.Select(ms...)
+		if err != nil {
+			return nil, err
+		}
+		if set == nil {
+			set = ss
+		} else {
+			set = tsdb.NewMergedVerticalSeriesSet(set, ss)
+		}
+	}
+	if set == nil {
+		return tsdb.EmptySeriesSet(), nil
+	}
+	return set, nil
+}
+
+func (q *querier) LabelValues(name string) ([]string, error) {
+	return q.merge(func(bq tsdb.Querier) ([]string, error) {
+		return bq.LabelValues(name)
+	})
+}
+
+func (q *querier) LabelValuesFor(name string, l labels.Label) ([]string, error) {
+	return q.merge(func(bq tsdb.Querier) ([]string, error) {
+		return bq.LabelValuesFor(name, l)
+	})
+}
+
+func (q *querier) LabelNames() ([]string, error) {
+	return q.merge(func(bq tsdb.Querier) ([]string, error) {
+		return bq.LabelNames()
+	})
+}
+
+// merge returns the sorted union of the strings returned for every querier.
+func (q *querier) merge(fn func(tsdb.Querier) ([]string, error)) ([]string, error) {
+	set := map[string]struct{}{}
+	for _, bq := range q.queriers {
+		res, err := fn(bq)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range res {
+			set[s] = struct{}{}
+		}
+	}
+
+	res := make([]string, 0, len(set))
+	for s := range set {
+		res = append(res, s)
+	}
+	sort.Strings(res)
+
+	return res, nil
+}
+
+func (q *querier) Close() error {
+	var errs []error
+	for _, bq := range q.queriers {
+		if err := bq.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, b := range q.blocks {
+		if err := b.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return errors.Errorf("close querier: %v", errs)
+	}
+	return nil
+}
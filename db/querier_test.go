@@ -0,0 +1,187 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/tsdb"
+	"github.com/prometheus/tsdb/labels"
+)
+
+func TestEachSeries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "querier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	want := []labels.Labels{
+		labels.FromStrings("__name__", "up", "job", "a"),
+		labels.FromStrings("job", "b"),
+	}
+	writeTestBlock(t, dir, want, []int64{1000, 2000})
+
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	r, err := db.openReaders(db.blocks, true, 0, 10000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	var got []labels.Labels
+	err = r.eachSeries(context.Background(), 0, 10000, func(lset labels.Labels, _ tsdb.SeriesIterator) error {
+		got = append(got, lset)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got series %v, want %v", got, want)
+	}
+	for i := range want {
+		if !got[i].Equals(want[i]) {
+			t.Fatalf("got series %v, want %v", got, want)
+		}
+	}
+}
+
+func TestTimeRanges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "querier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	lsets := []labels.Labels{labels.FromStrings("__name__", "up")}
+	writeTestBlock(t, dir, lsets, []int64{1000, 25000})
+	writeTestBlock(t, dir, lsets, []int64{60000, 65000})
+
+	cases := []struct {
+		mint, maxt int64
+		want       []timeRange
+	}{
+		{
+			mint: math.MinInt64, maxt: math.MaxInt64,
+			// The gap between the blocks is left out.
+			want: []timeRange{{1000, 9999}, {10000, 19999}, {20000, 29999}, {60000, 65000}},
+		},
+		{
+			mint: 15000, maxt: 62000,
+			want: []timeRange{{15000, 19999}, {20000, 29999}, {60000, 62000}},
+		},
+		{
+			mint: 30000, maxt: 50000,
+		},
+	}
+	for _, c := range cases {
+		db, err := Open(dir, WithTimeRange(c.mint, c.maxt))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := db.timeRanges(db.blocks, true, 10000)
+		db.Close()
+
+		if len(got) != len(c.want) {
+			t.Fatalf("[%d, %d]: got ranges %v, want %v", c.mint, c.maxt, got, c.want)
+		}
+		for i := range got {
+			if got[i] != c.want[i] {
+				t.Fatalf("[%d, %d]: got ranges %v, want %v", c.mint, c.maxt, got, c.want)
+			}
+		}
+	}
+}
+
+func TestDumpRewrittenPerRange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "querier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// One block spanning three ranges of 10s.
+	lsets := []labels.Labels{
+		labels.FromStrings("__name__", "a_total"),
+		labels.FromStrings("__name__", "b"),
+	}
+	var ts []int64
+	for ms := int64(0); ms < 30000; ms += 1000 {
+		ts = append(ts, ms)
+	}
+	writeTestBlock(t, dir, lsets, ts)
+
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, parallelism := range []int{1, 3} {
+		out := filepath.Join(dir, fmt.Sprintf("out%d", parallelism))
+		err = db.Dump(context.Background(), DumpOptions{Dir: out, BlockRange: 10000, Downsample: 5000, Parallelism: parallelism})
+		if err != nil {
+			t.Fatal(err)
+		}
+		dirs, err := blockDirs(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(dirs) != 3 {
+			t.Fatalf("parallelism %d: dumped %d blocks, want 3", parallelism, len(dirs))
+		}
+
+		// The increase adds up across the ranges: 29 increments of 1000.
+		windows, sum := sumSamples(t, out, "a_total:increase_5s")
+		if windows != 6 || sum != 29000 {
+			t.Fatalf("parallelism %d: got %d windows with an increase of %v, want 6 and 29000", parallelism, windows, sum)
+		}
+	}
+}
+
+// sumSamples returns the number and the sum of the samples of the metric name
+// in the data directory dir.
+func sumSamples(t *testing.T, dir, name string) (int, float64) {
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	q, err := db.Querier(math.MinInt64, math.MaxInt64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	set, err := q.Select(labels.NewEqualMatcher("__name__", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		n   int
+		sum float64
+	)
+	for set.Next() {
+		it := set.At().Iterator()
+		for it.Next() {
+			_, v := it.At()
+			n++
+			sum += v
+		}
+	}
+	if err := set.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return n, sum
+}
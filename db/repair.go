@@ -0,0 +1,380 @@
+package db
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/pingcap/errors"
+	"github.com/prometheus/tsdb"
+	"github.com/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/tsdb/chunks"
+	"github.com/prometheus/tsdb/index"
+	"github.com/prometheus/tsdb/labels"
+)
+
+// Repair writes a fixed copy of the blocks of dbpath into outdir. Blocks with
+// broken chunks are rewritten without the affected series, blocks with a broken
+// index are rebuilt from the series entries and chunks that can still be read
+// and overlapping blocks are merged vertically. Healthy blocks are hardlinked,
+// the source directory is never modified.
+func Repair(dbpath, outdir string) ([]*Report, error) {
+	if dbpath == "" {
+		return nil, errors.Errorf("empty prometheus data directory")
+	}
+	if err := checkOutputDir(dbpath, outdir); err != nil {
+		return nil, err
+	}
+
+	compactor, err := newCompactor(tsdb.ExponentialBlockRanges(minBlockRange, 3, 5))
+	if err != nil {
+		return nil, err
+	}
+
+	dirs, err := blockDirs(dbpath)
+	if err != nil {
+		return nil, errors.Wrap(err, "find blocks fail")
+	}
+
+	var reports []*Report
+	for _, dir := range dirs {
+		r := &Report{Name: filepath.Base(dir)}
+		reports = append(reports, r)
+
+		meta, err := verifyMeta(dir, r)
+		if err != nil {
+			r.problemf("%s: %v, block skipped", metaName, err)
+			continue
+		}
+
+		ic, err := verifyIndex(dir, meta, r)
+		switch {
+		case err != nil || ic.broken:
+			if err != nil {
+				r.problemf("%s: %v", indexName, err)
+			}
+			err = rebuildBlock(compactor, dir, outdir, meta, r)
+		case len(ic.bad) > 0:
+			err = dropSeries(compactor, dir, outdir, meta, ic.bad, r)
+		default:
+			err = link(meta.ULID.String(), dir, outdir)
+			r.infof("linked unchanged")
+		}
+		if err != nil {
+			return reports, errors.Wrapf(err, "repair block %s", r.Name)
+		}
+	}
+
+	r, err := mergeOverlapping(compactor, outdir)
+	if err != nil {
+		return reports, err
+	}
+
+	return append(reports, r), nil
+}
+
+func checkOutputDir(dbpath, outdir string) error {
+	if outdir == "" {
+		return errors.Errorf("empty output directory")
+	}
+
+	src, err := filepath.Abs(dbpath)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	dst, err := filepath.Abs(outdir)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if src == dst {
+		return errors.Errorf("output directory must differ from the data directory")
+	}
+
+	if files, err := ioutil.ReadDir(dst); err == nil && len(files) > 0 {
+		return errors.Errorf("output directory %s is not empty", outdir)
+	}
+
+	return errors.Wrap(os.MkdirAll(dst, 0777), "create output directory")
+}
+
+// dropSeries rewrites the block without the given series.
+func dropSeries(c *tsdb.LeveledCompactor, dir, outdir string, meta *tsdb.BlockMeta, bad map[uint64]labels.Labels, r *Report) error {
+	b, err := tsdb.OpenBlock(nil, dir, chunkenc.NewPool())
+	if err != nil {
+		r.problemf("open block: %v", err)
+		return rebuildBlock(c, dir, outdir, meta, r)
+	}
+	defer b.Close()
+
+	refs := make([]uint64, 0, len(bad))
+	for ref := range bad {
+		refs = append(refs, ref)
+	}
+	sort.Slice(refs, func(i, j int) bool { return refs[i] < refs[j] })
+
+	uid, err := c.Write(outdir, &withoutSeries{BlockReader: b, refs: refs}, meta.MinTime, meta.MaxTime, meta)
+	if err != nil {
+		return errors.Wrap(err, "write block")
+	}
+
+	for _, ref := range refs {
+		r.infof("dropped series %s", bad[ref])
+	}
+	r.infof("rewritten as %s", uid)
+
+	return nil
+}
+
+// withoutSeries hides series from a block, so that the compactor skips them.
+type withoutSeries struct {
+	tsdb.BlockReader
+	refs []uint64
+}
+
+func (b *withoutSeries) Index() (tsdb.IndexReader, error) {
+	ir, err := b.BlockReader.Index()
+	if err != nil {
+		return nil, err
+	}
+	return &withoutSeriesIndex{IndexReader: ir, refs: b.refs}, nil
+}
+
+type withoutSeriesIndex struct {
+	tsdb.IndexReader
+	refs []uint64
+}
+
+func (ir *withoutSeriesIndex) Postings(name, value string) (index.Postings, error) {
+	p, err := ir.IndexReader.Postings(name, value)
+	if err != nil {
+		return nil, err
+	}
+	return index.Without(p, index.NewListPostings(ir.refs)), nil
+}
+
+// rebuildBlock decodes every series entry of the index that is still intact,
+// reads its chunks and writes the recovered series into a new block.
+func rebuildBlock(c *tsdb.LeveledCompactor, dir, outdir string, meta *tsdb.BlockMeta, r *Report) error {
+	cr, err := newChunkVerifier(chunkDir(dir))
+	if err != nil {
+		r.problemf("%s: %v, block skipped", chunksName, err)
+		return nil
+	}
+	defer cr.Close()
+
+	w, err := newBlockWriter(c, outdir)
+	if err != nil {
+		return err
+	}
+
+	var recovered int
+	skipped, err := salvageSeries(filepath.Join(dir, indexName), func(lset labels.Labels, chks []chunks.Meta) error {
+		for _, chk := range chks {
+			if chk.MinTime < meta.MinTime || chk.MaxTime > meta.MaxTime {
+				r.infof("dropped series %s: chunk outside block range", lset)
+				return nil
+			}
+			if _, err := cr.verify(chk); err != nil {
+				r.infof("dropped series %s: %v", lset, err)
+				return nil
+			}
+		}
+
+		for _, chk := range chks {
+			chunk, err := cr.read(chk)
+			if err != nil {
+				return err
+			}
+			if _, err := w.add(lset, chunk.Iterator()); err != nil {
+				return err
+			}
+		}
+		recovered++
+		return nil
+	})
+	if err != nil {
+		r.problemf("%s: %v, block skipped", indexName, err)
+		return nil
+	}
+	if skipped > 0 {
+		r.infof("skipped %d unreadable series entries", skipped)
+	}
+
+	uids, err := w.flush(meta)
+	if err != nil {
+		return err
+	}
+	if len(uids) == 0 {
+		r.infof("nothing recovered")
+		return nil
+	}
+	r.infof("rebuilt as %s with %d recovered series", uids[0], recovered)
+
+	return nil
+}
+
+type byteSlice []byte
+
+func (b byteSlice) Len() int                    { return len(b) }
+func (b byteSlice) Range(start, end int) []byte { return b[start:end] }
+
+// salvageSeries walks the series section of an index file without relying on
+// its postings and calls fn for every entry whose checksum matches. Entries of
+// the v2 format are 16 byte aligned, so reading resumes after corrupted regions.
+// It returns the number of corrupted regions.
+func salvageSeries(path string, fn func(labels.Labels, []chunks.Meta) error) (int, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	if len(b) < index.HeaderLen || binary.BigEndian.Uint32(b[:4]) != index.MagicIndex {
+		return 0, errors.Errorf("invalid index header")
+	}
+	version := int(b[4])
+
+	toc, err := index.NewTOCFromByteSlice(byteSlice(b))
+	if err != nil {
+		return 0, errors.Wrap(err, "read TOC")
+	}
+	symbolsV2, symbolsV1, err := index.ReadSymbols(byteSlice(b), version, int(toc.Symbols))
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	dec := &index.Decoder{LookupSymbol: func(o uint32) (string, error) {
+		if version == index.FormatV2 {
+			if int(o) >= len(symbolsV2) {
+				return "", errors.Errorf("unknown symbol %d", o)
+			}
+			return symbolsV2[o], nil
+		}
+		s, ok := symbolsV1[o]
+		if !ok {
+			return "", errors.Errorf("unknown symbol offset %d", o)
+		}
+		return s, nil
+	}}
+
+	start, end := int(toc.Series), int(toc.LabelIndices)
+	if end <= start || end > len(b) {
+		end = len(b)
+	}
+
+	var (
+		skipped int
+		corrupt bool
+		lset    labels.Labels
+		chks    []chunks.Meta
+	)
+	for off := start; off < end; {
+		l, n := binary.Uvarint(b[off:end])
+		if n == 1 && l == 0 && version == index.FormatV2 {
+			// Padding.
+			off = align16(off + 1)
+			continue
+		}
+		data := off + n
+		next := data + int(l) + crc32.Size
+		if n <= 0 || l == 0 || l > uint64(end-off) || next > end ||
+			crc32.Checksum(b[data:data+int(l)], castagnoliTable) != binary.BigEndian.Uint32(b[next-crc32.Size:next]) {
+			if !corrupt {
+				skipped++
+				corrupt = true
+			}
+			if version != index.FormatV2 {
+				// v1 entries are not aligned, the next one cannot be found.
+				break
+			}
+			off = align16(off + 1)
+			continue
+		}
+		corrupt = false
+
+		if err := dec.Series(b[data:data+int(l)], &lset, &chks); err != nil {
+			skipped++
+		} else if err := fn(lset, chks); err != nil {
+			return skipped, err
+		}
+
+		off = next
+		if version == index.FormatV2 {
+			off = align16(off)
+		}
+	}
+
+	return skipped, nil
+}
+
+func align16(off int) int {
+	return (off + 15) / 16 * 16
+}
+
+// mergeOverlapping vertically compacts every group of overlapping blocks in dir
+// into a single block and removes the blocks it was made of.
+func mergeOverlapping(c *tsdb.LeveledCompactor, dir string) (*Report, error) {
+	r := &Report{Name: overlapsName}
+
+	// Blocks this tsdb version cannot compact are reported and left alone.
+	blocks, err := nativeBlocks(dir, r)
+	if err != nil {
+		return r, err
+	}
+
+	for _, group := range overlappingGroups(blocks) {
+		var (
+			groupDirs = make([]string, 0, len(group))
+			ids       = make([]string, 0, len(group))
+		)
+		for _, b := range group {
+			groupDirs = append(groupDirs, b.dir)
+			ids = append(ids, b.meta.ULID.String())
+		}
+
+		uid, err := c.Compact(dir, groupDirs, nil)
+		if err != nil {
+			return r, errors.Wrapf(err, "merge blocks %v", ids)
+		}
+		for _, d := range groupDirs {
+			if err := os.RemoveAll(d); err != nil {
+				return r, errors.Trace(err)
+			}
+		}
+		r.infof("merged %v into %s", ids, uid)
+	}
+
+	return r, nil
+}
+
+// overlappingGroups returns the groups of more than one block whose time
+// ranges overlap.
+func overlappingGroups(blocks []*block) [][]*block {
+	sort.Slice(blocks, func(i, j int) bool {
+		return blocks[i].meta.MinTime < blocks[j].meta.MinTime
+	})
+
+	var (
+		groups [][]*block
+		cur    []*block
+		maxt   int64
+	)
+	for _, b := range blocks {
+		if len(cur) > 0 && b.meta.MinTime >= maxt {
+			if len(cur) > 1 {
+				groups = append(groups, cur)
+			}
+			cur = nil
+		}
+		if len(cur) == 0 || b.meta.MaxTime > maxt {
+			maxt = b.meta.MaxTime
+		}
+		cur = append(cur, b)
+	}
+	if len(cur) > 1 {
+		groups = append(groups, cur)
+	}
+
+	return groups
+}
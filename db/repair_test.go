@@ -0,0 +1,340 @@
+package db
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/tsdb"
+	"github.com/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/tsdb/chunks"
+	"github.com/prometheus/tsdb/index"
+	"github.com/prometheus/tsdb/labels"
+)
+
+// writeTestBlock writes a block with one series per label set into dir, each
+// with a sample of value t at every t of ts, and returns its directory.
+func writeTestBlock(t *testing.T, dir string, series []labels.Labels, ts []int64) string {
+	h, err := tsdb.NewHead(nil, nil, nil, math.MaxInt64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	app := h.Appender()
+	for _, lset := range series {
+		for _, ms := range ts {
+			if _, err := app.Add(lset, ms, float64(ms)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := app.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := newCompactor(tsdb.ExponentialBlockRanges(minBlockRange, 3, 5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	uid, err := c.Write(dir, h, h.MinTime(), h.MaxTime()+1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, uid.String())
+}
+
+// readTestBlocks returns the number of samples per series of the blocks in dir.
+func readTestBlocks(t *testing.T, dir string) map[string]int {
+	dirs, err := blockDirs(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := map[string]int{}
+	for _, d := range dirs {
+		b, err := tsdb.OpenBlock(nil, d, chunkenc.NewPool())
+		if err != nil {
+			t.Fatal(err)
+		}
+		q, err := tsdb.NewBlockQuerier(b, math.MinInt64, math.MaxInt64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		set, err := q.Select(labels.NewMustRegexpMatcher("__name__", ".*"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for set.Next() {
+			it := set.At().Iterator()
+			for it.Next() {
+				res[set.At().Labels().String()]++
+			}
+			if err := it.Err(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := set.Err(); err != nil {
+			t.Fatal(err)
+		}
+		q.Close()
+		b.Close()
+	}
+	return res
+}
+
+// testSeries returns n series of the metric up.
+func testSeries(n int) []labels.Labels {
+	lsets := make([]labels.Labels, 0, n)
+	for i := 0; i < n; i++ {
+		lsets = append(lsets, labels.FromStrings("__name__", "up", "instance", string('a'+rune(i))))
+	}
+	return lsets
+}
+
+// seriesOf returns the series ref and chunks of lset in the block in bdir.
+func seriesOf(t *testing.T, bdir string, lset labels.Labels) (uint64, []chunks.Meta) {
+	ir, err := index.NewFileReader(filepath.Join(bdir, indexName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ir.Close()
+
+	p, err := ir.Postings("instance", lset.Get("instance"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.Next() {
+		t.Fatalf("series %s not found", lset)
+	}
+	var (
+		got  labels.Labels
+		chks []chunks.Meta
+	)
+	if err := ir.Series(p.At(), &got, &chks); err != nil {
+		t.Fatal(err)
+	}
+	return p.At(), chks
+}
+
+// flipByte inverts the byte at off of the file path.
+func flipByte(t *testing.T, path string, off int64) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	b := make([]byte, 1)
+	if _, err := f.ReadAt(b, off); err != nil {
+		t.Fatal(err)
+	}
+	b[0] ^= 0xff
+	if _, err := f.WriteAt(b, off); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSalvageSeries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "repair")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	lsets := testSeries(5)
+	bdir := writeTestBlock(t, dir, lsets, []int64{1000, 2000, 3000})
+	path := filepath.Join(bdir, indexName)
+
+	cases := []struct {
+		// corrupt are the series whose index entries are corrupted.
+		corrupt []int
+		skipped int
+	}{
+		{},
+		{corrupt: []int{0}, skipped: 1},
+		{corrupt: []int{2}, skipped: 1},
+		{corrupt: []int{4}, skipped: 1},
+		{corrupt: []int{1, 3}, skipped: 2},
+		// Adjacent entries are one corrupted region.
+		{corrupt: []int{1, 2}, skipped: 1},
+	}
+	for _, c := range cases {
+		orig, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, i := range c.corrupt {
+			// Entries of index v2 start at 16 times their ref, the label
+			// set follows the length.
+			ref, _ := seriesOf(t, bdir, lsets[i])
+			flipByte(t, path, int64(ref*16+2))
+		}
+
+		var got []string
+		skipped, err := salvageSeries(path, func(lset labels.Labels, chks []chunks.Meta) error {
+			if len(chks) != 1 {
+				t.Errorf("%v: series %s has %d chunks, want 1", c.corrupt, lset, len(chks))
+			}
+			got = append(got, lset.Get("instance"))
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if skipped != c.skipped {
+			t.Errorf("%v: got %d corrupted regions, want %d", c.corrupt, skipped, c.skipped)
+		}
+		var want []string
+		for i, lset := range lsets {
+			if !containsInt(c.corrupt, i) {
+				want = append(want, lset.Get("instance"))
+			}
+		}
+		if len(got) != len(want) {
+			t.Errorf("%v: got series %v, want %v", c.corrupt, got, want)
+		} else {
+			for i := range want {
+				if got[i] != want[i] {
+					t.Errorf("%v: got series %v, want %v", c.corrupt, got, want)
+					break
+				}
+			}
+		}
+
+		if err := ioutil.WriteFile(path, orig, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := salvageSeries(filepath.Join(bdir, metaName), nil); err == nil {
+		t.Errorf("invalid index header not detected")
+	}
+}
+
+func containsInt(s []int, v int) bool {
+	for _, x := range s {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+func TestRepair(t *testing.T) {
+	lsets := testSeries(4)
+	ts := []int64{1000, 2000, 3000}
+
+	cases := []struct {
+		name    string
+		corrupt func(t *testing.T, bdir string)
+		// want are the instances of the series in the repaired block.
+		want []string
+	}{
+		{
+			name:    "healthy",
+			corrupt: func(t *testing.T, bdir string) {},
+			want:    []string{"a", "b", "c", "d"},
+		},
+		{
+			name: "broken chunk",
+			corrupt: func(t *testing.T, bdir string) {
+				// Flip the first data byte of the chunk of b, after the
+				// length and the encoding.
+				_, chks := seriesOf(t, bdir, lsets[1])
+				seq, off := chks[0].Ref>>32, int64(chks[0].Ref&0xffffffff)
+				flipByte(t, filepath.Join(chunkDir(bdir), fmt.Sprintf("%06d", seq+1)), off+2)
+			},
+			want: []string{"a", "c", "d"},
+		},
+		{
+			name: "broken index entry",
+			corrupt: func(t *testing.T, bdir string) {
+				ref, _ := seriesOf(t, bdir, lsets[2])
+				flipByte(t, filepath.Join(bdir, indexName), int64(ref*16+2))
+			},
+			want: []string{"a", "b", "d"},
+		},
+	}
+	for _, c := range cases {
+		dir, err := ioutil.TempDir("", "repair")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		src, out := filepath.Join(dir, "src"), filepath.Join(dir, "out")
+		if err := os.Mkdir(src, 0777); err != nil {
+			t.Fatal(err)
+		}
+
+		c.corrupt(t, writeTestBlock(t, src, lsets, ts))
+		if _, err := Repair(src, out); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+
+		got := readTestBlocks(t, out)
+		if len(got) != len(c.want) {
+			t.Errorf("%s: got series %v, want %v", c.name, got, c.want)
+		}
+		for _, instance := range c.want {
+			lset := labels.FromStrings("__name__", "up", "instance", instance)
+			if n := got[lset.String()]; n != len(ts) {
+				t.Errorf("%s: series %s has %d samples, want %d", c.name, lset, n, len(ts))
+			}
+		}
+	}
+}
+
+func TestMergeOverlappingSkipsForeignBlocks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "repair")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	lsets := []labels.Labels{labels.FromStrings("__name__", "up")}
+	writeTestBlock(t, dir, lsets, []int64{1000, 3000})
+	writeTestBlock(t, dir, lsets, []int64{2000, 4000})
+	foreign := writeTestBlock(t, dir, lsets, []int64{2500})
+
+	// Written by a newer version.
+	b, err := ioutil.ReadFile(filepath.Join(foreign, metaName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b = []byte(strings.Replace(string(b), `"version": 1`, `"version": 2`, 1))
+	if err := ioutil.WriteFile(filepath.Join(foreign, metaName), b, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := newCompactor(DefaultBlockRanges())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := mergeOverlapping(c, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dirs, err := blockDirs(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dirs) != 2 {
+		t.Fatalf("got %d blocks, want the merged and the skipped one: %v", len(dirs), r.Info)
+	}
+	if !Exists(foreign) {
+		t.Fatalf("block of a newer version merged")
+	}
+	var skipped bool
+	for _, info := range r.Info {
+		skipped = skipped || strings.Contains(info, "skipped")
+	}
+	if !skipped {
+		t.Fatalf("skipped block not reported: %v", r.Info)
+	}
+}
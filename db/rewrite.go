@@ -0,0 +1,350 @@
+package db
+
+import (
+	"context"
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/oklog/ulid"
+	"github.com/pingcap/errors"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/tsdb"
+	"github.com/prometheus/tsdb/labels"
+	"github.com/qiffang/prom-tools/relabel"
+)
+
+// sampleIterator is satisfied by both series and chunk iterators.
+type sampleIterator interface {
+	Next() bool
+	At() (int64, float64)
+	Err() error
+}
+
+// blockWriter collects rewritten series in in-memory heads and writes them
+// out as blocks with the compactor, the same way the head is dumped. With a
+// block range samples are split into one head per aligned range, so that the
+// written blocks have the same boundaries as the ones Prometheus cuts. The
+// heads are only released by flush, callers add the data of one range at a
+// time and flush it before the next one.
+type blockWriter struct {
+	compactor  *tsdb.LeveledCompactor
+	dir        string
+	blockRange int64
+	heads      map[int64]*tsdb.Head
+	// series holds the hashes of the label sets written.
+	series map[uint64]struct{}
+}
+
+func newBlockWriter(compactor *tsdb.LeveledCompactor, dir string) (*blockWriter, error) {
+	return newAlignedBlockWriter(compactor, dir, 0)
+}
+
+func newAlignedBlockWriter(compactor *tsdb.LeveledCompactor, dir string, blockRange int64) (*blockWriter, error) {
+	if blockRange < 0 {
+		return nil, errors.Errorf("invalid block range %d", blockRange)
+	}
+
+	return &blockWriter{
+		compactor:  compactor,
+		dir:        dir,
+		blockRange: blockRange,
+		heads:      map[int64]*tsdb.Head{},
+		series:     map[uint64]struct{}{},
+	}, nil
+}
+
+// rangeStart returns the start of the aligned range t belongs to.
+func (w *blockWriter) rangeStart(t int64) int64 {
+	if w.blockRange == 0 {
+		return 0
+	}
+	return alignDown(t, w.blockRange)
+}
+
+// alignDown returns the largest multiple of r that is not greater than t.
+func alignDown(t, r int64) int64 {
+	m := t % r
+	if m < 0 {
+		m += r
+	}
+	return t - m
+}
+
+func (w *blockWriter) headFor(start int64) (*tsdb.Head, error) {
+	if h, ok := w.heads[start]; ok {
+		return h, nil
+	}
+
+	// The head never cuts chunks by range and accepts samples of every series
+	// independently of the others, so series can be added one after another.
+	h, err := tsdb.NewHead(nil, nil, nil, math.MaxInt64)
+	if err != nil {
+		return nil, errors.Wrap(err, "create head")
+	}
+	w.heads[start] = h
+
+	return h, nil
+}
+
+// add appends all samples of it to the series lset. Samples that are older than
+// or equal to the last sample of the series are skipped.
+func (w *blockWriter) add(lset labels.Labels, it sampleIterator) (int, error) {
+	// The head keeps the label set, callers may reuse theirs.
+	lset = append(labels.Labels(nil), lset...)
+
+	type appendState struct {
+		app   tsdb.Appender
+		ref   uint64
+		added int
+	}
+	var (
+		apps     = map[int64]*appendState{}
+		rollback = func() {
+			for _, a := range apps {
+				a.app.Rollback()
+			}
+		}
+	)
+	for it.Next() {
+		t, v := it.At()
+
+		start := w.rangeStart(t)
+		a, ok := apps[start]
+		if !ok {
+			h, err := w.headFor(start)
+			if err != nil {
+				rollback()
+				return 0, err
+			}
+			a = &appendState{app: h.Appender()}
+			apps[start] = a
+		}
+
+		var err error
+		if a.added == 0 {
+			a.ref, err = a.app.Add(lset, t, v)
+		} else {
+			err = a.app.AddFast(a.ref, t, v)
+		}
+		switch errors.Cause(err) {
+		case nil:
+			a.added++
+		case tsdb.ErrOutOfOrderSample, tsdb.ErrAmendSample:
+		default:
+			rollback()
+			return 0, errors.Wrapf(err, "append sample of %s", lset)
+		}
+	}
+	if err := it.Err(); err != nil {
+		rollback()
+		return 0, errors.Wrapf(err, "iterate series %s", lset)
+	}
+
+	var added int
+	for _, a := range apps {
+		if err := a.app.Commit(); err != nil {
+			return 0, errors.Trace(err)
+		}
+		added += a.added
+	}
+	if added > 0 {
+		w.series[lset.Hash()] = struct{}{}
+	}
+
+	return added, nil
+}
+
+// numSeries returns the number of distinct series written.
+func (w *blockWriter) numSeries() int {
+	return len(w.series)
+}
+
+// flush writes everything added since the last flush into new blocks and
+// returns their IDs, none if there was nothing to write. Without a block range
+// a single block is written that spans the range of parent, or of the samples
+// if parent is nil.
+func (w *blockWriter) flush(parent *tsdb.BlockMeta) ([]ulid.ULID, error) {
+	defer func() {
+		for start, h := range w.heads {
+			h.Close()
+			delete(w.heads, start)
+		}
+	}()
+
+	starts := make([]int64, 0, len(w.heads))
+	for start := range w.heads {
+		starts = append(starts, start)
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i] < starts[j] })
+
+	var uids []ulid.ULID
+	for _, start := range starts {
+		h := w.heads[start]
+
+		var mint, maxt int64
+		switch {
+		case w.blockRange > 0:
+			mint, maxt = start, start+w.blockRange
+		case parent != nil:
+			mint, maxt = parent.MinTime, parent.MaxTime
+		default:
+			mint, maxt = h.MinTime(), h.MaxTime()+1
+		}
+
+		uid, err := w.compactor.Write(w.dir, h, mint, maxt, parent)
+		if err != nil {
+			return uids, errors.Wrap(err, "write block")
+		}
+		if uid != (ulid.ULID{}) {
+			uids = append(uids, uid)
+		}
+	}
+
+	return uids, nil
+}
+
+// dumpRewritten writes all series of db relabeled, anonymized and downsampled
+// into aligned blocks of the block range, 2h by default. The data is read and
+// written one block range at a time, opts.Parallelism ranges at the same
+// time. Series that are relabeled into the same label set are merged within
+// every range, their samples are buffered in memory for that, and where both
+// have a sample at the same timestamp the one of the series read first is kept.
+func (db *DB) dumpRewritten(ctx context.Context, dumpdir string, opts DumpOptions) error {
+	if db.walErr != nil {
+		log.Warnf("WAL cannot be loaded, it is not dumped: %v", db.walErr)
+	}
+
+	blockRange := minBlockRange
+	if opts.BlockRange > 0 {
+		blockRange = opts.BlockRange
+	}
+	parallelism := opts.Parallelism
+	if parallelism <= 0 {
+		parallelism = 1
+	}
+	if opts.Anonymizer != nil && opts.Anonymizer.OrderDependent() && parallelism > 1 {
+		// Series are only passed in the same order if one range is
+		// rewritten after the other.
+		log.Infof("sequential pseudonyms, block ranges are rewritten one at a time")
+		parallelism = 1
+	}
+	// Every range being processed has a writer of its own.
+	writers := make(chan *blockWriter, parallelism)
+	all := make([]*blockWriter, 0, parallelism)
+	for i := 0; i < parallelism; i++ {
+		w, err := newAlignedBlockWriter(db.compactor, dumpdir, blockRange)
+		if err != nil {
+			return err
+		}
+		writers <- w
+		all = append(all, w)
+	}
+
+	ranges := db.timeRanges(db.blocks, true, blockRange)
+	opts.Progress.Start("ranges", len(ranges), 0)
+
+	var (
+		mtx     sync.Mutex
+		blocks  int
+		dropped = map[uint64]struct{}{}
+		merged  = map[uint64]struct{}{}
+	)
+	relabeled := func(lset labels.Labels) labels.Labels {
+		res := relabel.Process(lset, opts.Relabel...)
+		if len(res) == 0 {
+			mtx.Lock()
+			dropped[lset.Hash()] = struct{}{}
+			mtx.Unlock()
+		}
+		return res
+	}
+	rewrite := func(w *blockWriter, lset labels.Labels, it sampleIterator, tr timeRange) error {
+		if opts.Anonymizer != nil {
+			lset = opts.Anonymizer.Labels(lset)
+		}
+		if opts.Downsample <= 0 {
+			_, err := w.add(lset, it)
+			return err
+		}
+
+		aggrs, err := downsample(lset, it, opts.Downsample)
+		if err != nil {
+			return errors.Wrapf(err, "downsample %s", lset)
+		}
+		for _, a := range aggrs {
+			if _, err := w.add(a.labels, newSliceIterator(within(a.samples, tr))); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	err := db.eachRange(ctx, db.blocks, true, ranges, parallelism, func(r *readers, tr timeRange) error {
+		w := <-writers
+		defer func() { writers <- w }()
+
+		query := tr
+		if opts.Downsample > 0 {
+			// Whole resolution windows are read, and the one before for the
+			// increase, but only aggregates timestamped within the range are
+			// written. Each window is written by the range of its last sample.
+			query = timeRange{
+				max(alignDown(tr.mint, opts.Downsample)-opts.Downsample, db.start),
+				min(alignDown(tr.maxt, opts.Downsample)+opts.Downsample-1, db.end),
+			}
+		}
+		var err error
+		if len(opts.Relabel) > 0 {
+			var lsets []labels.Labels
+			lsets, err = r.eachRelabeled(ctx, query.mint, query.maxt, relabeled, func(lset labels.Labels, it sampleIterator) error {
+				return rewrite(w, lset, it, tr)
+			})
+			mtx.Lock()
+			for _, lset := range lsets {
+				merged[lset.Hash()] = struct{}{}
+			}
+			mtx.Unlock()
+		} else {
+			err = r.eachSeries(ctx, query.mint, query.maxt, func(lset labels.Labels, it tsdb.SeriesIterator) error {
+				return rewrite(w, lset, it, tr)
+			})
+		}
+		if err != nil {
+			return err
+		}
+
+		uids, err := w.flush(nil)
+		mtx.Lock()
+		blocks += len(uids)
+		mtx.Unlock()
+		opts.Progress.Add(1, 0)
+		return err
+	})
+	if err != nil {
+		return errors.Wrap(err, "rewrite series")
+	}
+
+	series := map[uint64]struct{}{}
+	for _, w := range all {
+		for h := range w.series {
+			series[h] = struct{}{}
+		}
+	}
+	log.Infof("%d series rewritten into %d blocks, %d series dropped", len(series), blocks, len(dropped))
+	if len(merged) > 0 {
+		log.Infof("%d series are merged from several relabeled series", len(merged))
+	}
+
+	return nil
+}
+
+// within returns the samples with timestamps in tr.
+func within(samples []sample, tr timeRange) []sample {
+	res := samples[:0]
+	for _, s := range samples {
+		if s.t >= tr.mint && s.t <= tr.maxt {
+			res = append(res, s)
+		}
+	}
+	return res
+}
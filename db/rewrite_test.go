@@ -0,0 +1,196 @@
+package db
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/tsdb/labels"
+	"github.com/qiffang/prom-tools/relabel"
+)
+
+func TestAlignDown(t *testing.T) {
+	cases := []struct {
+		t, r, want int64
+	}{
+		{t: 0, r: 10, want: 0},
+		{t: 9, r: 10, want: 0},
+		{t: 10, r: 10, want: 10},
+		{t: 25, r: 10, want: 20},
+		{t: -1, r: 10, want: -10},
+		{t: -10, r: 10, want: -10},
+		{t: -11, r: 10, want: -20},
+		{t: 7200001, r: minBlockRange, want: 7200000},
+	}
+	for _, c := range cases {
+		if got := alignDown(c.t, c.r); got != c.want {
+			t.Errorf("alignDown(%d, %d) = %d, want %d", c.t, c.r, got, c.want)
+		}
+	}
+}
+
+func TestBlockWriterAligned(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rewrite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := newCompactor(DefaultBlockRanges())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		blockRange int64
+		samples    []int64
+		// want are the [mint, maxt) of the blocks written.
+		want [][2]int64
+	}{
+		{blockRange: 0, samples: []int64{5, 15, 25}, want: [][2]int64{{5, 26}}},
+		{blockRange: 10, samples: []int64{5, 15, 25}, want: [][2]int64{{0, 10}, {10, 20}, {20, 30}}},
+		{blockRange: 10, samples: []int64{10, 19}, want: [][2]int64{{10, 20}}},
+		{blockRange: 100, samples: []int64{5, 15, 25}, want: [][2]int64{{0, 100}}},
+	}
+	for _, cs := range cases {
+		w, err := newAlignedBlockWriter(c, dir, cs.blockRange)
+		if err != nil {
+			t.Fatal(err)
+		}
+		samples := make([]sample, 0, len(cs.samples))
+		for _, ts := range cs.samples {
+			samples = append(samples, sample{t: ts, v: 1})
+		}
+		if _, err := w.add(labels.FromStrings("__name__", "up"), newSliceIterator(samples)); err != nil {
+			t.Fatal(err)
+		}
+		uids, err := w.flush(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got [][2]int64
+		for _, uid := range uids {
+			meta, _, err := readMetaFile(filepath.Join(dir, uid.String()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, [2]int64{meta.MinTime, meta.MaxTime})
+			if err := os.RemoveAll(filepath.Join(dir, uid.String())); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if len(got) != len(cs.want) {
+			t.Errorf("range %d, samples %v: got blocks %v, want %v", cs.blockRange, cs.samples, got, cs.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != cs.want[i] {
+				t.Errorf("range %d, samples %v: got blocks %v, want %v", cs.blockRange, cs.samples, got, cs.want)
+				break
+			}
+		}
+	}
+
+	if _, err := newAlignedBlockWriter(c, dir, -1); err == nil {
+		t.Errorf("negative block range accepted")
+	}
+}
+
+func TestAlignedPlan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rewrite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := newCompactor(DefaultBlockRanges())
+	if err != nil {
+		t.Fatal(err)
+	}
+	lsets := []labels.Labels{labels.FromStrings("__name__", "up")}
+	// Aligned blocks of 10ms at [0, 10) and [10, 20), and one of [12, 16)
+	// overlapping the second.
+	for _, ts := range [][]int64{{0, 9}, {10, 19}} {
+		w, err := newAlignedBlockWriter(c, dir, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		samples := []sample{{t: ts[0], v: 1}, {t: ts[1], v: 1}}
+		if _, err := w.add(lsets[0], newSliceIterator(samples)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.flush(nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeTestBlock(t, dir, lsets, []int64{12, 15})
+
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	a, err := db.alignedPlan(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(a.link) != 1 || a.link[0].meta.MinTime != 0 {
+		t.Errorf("got linked blocks %v, want the one at 0", blockRanges(a.link))
+	}
+	if len(a.rewrite) != 2 || a.rewrite[0].meta.MinTime != 10 || a.rewrite[1].meta.MinTime != 12 {
+		t.Errorf("got rewritten blocks %v, want the ones at 10 and 12", blockRanges(a.rewrite))
+	}
+}
+
+func blockRanges(blocks []*block) [][2]int64 {
+	res := make([][2]int64, 0, len(blocks))
+	for _, b := range blocks {
+		res = append(res, [2]int64{b.meta.MinTime, b.meta.MaxTime})
+	}
+	return res
+}
+
+func TestDumpMergesRelabeledSeries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rewrite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Both become up{job="node"}, their samples interleave and one
+	// timestamp is in both.
+	src := filepath.Join(dir, "src")
+	if err := os.Mkdir(src, 0777); err != nil {
+		t.Fatal(err)
+	}
+	writeTestBlock(t, src, []labels.Labels{labels.FromStrings("__name__", "up", "instance", "a", "job", "node")}, []int64{1000, 3000, 5000})
+	writeTestBlock(t, src, []labels.Labels{labels.FromStrings("__name__", "up", "instance", "b", "job", "node")}, []int64{2000, 3000, 4000, 6000})
+
+	db, err := Open(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	out := filepath.Join(dir, "out")
+	err = db.Dump(context.Background(), DumpOptions{
+		Dir: out,
+		Relabel: []*relabel.Config{{
+			Regex:  relabel.MustNewRegexp("instance"),
+			Action: relabel.LabelDrop,
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := readTestBlocks(t, out)
+	want := labels.FromStrings("__name__", "up", "job", "node").String()
+	if len(got) != 1 || got[want] != 6 {
+		t.Fatalf("got series %v, want %s with 6 samples", got, want)
+	}
+}
@@ -0,0 +1,130 @@
+package db
+
+import (
+	"context"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pingcap/errors"
+	"github.com/prometheus/tsdb"
+	"github.com/prometheus/tsdb/labels"
+)
+
+// SplitOptions controls how Split writes the output TSDBs.
+type SplitOptions struct {
+	// By is the name of the label to split by.
+	By string
+	// DropLabel removes the label from the series written.
+	DropLabel bool
+	MinTime   int64
+	MaxTime   int64
+}
+
+// Split writes one TSDB into outdir for every value of a label, named after
+// the value. Series without the label are not written. The reports describe
+// what was written even if an error is returned.
+func Split(dbpath, outdir string, opts SplitOptions) ([]*Report, error) {
+	if opts.By == "" {
+		return nil, errors.Errorf("empty label name to split by")
+	}
+	if err := checkOutputDir(dbpath, outdir); err != nil {
+		return nil, err
+	}
+
+	db, err := Open(dbpath, WithTimeRange(opts.MinTime, opts.MaxTime))
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	type output struct {
+		w       *blockWriter
+		r       *Report
+		samples int
+		blocks  int
+	}
+	var (
+		outputs = map[string]*output{}
+		skipped = map[uint64]struct{}{}
+		ranges  = db.timeRanges(db.blocks, true, minBlockRange)
+	)
+	add := func(lset labels.Labels, it tsdb.SeriesIterator) error {
+		value := lset.Get(opts.By)
+		if value == "" {
+			skipped[lset.Hash()] = struct{}{}
+			return nil
+		}
+
+		o, ok := outputs[value]
+		if !ok {
+			dir := filepath.Join(outdir, splitDirName(value))
+			if err := checkOutputDir(dbpath, dir); err != nil {
+				return err
+			}
+			w, err := newAlignedBlockWriter(db.compactor, dir, minBlockRange)
+			if err != nil {
+				return err
+			}
+			o = &output{w: w, r: &Report{Name: dir}}
+			outputs[value] = o
+		}
+
+		if opts.DropLabel {
+			lset = withLabels(lset, map[string]string{opts.By: ""})
+		}
+		n, err := o.w.add(lset, it)
+		if err != nil {
+			return err
+		}
+		o.samples += n
+		return nil
+	}
+	err = db.eachRange(context.Background(), db.blocks, true, ranges, 1, func(r *readers, tr timeRange) error {
+		if err := r.eachSeries(context.Background(), tr.mint, tr.maxt, add); err != nil {
+			return err
+		}
+		// Every output holds at most this range.
+		for value, o := range outputs {
+			uids, err := o.w.flush(nil)
+			if err != nil {
+				return errors.Wrapf(err, "write %s=%q", opts.By, value)
+			}
+			o.blocks += len(uids)
+		}
+		return nil
+	})
+	// What was written so far is reported on errors as well.
+	values := make([]string, 0, len(outputs))
+	for value := range outputs {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+
+	reports := make([]*Report, 0, len(values)+1)
+	for _, value := range values {
+		o := outputs[value]
+		reports = append(reports, o.r)
+		o.r.infof("%s=%q: %d series, %d samples written into %d blocks", opts.By, value, o.w.numSeries(), o.samples, o.blocks)
+	}
+
+	r := &Report{Name: dbpath}
+	if len(skipped) > 0 {
+		r.infof("%d series without label %s skipped", len(skipped), opts.By)
+	}
+	if db.walErr != nil {
+		r.problemf("%s: %v, skipped", walName, db.walErr)
+	}
+
+	return append(reports, r), err
+}
+
+// splitDirName escapes a label value so that it can be used as a directory name.
+func splitDirName(value string) string {
+	name := url.PathEscape(value)
+	if name == "." || name == ".." {
+		name = strings.Replace(name, ".", "%2E", -1)
+	}
+	return name
+}
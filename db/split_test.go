@@ -0,0 +1,136 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/tsdb/labels"
+)
+
+func TestSplit(t *testing.T) {
+	lsets := []labels.Labels{
+		labels.FromStrings("__name__", "up", "instance", "a"),
+		labels.FromStrings("__name__", "up", "instance", "a", "job", "x"),
+		labels.FromStrings("__name__", "up", "instance", "b/c"),
+		labels.FromStrings("__name__", "up"),
+	}
+	ts := []int64{1000, 2000, 3000}
+
+	cases := []struct {
+		dropLabel bool
+		// want are the series per output directory.
+		want map[string][]labels.Labels
+	}{
+		{
+			want: map[string][]labels.Labels{
+				"a":     lsets[:2],
+				"b%2Fc": lsets[2:3],
+			},
+		},
+		{
+			dropLabel: true,
+			want: map[string][]labels.Labels{
+				"a": {
+					labels.FromStrings("__name__", "up"),
+					labels.FromStrings("__name__", "up", "job", "x"),
+				},
+				"b%2Fc": {labels.FromStrings("__name__", "up")},
+			},
+		},
+	}
+	for _, c := range cases {
+		dir, err := ioutil.TempDir("", "split")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		src, out := filepath.Join(dir, "src"), filepath.Join(dir, "out")
+		if err := os.Mkdir(src, 0777); err != nil {
+			t.Fatal(err)
+		}
+		writeTestBlock(t, src, lsets, ts)
+
+		reports, err := Split(src, out, SplitOptions{By: "instance", DropLabel: c.dropLabel, MinTime: 0, MaxTime: 10000})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// One per output and the one of the source.
+		if len(reports) != len(c.want)+1 {
+			t.Errorf("drop %v: got %d reports, want %d", c.dropLabel, len(reports), len(c.want)+1)
+		}
+
+		files, err := ioutil.ReadDir(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != len(c.want) {
+			t.Errorf("drop %v: got %d outputs, want %d", c.dropLabel, len(files), len(c.want))
+		}
+		for name, want := range c.want {
+			got := readTestBlocks(t, filepath.Join(out, name))
+			if len(got) != len(want) {
+				t.Errorf("drop %v: %s: got series %v, want %v", c.dropLabel, name, got, want)
+			}
+			for _, lset := range want {
+				if got[lset.String()] != len(ts) {
+					t.Errorf("drop %v: %s: series %s has %d samples, want %d", c.dropLabel, name, lset, got[lset.String()], len(ts))
+				}
+			}
+		}
+	}
+}
+
+func TestSplitErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "split")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	if err := os.Mkdir(src, 0777); err != nil {
+		t.Fatal(err)
+	}
+	writeTestBlock(t, src, []labels.Labels{
+		labels.FromStrings("__name__", "up", "instance", "a"),
+		// Too long for a directory name.
+		labels.FromStrings("__name__", "up", "instance", strings.Repeat("b", 300)),
+	}, []int64{1000, 2000})
+
+	if _, err := Split(src, filepath.Join(dir, "out1"), SplitOptions{}); err == nil {
+		t.Errorf("empty label name accepted")
+	}
+	if _, err := Split(src, src, SplitOptions{By: "instance"}); err == nil {
+		t.Errorf("output into the source accepted")
+	}
+
+	// What was written before the error is reported.
+	reports, err := Split(src, filepath.Join(dir, "out2"), SplitOptions{By: "instance", MinTime: 0, MaxTime: 10000})
+	if err == nil {
+		t.Fatalf("output directory that cannot be created not reported")
+	}
+	if len(reports) != 2 || reports[0].Name != filepath.Join(dir, "out2", "a") {
+		t.Fatalf("got %d reports, want the one of the first output and the source", len(reports))
+	}
+}
+
+func TestSplitDirName(t *testing.T) {
+	cases := []struct {
+		value, want string
+	}{
+		{value: "a", want: "a"},
+		{value: "a/b", want: "a%2Fb"},
+		{value: "a b", want: "a%20b"},
+		{value: ".", want: "%2E"},
+		{value: "..", want: "%2E%2E"},
+		{value: "...", want: "..."},
+	}
+	for _, c := range cases {
+		if got := splitDirName(c.value); got != c.want {
+			t.Errorf("splitDirName(%q) = %q, want %q", c.value, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,655 @@
+package db
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pingcap/errors"
+	"github.com/prometheus/tsdb"
+	"github.com/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/tsdb/chunks"
+	"github.com/prometheus/tsdb/index"
+	"github.com/prometheus/tsdb/labels"
+	"github.com/prometheus/tsdb/wal"
+)
+
+const (
+	walName          = "wal"
+	checkpointPrefix = "checkpoint."
+	overlapsName     = "overlaps"
+)
+
+var (
+	castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+	errUnsupportedEncoding = errors.New("unsupported chunk encoding")
+	errChunkLength         = errors.New("chunk length out of range")
+)
+
+// Report holds the problems found while verifying one part of a data directory.
+type Report struct {
+	Name     string
+	Info     []string
+	Problems []string
+}
+
+func (r *Report) OK() bool {
+	return len(r.Problems) == 0
+}
+
+func (r *Report) problemf(format string, args ...interface{}) {
+	r.Problems = append(r.Problems, fmt.Sprintf(format, args...))
+}
+
+func (r *Report) infof(format string, args ...interface{}) {
+	r.Info = append(r.Info, fmt.Sprintf(format, args...))
+}
+
+// Verify checks every block, the block layout and the WAL of the data directory
+// without opening it as a database, so it also works on dumps that Open rejects.
+func Verify(dbpath string) ([]*Report, error) {
+	if dbpath == "" {
+		return nil, errors.Errorf("empty prometheus data directory")
+	}
+
+	dirs, err := blockDirs(dbpath)
+	if err != nil {
+		return nil, errors.Wrap(err, "find blocks fail")
+	}
+
+	var (
+		reports []*Report
+		metas   []tsdb.BlockMeta
+	)
+	for _, dir := range dirs {
+		r, meta := verifyBlock(dir)
+		if meta != nil {
+			metas = append(metas, *meta)
+		}
+		reports = append(reports, r)
+	}
+
+	sort.Slice(metas, func(i, j int) bool { return metas[i].MinTime < metas[j].MinTime })
+	overlaps := &Report{Name: overlapsName}
+	for tr, bms := range tsdb.OverlappingBlocks(metas) {
+		ids := make([]string, 0, len(bms))
+		for _, bm := range bms {
+			ids = append(ids, bm.ULID.String())
+		}
+		overlaps.problemf("blocks overlap in [%d, %d]: %v", tr.Min, tr.Max, ids)
+	}
+	sort.Strings(overlaps.Problems)
+	reports = append(reports, overlaps)
+
+	walDir := filepath.Join(dbpath, walName)
+	if Exists(walDir) {
+		reports = append(reports, verifyWAL(walDir))
+	}
+
+	return reports, nil
+}
+
+func verifyBlock(dir string) (*Report, *tsdb.BlockMeta) {
+	r := &Report{Name: filepath.Base(dir)}
+
+	meta, err := verifyMeta(dir, r)
+	if err != nil {
+		r.problemf("%s: %v", metaName, err)
+		return r, nil
+	}
+	r.infof("time range [%d, %d), %d series, %d samples", meta.MinTime, meta.MaxTime, meta.Stats.NumSeries, meta.Stats.NumSamples)
+	if f, err := readBlockFormat(dir, meta); err == nil {
+		// Errors in the chunk segments are reported by verifyIndex.
+		f.readEncodings(dir)
+		r.infof("format: %s", f)
+	}
+
+	ic, err := verifyIndex(dir, meta, r)
+	if err != nil {
+		r.problemf("%s: %v", indexName, err)
+		return r, meta
+	}
+
+	if meta.Version == 1 {
+		verifyTombstones(dir, ic.refs, r)
+	} else {
+		r.infof("%s of meta version %d not checked", tombstoneName, meta.Version)
+	}
+
+	return r, meta
+}
+
+func verifyMeta(dir string, r *Report) (*tsdb.BlockMeta, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, metaName))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var m tsdb.BlockMeta
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if m.Version < 1 {
+		r.problemf("%s: unexpected meta file version %d", metaName, m.Version)
+	}
+	if m.ULID.String() != filepath.Base(dir) {
+		r.problemf("%s: ulid %s does not match directory name", metaName, m.ULID)
+	}
+	if m.MinTime >= m.MaxTime {
+		r.problemf("%s: invalid time range [%d, %d)", metaName, m.MinTime, m.MaxTime)
+	}
+
+	return &m, nil
+}
+
+// indexCheck is the outcome of verifying an index that could be opened.
+type indexCheck struct {
+	// refs holds all series that could be read.
+	refs map[uint64]struct{}
+	// bad holds the series with missing, corrupted or misplaced chunks.
+	bad map[uint64]labels.Labels
+	// broken is set if the index itself is inconsistent.
+	broken bool
+}
+
+// verifyIndex walks all series of the index and checks the postings ordering,
+// the label sets and every chunk they reference.
+func verifyIndex(dir string, meta *tsdb.BlockMeta, r *Report) (*indexCheck, error) {
+	ir, err := index.NewFileReader(filepath.Join(dir, indexName))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer ir.Close()
+
+	cr, err := newChunkVerifier(chunkDir(dir))
+	if err != nil {
+		return nil, errors.Wrap(err, "open chunks")
+	}
+	defer cr.Close()
+
+	all, err := ir.Postings(index.AllPostingsKey())
+	if err != nil {
+		return nil, errors.Wrap(err, "read all postings")
+	}
+
+	var (
+		ic        = &indexCheck{refs: map[uint64]struct{}{}, bad: map[uint64]labels.Labels{}}
+		lset      labels.Labels
+		prev      labels.Labels
+		chks      []chunks.Meta
+		prevRef   uint64
+		samples   uint64
+		uncounted bool
+	)
+	for all.Next() {
+		ref := all.At()
+		if len(ic.refs) > 0 && ref <= prevRef {
+			r.problemf("%s: postings out of order, %d after %d", indexName, ref, prevRef)
+			ic.broken = true
+		}
+		prevRef = ref
+
+		if err := ir.Series(ref, &lset, &chks); err != nil {
+			r.problemf("%s: read series %d: %v", indexName, ref, err)
+			ic.broken = true
+			continue
+		}
+		ic.refs[ref] = struct{}{}
+
+		if len(lset) == 0 {
+			r.problemf("%s: series %d has no labels", indexName, ref)
+			ic.broken = true
+		}
+		for i := 1; i < len(lset); i++ {
+			if lset[i-1].Name >= lset[i].Name {
+				r.problemf("%s: series %s has unsorted or duplicate labels", indexName, lset)
+				ic.broken = true
+				break
+			}
+		}
+		if prev != nil && labels.Compare(prev, lset) >= 0 {
+			r.problemf("%s: series %s not ordered after %s", indexName, lset, prev)
+			ic.broken = true
+		}
+		prev = append(prev[:0], lset...)
+
+		var maxt int64
+		for i, c := range chks {
+			problem := ""
+			switch {
+			case c.MinTime > c.MaxTime:
+				problem = fmt.Sprintf("%s: series %s chunk %d has invalid range [%d, %d]", indexName, lset, i, c.MinTime, c.MaxTime)
+			case c.MinTime < meta.MinTime || c.MaxTime > meta.MaxTime:
+				problem = fmt.Sprintf("%s: series %s chunk %d [%d, %d] outside block range", indexName, lset, i, c.MinTime, c.MaxTime)
+			case i > 0 && c.MinTime <= maxt:
+				problem = fmt.Sprintf("%s: series %s chunk %d overlaps previous chunk", indexName, lset, i)
+			}
+			maxt = c.MaxTime
+
+			n, err := cr.verify(c)
+			if errors.Cause(err) == errUnsupportedEncoding {
+				// Valid chunks this tool cannot decode, their samples cannot be counted.
+				uncounted = true
+				err = nil
+			}
+			if err != nil && problem == "" {
+				problem = fmt.Sprintf("%s: series %s chunk %d: %v", chunksName, lset, i, err)
+			}
+			samples += uint64(n)
+
+			if problem != "" {
+				r.Problems = append(r.Problems, problem)
+				ic.bad[ref] = append(labels.Labels(nil), lset...)
+			}
+		}
+	}
+	if err := all.Err(); err != nil {
+		return nil, errors.Wrap(err, "iterate all postings")
+	}
+
+	if uint64(len(ic.refs)) != meta.Stats.NumSeries {
+		r.problemf("%s: %d series in index, meta.json says %d", indexName, len(ic.refs), meta.Stats.NumSeries)
+	}
+	if !uncounted && samples != meta.Stats.NumSamples {
+		r.problemf("%s: %d samples in chunks, meta.json says %d", chunksName, samples, meta.Stats.NumSamples)
+	}
+
+	if err := verifyPostings(ir, ic, r); err != nil {
+		return nil, err
+	}
+
+	return ic, nil
+}
+
+// verifyPostings checks that every label pair postings list is sorted and only
+// points at existing series.
+func verifyPostings(ir *index.Reader, ic *indexCheck, r *Report) error {
+	names, err := ir.LabelNames()
+	if err != nil {
+		return errors.Wrap(err, "read label names")
+	}
+
+	for _, name := range names {
+		tpls, err := ir.LabelValues(name)
+		if err != nil {
+			return errors.Wrapf(err, "read label values of %s", name)
+		}
+
+		for i := 0; i < tpls.Len(); i++ {
+			vals, err := tpls.At(i)
+			if err != nil {
+				return errors.Wrapf(err, "read label value of %s", name)
+			}
+
+			p, err := ir.Postings(name, vals[0])
+			if err != nil {
+				r.problemf("%s: read postings %s=%q: %v", indexName, name, vals[0], err)
+				ic.broken = true
+				continue
+			}
+
+			var prev uint64
+			for first := true; p.Next(); first = false {
+				if !first && p.At() <= prev {
+					r.problemf("%s: postings %s=%q out of order", indexName, name, vals[0])
+					ic.broken = true
+					break
+				}
+				if _, ok := ic.refs[p.At()]; !ok {
+					r.problemf("%s: postings %s=%q reference unknown series %d", indexName, name, vals[0], p.At())
+					ic.broken = true
+					break
+				}
+				prev = p.At()
+			}
+			if err := p.Err(); err != nil {
+				r.problemf("%s: iterate postings %s=%q: %v", indexName, name, vals[0], err)
+				ic.broken = true
+			}
+		}
+	}
+
+	return nil
+}
+
+func verifyTombstones(dir string, refs map[uint64]struct{}, r *Report) {
+	if !Exists(filepath.Join(dir, tombstoneName)) {
+		return
+	}
+
+	b, err := tsdb.OpenBlock(nil, dir, chunkenc.NewPool())
+	if err != nil {
+		r.problemf("%s: %v", tombstoneName, err)
+		return
+	}
+	defer b.Close()
+
+	tr, err := b.Tombstones()
+	if err != nil {
+		r.problemf("%s: %v", tombstoneName, err)
+		return
+	}
+	defer tr.Close()
+
+	if err := tr.Iter(func(ref uint64, ivs tsdb.Intervals) error {
+		if _, ok := refs[ref]; !ok {
+			r.problemf("%s: tombstone for unknown series %d", tombstoneName, ref)
+		}
+		for _, iv := range ivs {
+			if iv.Mint > iv.Maxt {
+				r.problemf("%s: series %d has invalid interval [%d, %d]", tombstoneName, ref, iv.Mint, iv.Maxt)
+			}
+		}
+		return nil
+	}); err != nil {
+		r.problemf("%s: %v", tombstoneName, err)
+	}
+	if n := tr.Total(); n > 0 {
+		r.infof("%d tombstones", n)
+	}
+}
+
+// chunkVerifier reads chunks straight from the segment files, so that the
+// stored CRC32 can be checked, which the tsdb chunk reader skips.
+type chunkVerifier struct {
+	segments []*os.File
+	// sizes are the sizes of the segments, chunk lengths are checked against
+	// them before anything is allocated.
+	sizes []int64
+}
+
+func newChunkVerifier(dir string) (*chunkVerifier, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	v := &chunkVerifier{}
+	for _, fi := range files {
+		if _, err := strconv.ParseUint(fi.Name(), 10, 64); err != nil {
+			continue
+		}
+		f, err := os.Open(filepath.Join(dir, fi.Name()))
+		if err != nil {
+			v.Close()
+			return nil, errors.Trace(err)
+		}
+		v.segments = append(v.segments, f)
+		v.sizes = append(v.sizes, fi.Size())
+	}
+
+	return v, nil
+}
+
+// locate returns the segment of the referenced chunk, the offset of its
+// encoding byte and the length of its data.
+func (v *chunkVerifier) locate(c chunks.Meta) (*os.File, int64, uint64, error) {
+	seq, off := int(c.Ref>>32), int64((c.Ref<<32)>>32)
+	if seq >= len(v.segments) {
+		return nil, 0, 0, errors.Errorf("reference sequence %d out of range", seq)
+	}
+	f := v.segments[seq]
+
+	head := make([]byte, binary.MaxVarintLen32)
+	n, err := f.ReadAt(head, off)
+	if n == 0 {
+		return nil, 0, 0, errors.Wrapf(err, "read chunk at offset %d", off)
+	}
+	l, n := binary.Uvarint(head[:n])
+	if n <= 0 {
+		return nil, 0, 0, errors.Errorf("reading chunk length at offset %d failed", off)
+	}
+	// The encoding byte, the data and the CRC32 must fit into the segment.
+	if rest := v.sizes[seq] - off - int64(n); l > uint64(rest) || uint64(rest)-l < 1+crc32.Size {
+		return nil, 0, 0, errors.Annotatef(errChunkLength, "length %d at offset %d, segment size %d", l, off, v.sizes[seq])
+	}
+
+	return f, off + int64(n), l, nil
+}
+
+func (v *chunkVerifier) encoding(c chunks.Meta) (chunkenc.Encoding, error) {
+	f, off, _, err := v.locate(c)
+	if err != nil {
+		return 0, err
+	}
+
+	b := make([]byte, 1)
+	if _, err := f.ReadAt(b, off); err != nil {
+		return 0, errors.Wrapf(err, "read chunk encoding at offset %d", off)
+	}
+	return chunkenc.Encoding(b[0]), nil
+}
+
+// read returns the referenced chunk after checking its CRC.
+func (v *chunkVerifier) read(c chunks.Meta) (chunkenc.Chunk, error) {
+	f, off, l, err := v.locate(c)
+	if err != nil {
+		return nil, err
+	}
+
+	// Encoding byte, data and the trailing CRC32.
+	b := make([]byte, 1+l+crc32.Size)
+	if _, err := f.ReadAt(b, off); err != nil {
+		return nil, errors.Wrapf(err, "read chunk at offset %d", off)
+	}
+	data, sum := b[:1+l], b[1+l:]
+	if crc32.Checksum(data, castagnoliTable) != binary.BigEndian.Uint32(sum) {
+		return nil, errors.Errorf("checksum mismatch at offset %d", off)
+	}
+
+	if enc := chunkenc.Encoding(data[0]); enc != chunkenc.EncXOR {
+		return nil, errors.Annotatef(errUnsupportedEncoding, "%s", encodingName(enc))
+	}
+	chk, err := chunkenc.FromData(chunkenc.Encoding(data[0]), data[1:])
+	return chk, errors.Trace(err)
+}
+
+// verify checks the CRC of the referenced chunk and that its samples are ordered
+// and within the range recorded in the index. It returns the number of samples.
+func (v *chunkVerifier) verify(c chunks.Meta) (int, error) {
+	chk, err := v.read(c)
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		it      = chk.Iterator()
+		samples int
+		prev    int64
+	)
+	for it.Next() {
+		t, _ := it.At()
+		if t < c.MinTime || t > c.MaxTime {
+			return samples, errors.Errorf("sample at %d outside chunk range [%d, %d]", t, c.MinTime, c.MaxTime)
+		}
+		if samples > 0 && t <= prev {
+			return samples, errors.Errorf("sample at %d not after %d", t, prev)
+		}
+		prev = t
+		samples++
+	}
+
+	return samples, errors.Trace(it.Err())
+}
+
+func (v *chunkVerifier) Close() error {
+	for _, f := range v.segments {
+		f.Close()
+	}
+	return nil
+}
+
+// verifyWAL reads the checkpoints and every segment after the last one and
+// makes sure the segments form a sequence that starts right after it. Older
+// checkpoints and segments the last checkpoint covers are left over by an
+// interrupted truncation and reported as well.
+func verifyWAL(dir string) *Report {
+	r := &Report{Name: walName}
+
+	first, last, err := walSegmentRange(dir)
+	if err != nil {
+		r.problemf("%v", err)
+		return r
+	}
+
+	cps, err := walCheckpoints(dir)
+	if err != nil {
+		r.problemf("%s: %v", checkpointPrefix, err)
+		return r
+	}
+	cpidx := -1
+	for i, cp := range cps {
+		name := filepath.Base(cp.dir)
+		if cp.tmp {
+			r.problemf("%s is an incomplete checkpoint", name)
+			continue
+		}
+		switch {
+		case i < len(cps)-1:
+			r.problemf("%s is stale, %s follows it", name, filepath.Base(cps[len(cps)-1].dir))
+		case first >= 0 && cp.idx > last:
+			r.problemf("%s is newer than the last segment %d", name, last)
+		case first >= 0 && cp.idx >= first:
+			r.problemf("segments %d to %d were not removed after %s", first, cp.idx, name)
+		}
+		verifyWALRecords(name, wal.SegmentRange{Dir: cp.dir, First: -1, Last: -1}, r)
+		cpidx = cp.idx
+	}
+	if cpidx >= 0 && first > cpidx+1 {
+		r.problemf("segments %d to %d missing after %s%06d", cpidx+1, first-1, checkpointPrefix, cpidx)
+	}
+
+	if first >= 0 {
+		r.infof("segments %d to %d", first, last)
+		start := first
+		if cpidx+1 > start {
+			start = cpidx + 1
+		}
+		if start <= last {
+			verifyWALRecords("segments", wal.SegmentRange{Dir: dir, First: start, Last: -1}, r)
+		}
+	}
+
+	return r
+}
+
+// walCheckpoint is a checkpoint directory of the WAL.
+type walCheckpoint struct {
+	dir string
+	idx int
+	// tmp is set for checkpoints that were not completed.
+	tmp bool
+}
+
+// walCheckpoints returns the checkpoints in dir ordered by their index, the
+// last one is the one the WAL is replayed from.
+func walCheckpoints(dir string) ([]walCheckpoint, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var cps []walCheckpoint
+	for _, fi := range files {
+		if !fi.IsDir() || !strings.HasPrefix(fi.Name(), checkpointPrefix) {
+			continue
+		}
+		s := strings.TrimPrefix(fi.Name(), checkpointPrefix)
+		cp := walCheckpoint{dir: filepath.Join(dir, fi.Name()), tmp: strings.HasSuffix(s, ".tmp")}
+		if cp.idx, err = strconv.Atoi(strings.TrimSuffix(s, ".tmp")); err != nil {
+			continue
+		}
+		cps = append(cps, cp)
+	}
+	// Incomplete checkpoints go first, they are never replayed.
+	sort.Slice(cps, func(i, j int) bool {
+		if cps[i].tmp != cps[j].tmp {
+			return cps[i].tmp
+		}
+		return cps[i].idx < cps[j].idx
+	})
+
+	return cps, nil
+}
+
+func walSegmentRange(dir string) (int, int, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return -1, -1, errors.Trace(err)
+	}
+
+	var idxs []int
+	for _, fi := range files {
+		k, err := strconv.Atoi(fi.Name())
+		if err != nil || fi.IsDir() {
+			continue
+		}
+		idxs = append(idxs, k)
+	}
+	if len(idxs) == 0 {
+		return -1, -1, nil
+	}
+
+	sort.Ints(idxs)
+	for i := 1; i < len(idxs); i++ {
+		if idxs[i] != idxs[i-1]+1 {
+			return -1, -1, errors.Errorf("segments not sequential, %d follows %d", idxs[i], idxs[i-1])
+		}
+	}
+
+	return idxs[0], idxs[len(idxs)-1], nil
+}
+
+func verifyWALRecords(name string, sr wal.SegmentRange, r *Report) {
+	sgmReader, err := wal.NewSegmentsRangeReader(sr)
+	if err != nil {
+		r.problemf("%s: %v", name, err)
+		return
+	}
+	defer sgmReader.Close()
+
+	var (
+		dec                         tsdb.RecordDecoder
+		rd                          = wal.NewReader(sgmReader)
+		series, samples, tombstones int
+	)
+	for rd.Next() {
+		rec := rd.Record()
+		switch dec.Type(rec) {
+		case tsdb.RecordSeries:
+			s, err := dec.Series(rec, nil)
+			if err != nil {
+				r.problemf("%s: decode series record in segment %d: %v", name, rd.Segment(), err)
+			}
+			series += len(s)
+		case tsdb.RecordSamples:
+			s, err := dec.Samples(rec, nil)
+			if err != nil {
+				r.problemf("%s: decode samples record in segment %d: %v", name, rd.Segment(), err)
+			}
+			samples += len(s)
+		case tsdb.RecordTombstones:
+			s, err := dec.Tombstones(rec, nil)
+			if err != nil {
+				r.problemf("%s: decode tombstones record in segment %d: %v", name, rd.Segment(), err)
+			}
+			tombstones += len(s)
+		default:
+			r.problemf("%s: invalid record type in segment %d at offset %d", name, rd.Segment(), rd.Offset())
+		}
+	}
+	if err := rd.Err(); err != nil {
+		r.problemf("%s: %v", name, err)
+	}
+
+	r.infof("%s: %d series, %d samples, %d tombstones", name, series, samples, tombstones)
+}
@@ -0,0 +1,136 @@
+package db
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/tsdb/labels"
+)
+
+func TestVerifyChunkLength(t *testing.T) {
+	dir, err := ioutil.TempDir("", "verify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	bdir := writeTestBlock(t, dir, []labels.Labels{
+		labels.FromStrings("__name__", "up", "job", "a"),
+	}, []int64{1000, 2000, 3000})
+
+	reports, err := Verify(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range reports {
+		if !r.OK() {
+			t.Fatalf("%s: unexpected problems %v", r.Name, r.Problems)
+		}
+	}
+
+	corruptChunkLength(t, bdir, 1<<30)
+
+	reports, err = Verify(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found bool
+	for _, r := range reports {
+		for _, p := range r.Problems {
+			if strings.Contains(p, errChunkLength.Error()) {
+				found = true
+			}
+		}
+	}
+	if !found {
+		t.Fatalf("chunk length not reported: %+v", reports[0])
+	}
+}
+
+func TestVerifyWALCheckpoints(t *testing.T) {
+	cases := []struct {
+		name        string
+		segments    []int
+		checkpoints []string
+		// want are substrings of the problems reported, in order.
+		want []string
+	}{
+		{name: "no checkpoint", segments: []int{0, 1, 2}},
+		{name: "checkpoint", segments: []int{4, 5, 6}, checkpoints: []string{"checkpoint.000003"}},
+		{name: "only checkpoint", checkpoints: []string{"checkpoint.000003"}},
+		{
+			name:        "stale",
+			segments:    []int{4, 5},
+			checkpoints: []string{"checkpoint.000001", "checkpoint.000003"},
+			want:        []string{"checkpoint.000001 is stale"},
+		},
+		{
+			name:        "incomplete",
+			segments:    []int{3, 4},
+			checkpoints: []string{"checkpoint.000002", "checkpoint.000003.tmp"},
+			want:        []string{"checkpoint.000003.tmp is an incomplete checkpoint"},
+		},
+		{
+			name:        "segments not removed",
+			segments:    []int{2, 3, 4, 5},
+			checkpoints: []string{"checkpoint.000003"},
+			want:        []string{"segments 2 to 3 were not removed"},
+		},
+		{
+			name:        "newer than the last segment",
+			segments:    []int{4, 5},
+			checkpoints: []string{"checkpoint.000007"},
+			want:        []string{"newer than the last segment 5"},
+		},
+		{
+			name:        "segments missing",
+			segments:    []int{6, 7},
+			checkpoints: []string{"checkpoint.000003"},
+			want:        []string{"segments 4 to 5 missing"},
+		},
+		{
+			name:        "misordered",
+			segments:    []int{2, 3},
+			checkpoints: []string{"checkpoint.000005", "checkpoint.000001"},
+			want:        []string{"checkpoint.000001 is stale", "newer than the last segment 3"},
+		},
+	}
+	for _, c := range cases {
+		dir, err := ioutil.TempDir("", "verify")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		// Empty segments are valid, they hold no records.
+		for _, s := range c.segments {
+			if err := ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("%08d", s)), nil, 0666); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, cp := range c.checkpoints {
+			if err := os.Mkdir(filepath.Join(dir, cp), 0777); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(dir, cp, fmt.Sprintf("%08d", 0)), nil, 0666); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		r := verifyWAL(dir)
+		if len(r.Problems) != len(c.want) {
+			t.Errorf("%s: got problems %v, want %v", c.name, r.Problems, c.want)
+			continue
+		}
+		for i, want := range c.want {
+			if !strings.Contains(r.Problems[i], want) {
+				t.Errorf("%s: got problems %v, want %v", c.name, r.Problems, c.want)
+				break
+			}
+		}
+	}
+}
@@ -13,4 +13,5 @@ require (
 	github.com/stretchr/testify v1.3.0 // indirect
 	github.com/wushilin/stream v0.0.0-20160517090247-4c9093559eef
 	gopkg.in/alecthomas/kingpin.v2 v2.2.6
+	gopkg.in/yaml.v2 v2.2.2
 )
@@ -0,0 +1,326 @@
+// Package grafana provisions datasources, folders and dashboards through the
+// Grafana HTTP API or provisioning files. Everything is identified by stable
+// UIDs or names, so that provisioning again updates what a previous run
+// created.
+package grafana
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pingcap/errors"
+)
+
+// Tag marks the dashboards provisioned by prom-tools.
+const Tag = "prom-tools-replay"
+
+// Datasource is a Grafana datasource.
+type Datasource struct {
+	ID        int64  `json:"id,omitempty" yaml:"-"`
+	UID       string `json:"uid" yaml:"uid"`
+	Name      string `json:"name" yaml:"name"`
+	Type      string `json:"type" yaml:"type"`
+	Access    string `json:"access" yaml:"access"`
+	URL       string `json:"url" yaml:"url"`
+	IsDefault bool   `json:"isDefault" yaml:"isDefault"`
+
+	BasicAuth     bool   `json:"basicAuth" yaml:"basicAuth,omitempty"`
+	BasicAuthUser string `json:"basicAuthUser,omitempty" yaml:"basicAuthUser,omitempty"`
+	// JSONData are the settings of the datasource type, e.g. tlsSkipVerify.
+	JSONData map[string]interface{} `json:"jsonData,omitempty" yaml:"jsonData,omitempty"`
+	// SecureJSONData are the secret settings, e.g. basicAuthPassword.
+	SecureJSONData map[string]string `json:"secureJsonData,omitempty" yaml:"secureJsonData,omitempty"`
+}
+
+// Folder is a Grafana dashboard folder.
+type Folder struct {
+	ID    int64  `json:"id"`
+	UID   string `json:"uid"`
+	Title string `json:"title"`
+}
+
+// FoundDashboard is a dashboard found by a search.
+type FoundDashboard struct {
+	UID   string `json:"uid"`
+	Title string `json:"title"`
+}
+
+// APIError is an error response of Grafana.
+type APIError struct {
+	Method, Path string
+	Status       int
+	Message      string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%s %s: %d %s", e.Method, e.Path, e.Status, e.Message)
+}
+
+// IsNotFound returns whether err is a not found response.
+func IsNotFound(err error) bool {
+	e, ok := errors.Cause(err).(*APIError)
+	return ok && e.Status == http.StatusNotFound
+}
+
+// Client calls the HTTP API of a Grafana.
+type Client struct {
+	url    string
+	auth   string
+	client *http.Client
+}
+
+// NewClient returns a Client for the Grafana at rawurl. It authenticates with
+// the API token if set, with basic auth otherwise.
+func NewClient(rawurl, user, password, token string) *Client {
+	c := &Client{
+		url:    strings.TrimSuffix(rawurl, "/"),
+		client: http.DefaultClient,
+	}
+	if token != "" {
+		c.auth = "Bearer " + token
+	} else {
+		req := http.Request{Header: http.Header{}}
+		req.SetBasicAuth(user, password)
+		c.auth = req.Header.Get("Authorization")
+	}
+	return c
+}
+
+// StableUID returns a UID derived from key, which is the same for the same key.
+func StableUID(key string) string {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return fmt.Sprintf("replay-%016x", h.Sum64())
+}
+
+// SetDatasource updates the datasource with the name of ds or creates it.
+func (c *Client) SetDatasource(ds Datasource) error {
+	var cur Datasource
+	err := c.do(http.MethodGet, "/api/datasources/name/"+url.PathEscape(ds.Name), nil, &cur)
+	switch {
+	case IsNotFound(err):
+		ds.ID = 0
+		return c.do(http.MethodPost, "/api/datasources", ds, nil)
+	case err != nil:
+		return err
+	}
+
+	ds.ID = cur.ID
+	return c.do(http.MethodPut, fmt.Sprintf("/api/datasources/%d", cur.ID), ds, nil)
+}
+
+// DeleteDatasource deletes the datasource with the name and the UID of ds, it
+// returns false if there is none. A datasource of that name with another UID
+// was not provisioned with ds and is not deleted, an error is returned.
+func (c *Client) DeleteDatasource(ds Datasource) (bool, error) {
+	id, err := c.provisionedDatasource(ds)
+	if err != nil || id == 0 {
+		return false, err
+	}
+
+	err = c.do(http.MethodDelete, fmt.Sprintf("/api/datasources/%d", id), nil, nil)
+	if IsNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// provisionedDatasource returns the id of the datasource with the name of ds,
+// 0 if there is none. It returns an error if its UID is not the one of ds.
+func (c *Client) provisionedDatasource(ds Datasource) (int64, error) {
+	var cur Datasource
+	err := c.do(http.MethodGet, "/api/datasources/name/"+url.PathEscape(ds.Name), nil, &cur)
+	switch {
+	case IsNotFound(err):
+		return 0, nil
+	case err != nil:
+		return 0, err
+	case cur.UID != ds.UID:
+		return 0, errors.Errorf("datasource %s has the uid %s instead of %s, it is not deleted", ds.Name, cur.UID, ds.UID)
+	}
+	return cur.ID, nil
+}
+
+// SetFolder returns the folder uid and creates it with title if it does not
+// exist.
+func (c *Client) SetFolder(uid, title string) (Folder, error) {
+	var f Folder
+	err := c.do(http.MethodGet, "/api/folders/"+url.PathEscape(uid), nil, &f)
+	if IsNotFound(err) {
+		err = c.do(http.MethodPost, "/api/folders", Folder{UID: uid, Title: title}, &f)
+	}
+	return f, err
+}
+
+// DeleteFolder deletes the folder uid if it has no dashboards, it returns
+// false if it does not exist or is not empty.
+func (c *Client) DeleteFolder(uid string) (bool, error) {
+	var f Folder
+	err := c.do(http.MethodGet, "/api/folders/"+url.PathEscape(uid), nil, &f)
+	if IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	var boards []FoundDashboard
+	q := url.Values{"folderIds": {fmt.Sprint(f.ID)}, "type": {"dash-db"}}
+	if err := c.do(http.MethodGet, "/api/search?"+q.Encode(), nil, &boards); err != nil {
+		return false, err
+	}
+	if len(boards) > 0 {
+		return false, nil
+	}
+	return true, c.do(http.MethodDelete, "/api/folders/"+url.PathEscape(uid), nil, nil)
+}
+
+// SetDashboard creates the dashboard board or replaces the one with its UID,
+// in the folder folderID, 0 being the General folder.
+func (c *Client) SetDashboard(board map[string]interface{}, folderID int64) error {
+	// Dashboards are matched by UID, ids are assigned by Grafana.
+	delete(board, "id")
+	req := map[string]interface{}{
+		"dashboard": board,
+		"folderId":  folderID,
+		"overwrite": true,
+	}
+	return c.do(http.MethodPost, "/api/dashboards/db", req, nil)
+}
+
+// SearchByTag returns the dashboards tagged with all tags.
+func (c *Client) SearchByTag(tags ...string) ([]FoundDashboard, error) {
+	var boards []FoundDashboard
+	q := url.Values{"tag": tags, "type": {"dash-db"}}
+	err := c.do(http.MethodGet, "/api/search?"+q.Encode(), nil, &boards)
+	return boards, err
+}
+
+// DeleteDashboard deletes the dashboard uid.
+func (c *Client) DeleteDashboard(uid string) error {
+	return c.do(http.MethodDelete, "/api/dashboards/uid/"+url.PathEscape(uid), nil, nil)
+}
+
+// FolderUID returns the UID of the folder title that Provision creates.
+func FolderUID(title string) string {
+	return StableUID("folder " + title)
+}
+
+// Provision creates or updates the datasource ds, the folder titled folder
+// unless it is empty and the dashboards in it.
+func (c *Client) Provision(ds Datasource, folder string, boards []map[string]interface{}) error {
+	if err := c.SetDatasource(ds); err != nil {
+		return errors.Wrapf(err, "set datasource %s", ds.Name)
+	}
+
+	var folderID int64
+	if folder != "" {
+		f, err := c.SetFolder(FolderUID(folder), folder)
+		if err != nil {
+			return errors.Wrapf(err, "set folder %s", folder)
+		}
+		folderID = f.ID
+	}
+
+	for _, board := range boards {
+		if err := c.SetDashboard(board, folderID); err != nil {
+			return errors.Wrapf(err, "set dashboard %v", board["title"])
+		}
+	}
+	return nil
+}
+
+// Cleanup deletes the dashboards tagged with Tag and tag, the datasource ds
+// and the folder titled folder if it is empty then. It returns what it
+// deleted. Nothing is deleted if a datasource with the name of ds has another
+// UID.
+func (c *Client) Cleanup(ds Datasource, tag, folder string) ([]string, error) {
+	var deleted []string
+
+	if _, err := c.provisionedDatasource(ds); err != nil {
+		return deleted, err
+	}
+	boards, err := c.SearchByTag(Tag, tag)
+	if err != nil {
+		return deleted, errors.Wrap(err, "search dashboards")
+	}
+	for _, b := range boards {
+		if err := c.DeleteDashboard(b.UID); err != nil {
+			return deleted, errors.Wrapf(err, "delete dashboard %s", b.Title)
+		}
+		deleted = append(deleted, fmt.Sprintf("dashboard %q", b.Title))
+	}
+
+	ok, err := c.DeleteDatasource(ds)
+	if err != nil {
+		return deleted, errors.Wrap(err, "delete datasource")
+	}
+	if ok {
+		deleted = append(deleted, "datasource "+ds.Name)
+	}
+
+	if folder == "" {
+		return deleted, nil
+	}
+	ok, err = c.DeleteFolder(FolderUID(folder))
+	if err != nil {
+		return deleted, errors.Wrap(err, "delete folder")
+	}
+	if ok {
+		deleted = append(deleted, "folder "+folder)
+	}
+	return deleted, nil
+}
+
+// do sends body as JSON and decodes the response into v if set.
+func (c *Client) do(method, path string, body, v interface{}) error {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		r = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequest(method, c.url+path, r)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	req.Header.Set("Authorization", c.auth)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if resp.StatusCode/100 != 2 {
+		var msg struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(b, &msg) != nil || msg.Message == "" {
+			msg.Message = string(b)
+		}
+		return errors.Trace(&APIError{Method: method, Path: path, Status: resp.StatusCode, Message: msg.Message})
+	}
+	if v == nil {
+		return nil
+	}
+	return errors.Wrapf(json.Unmarshal(b, v), "decode response of %s %s", method, path)
+}
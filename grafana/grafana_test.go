@@ -0,0 +1,212 @@
+package grafana
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeGrafana keeps datasources, folders and dashboards in memory and logs
+// the requests that change them.
+type fakeGrafana struct {
+	mtx         sync.Mutex
+	nextID      int64
+	datasources map[int64]Datasource
+	folders     map[string]Folder
+	dashboards  map[string]map[string]interface{}
+	// folderOf is the folder id of every dashboard.
+	folderOf map[string]int64
+	changes  []string
+}
+
+func newFakeGrafana() *fakeGrafana {
+	return &fakeGrafana{
+		datasources: map[int64]Datasource{},
+		folders:     map[string]Folder{},
+		dashboards:  map[string]map[string]interface{}{},
+		folderOf:    map[string]int64{},
+	}
+}
+
+func (g *fakeGrafana) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	if r.Header.Get("Authorization") != "Bearer token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodGet {
+		g.changes = append(g.changes, r.Method+" "+r.URL.Path)
+	}
+
+	reply := func(v interface{}) {
+		json.NewEncoder(w).Encode(v)
+	}
+	notFound := func() {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"message":"not found"}`)
+	}
+	path := r.URL.Path
+	switch {
+	case r.Method == http.MethodGet && strings.HasPrefix(path, "/api/datasources/name/"):
+		for _, ds := range g.datasources {
+			if ds.Name == strings.TrimPrefix(path, "/api/datasources/name/") {
+				reply(ds)
+				return
+			}
+		}
+		notFound()
+	case r.Method == http.MethodPost && path == "/api/datasources":
+		var ds Datasource
+		json.NewDecoder(r.Body).Decode(&ds)
+		g.nextID++
+		ds.ID = g.nextID
+		g.datasources[ds.ID] = ds
+		reply(ds)
+	case strings.HasPrefix(path, "/api/datasources/"):
+		id, err := strconv.ParseInt(strings.TrimPrefix(path, "/api/datasources/"), 10, 64)
+		if _, ok := g.datasources[id]; err != nil || !ok {
+			notFound()
+			return
+		}
+		switch r.Method {
+		case http.MethodPut:
+			var ds Datasource
+			json.NewDecoder(r.Body).Decode(&ds)
+			g.datasources[id] = ds
+		case http.MethodDelete:
+			delete(g.datasources, id)
+		}
+		reply(map[string]string{})
+	case r.Method == http.MethodPost && path == "/api/folders":
+		var f Folder
+		json.NewDecoder(r.Body).Decode(&f)
+		g.nextID++
+		f.ID = g.nextID
+		g.folders[f.UID] = f
+		reply(f)
+	case strings.HasPrefix(path, "/api/folders/"):
+		f, ok := g.folders[strings.TrimPrefix(path, "/api/folders/")]
+		if !ok {
+			notFound()
+			return
+		}
+		if r.Method == http.MethodDelete {
+			delete(g.folders, f.UID)
+		}
+		reply(f)
+	case r.Method == http.MethodPost && path == "/api/dashboards/db":
+		var req struct {
+			Dashboard map[string]interface{} `json:"dashboard"`
+			FolderID  int64                  `json:"folderId"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		uid := req.Dashboard["uid"].(string)
+		g.dashboards[uid] = req.Dashboard
+		g.folderOf[uid] = req.FolderID
+		reply(map[string]string{})
+	case r.Method == http.MethodDelete && strings.HasPrefix(path, "/api/dashboards/uid/"):
+		uid := strings.TrimPrefix(path, "/api/dashboards/uid/")
+		if _, ok := g.dashboards[uid]; !ok {
+			notFound()
+			return
+		}
+		delete(g.dashboards, uid)
+		reply(map[string]string{})
+	case r.Method == http.MethodGet && path == "/api/search":
+		q := r.URL.Query()
+		res := []FoundDashboard{}
+		for uid, board := range g.dashboards {
+			if ids := q["folderIds"]; len(ids) > 0 && ids[0] != fmt.Sprint(g.folderOf[uid]) {
+				continue
+			}
+			if !hasTags(board, q["tag"]) {
+				continue
+			}
+			res = append(res, FoundDashboard{UID: uid, Title: fmt.Sprint(board["title"])})
+		}
+		reply(res)
+	default:
+		notFound()
+	}
+}
+
+func hasTags(board map[string]interface{}, tags []string) bool {
+	have := map[string]bool{}
+	ts, _ := board["tags"].([]interface{})
+	for _, t := range ts {
+		have[fmt.Sprint(t)] = true
+	}
+	for _, t := range tags {
+		if !have[t] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestProvisionAndCleanup(t *testing.T) {
+	g := newFakeGrafana()
+	srv := httptest.NewServer(g)
+	defer srv.Close()
+	c := NewClient(srv.URL+"/", "", "", "token")
+
+	ds := Datasource{UID: "replay", Name: "replay", Type: "prometheus", URL: "http://localhost:8080"}
+	boards := func() []map[string]interface{} {
+		return []map[string]interface{}{
+			{"uid": "a", "title": "A", "id": 3, "tags": []interface{}{Tag, "replay"}},
+			{"uid": "b", "title": "B", "tags": []interface{}{Tag, "replay"}},
+		}
+	}
+	for run := 0; run < 2; run++ {
+		g.changes = nil
+		if err := c.Provision(ds, "Replay", boards()); err != nil {
+			t.Fatalf("run %d: %v", run, err)
+		}
+	}
+	// Another dashboard, which is not removed.
+	g.dashboards["c"] = map[string]interface{}{"uid": "c", "title": "C", "tags": []interface{}{Tag, "other"}}
+
+	if len(g.datasources) != 1 || len(g.folders) != 1 || len(g.dashboards) != 3 {
+		t.Fatalf("got %d datasources, %d folders and %d dashboards, want 1, 1 and 3",
+			len(g.datasources), len(g.folders), len(g.dashboards))
+	}
+	want := []string{"PUT /api/datasources/1", "POST /api/dashboards/db", "POST /api/dashboards/db"}
+	if strings.Join(g.changes, ", ") != strings.Join(want, ", ") {
+		t.Errorf("second run: got requests %v, want %v", g.changes, want)
+	}
+	if id := g.folderOf["a"]; id != g.folders[FolderUID("Replay")].ID {
+		t.Errorf("dashboard in folder %d, want the one of Replay", id)
+	}
+
+	// A datasource of the same name that was not provisioned is kept.
+	if _, err := c.Cleanup(Datasource{UID: "other", Name: "replay"}, "replay", "Replay"); err == nil {
+		t.Errorf("datasource with another uid deleted")
+	}
+	if len(g.datasources) != 1 || len(g.dashboards) != 3 {
+		t.Fatalf("cleanup with another datasource uid deleted something")
+	}
+
+	deleted, err := c.Cleanup(ds, "replay", "Replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 2+1+1 {
+		t.Errorf("got deleted %v, want the dashboards, the datasource and the folder", deleted)
+	}
+	if len(g.datasources) != 0 || len(g.folders) != 0 || len(g.dashboards) != 1 {
+		t.Errorf("left %d datasources, %d folders and %d dashboards, want only the other dashboard",
+			len(g.datasources), len(g.folders), len(g.dashboards))
+	}
+
+	// Nothing is left to delete.
+	if deleted, err := c.Cleanup(ds, "replay", "Replay"); err != nil || len(deleted) != 0 {
+		t.Errorf("second cleanup: deleted %v, %v", deleted, err)
+	}
+}
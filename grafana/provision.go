@@ -0,0 +1,133 @@
+package grafana
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pingcap/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// Provisioning describes the files Grafana provisions the datasource and the
+// dashboards from when it starts.
+type Provisioning struct {
+	// Dir is the provisioning directory of Grafana, with the datasources
+	// and dashboards directories.
+	Dir        string
+	Datasource Datasource
+	// Folder is the title of the folder of the dashboards, the General
+	// folder if empty.
+	Folder     string
+	Dashboards []map[string]interface{}
+	// DashboardsPath is the directory of the dashboard JSON files as Grafana
+	// sees it, the one they are written to if empty.
+	DashboardsPath string
+}
+
+type datasourcesFile struct {
+	APIVersion  int          `yaml:"apiVersion"`
+	Datasources []Datasource `yaml:"datasources"`
+}
+
+type dashboardsFile struct {
+	APIVersion int        `yaml:"apiVersion"`
+	Providers  []provider `yaml:"providers"`
+}
+
+type provider struct {
+	Name            string `yaml:"name"`
+	Folder          string `yaml:"folder,omitempty"`
+	FolderUID       string `yaml:"folderUid,omitempty"`
+	Type            string `yaml:"type"`
+	DisableDeletion bool   `yaml:"disableDeletion"`
+	Options         struct {
+		Path string `yaml:"path"`
+	} `yaml:"options"`
+}
+
+// Write writes datasources/<uid>.yaml, dashboards/<uid>.yaml and the
+// dashboards into dashboards/<uid>, uid being the one of the datasource,
+// replacing the files a previous run wrote. If the datasource has secrets its
+// file is only readable by the owner and the group, Grafana has to run as one
+// of them, e.g. with a setgid datasources directory of the group Grafana runs
+// as, 472 in its Docker image.
+func (p *Provisioning) Write() error {
+	name := p.Datasource.UID
+	dsDir := filepath.Join(p.Dir, "datasources")
+	boardsDir := filepath.Join(p.Dir, "dashboards")
+	jsonDir := filepath.Join(boardsDir, name)
+	for _, dir := range []string{dsDir, jsonDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	ds := datasourcesFile{APIVersion: 1, Datasources: []Datasource{p.Datasource}}
+	perm := os.FileMode(0644)
+	if len(p.Datasource.SecureJSONData) > 0 {
+		perm = 0640
+	}
+	if err := writeYAML(filepath.Join(dsDir, name+".yaml"), ds, perm); err != nil {
+		return err
+	}
+
+	// Dashboards that are gone since the last run are removed.
+	old, err := filepath.Glob(filepath.Join(jsonDir, "*.json"))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	for _, path := range old {
+		if err := os.Remove(path); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	for _, board := range p.Dashboards {
+		delete(board, "id")
+		uid, _ := board["uid"].(string)
+		if uid == "" {
+			return errors.Errorf("dashboard %v has no uid", board["title"])
+		}
+		b, err := json.MarshalIndent(board, "", "  ")
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if err := writeFile(filepath.Join(jsonDir, uid+".json"), b, 0644); err != nil {
+			return err
+		}
+	}
+
+	prov := provider{Name: name, Folder: p.Folder, Type: "file"}
+	if p.Folder != "" {
+		prov.FolderUID = FolderUID(p.Folder)
+	}
+	prov.Options.Path = p.DashboardsPath
+	if prov.Options.Path == "" {
+		if prov.Options.Path, err = filepath.Abs(jsonDir); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return writeYAML(filepath.Join(boardsDir, name+".yaml"), dashboardsFile{APIVersion: 1, Providers: []provider{prov}}, 0644)
+}
+
+func writeYAML(path string, v interface{}, perm os.FileMode) error {
+	b, err := yaml.Marshal(v)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return writeFile(path, b, perm)
+}
+
+// writeFile replaces the file at path with one with the permissions perm,
+// which also applies if a previous run wrote it with others.
+func writeFile(path string, b []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+	if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		return errors.Trace(err)
+	}
+	if err := ioutil.WriteFile(tmp, b, perm); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(os.Rename(tmp, path))
+}
@@ -0,0 +1,160 @@
+package grafana
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestProvisioningPermissions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "provisioning")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ds := Datasource{UID: "replay", Name: "replay", SecureJSONData: map[string]string{"basicAuthPassword": "secret"}}
+	dsFile := filepath.Join(dir, "datasources", "replay.yaml")
+	boardFile := filepath.Join(dir, "dashboards", "replay", "a.json")
+
+	// A file of a previous run with wider permissions is replaced.
+	if err := os.MkdirAll(filepath.Dir(dsFile), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(dsFile, nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(dsFile, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Provisioning{
+		Dir:        dir,
+		Datasource: ds,
+		Dashboards: []map[string]interface{}{{"uid": "a", "title": "A"}},
+	}
+	if err := p.Write(); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		path string
+		// mask are the permission bits that must not be set.
+		mask os.FileMode
+	}{
+		// Grafana reads it as the group.
+		{dsFile, 0037},
+		{boardFile, 0022},
+		{filepath.Join(dir, "dashboards", "replay.yaml"), 0022},
+	}
+	for _, c := range cases {
+		fi, err := os.Stat(c.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm()&c.mask != 0 {
+			t.Errorf("%s: got mode %v", c.path, fi.Mode())
+		}
+	}
+}
+
+func TestProvisioningFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "provisioning")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := &Provisioning{
+		Dir: dir,
+		Datasource: Datasource{
+			UID:            "replay",
+			Name:           "replay",
+			Type:           "prometheus",
+			SecureJSONData: map[string]string{"basicAuthPassword": "secret"},
+		},
+		Folder:         "Replay",
+		Dashboards:     []map[string]interface{}{{"uid": "a", "title": "A", "id": 1}},
+		DashboardsPath: "/var/lib/grafana/dashboards/replay",
+	}
+	if err := p.Write(); err != nil {
+		t.Fatal(err)
+	}
+
+	var ds struct {
+		APIVersion  int `yaml:"apiVersion"`
+		Datasources []struct {
+			UID            string            `yaml:"uid"`
+			SecureJSONData map[string]string `yaml:"secureJsonData"`
+		} `yaml:"datasources"`
+	}
+	readYAML(t, filepath.Join(dir, "datasources", "replay.yaml"), &ds)
+	if ds.APIVersion != 1 || len(ds.Datasources) != 1 {
+		t.Fatalf("got datasources file %+v", ds)
+	}
+	if got := ds.Datasources[0]; got.UID != "replay" || got.SecureJSONData["basicAuthPassword"] != "secret" {
+		t.Errorf("got datasource %+v, want uid replay with the password in secureJsonData", got)
+	}
+
+	var boards struct {
+		APIVersion int `yaml:"apiVersion"`
+		Providers  []struct {
+			Name      string `yaml:"name"`
+			Folder    string `yaml:"folder"`
+			FolderUID string `yaml:"folderUid"`
+			Options   struct {
+				Path string `yaml:"path"`
+			} `yaml:"options"`
+		} `yaml:"providers"`
+	}
+	readYAML(t, filepath.Join(dir, "dashboards", "replay.yaml"), &boards)
+	if boards.APIVersion != 1 || len(boards.Providers) != 1 {
+		t.Fatalf("got dashboards file %+v", boards)
+	}
+	prov := boards.Providers[0]
+	if prov.Name != "replay" || prov.Folder != "Replay" || prov.FolderUID != StableUID("folder Replay") {
+		t.Errorf("got provider %+v, want folder Replay with its stable uid", prov)
+	}
+	if prov.Options.Path != p.DashboardsPath {
+		t.Errorf("got options.path %q, want %q", prov.Options.Path, p.DashboardsPath)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "dashboards", "replay", "a.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var board map[string]interface{}
+	if err := json.Unmarshal(b, &board); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := board["id"]; ok || board["uid"] != "a" {
+		t.Errorf("got dashboard %v, want uid a without id", board)
+	}
+
+	// Without secrets the datasource is readable by everyone.
+	p.Datasource.SecureJSONData = nil
+	if err := p.Write(); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(filepath.Join(dir, "datasources", "replay.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm()&0004 == 0 {
+		t.Errorf("datasource without secrets has mode %v", fi.Mode())
+	}
+}
+
+func readYAML(t *testing.T, path string, v interface{}) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := yaml.Unmarshal(b, v); err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+}
@@ -0,0 +1,312 @@
+// Package progress reports the progress of long running tasks, as a bar on a
+// terminal or as log lines otherwise.
+package progress
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pingcap/errors"
+)
+
+// Mode selects how progress is written.
+type Mode string
+
+const (
+	// Auto draws a bar if the output is a terminal and writes log lines
+	// otherwise.
+	Auto Mode = "auto"
+	// Bar redraws a single line.
+	Bar Mode = "bar"
+	// Log writes a logfmt line per interval.
+	Log Mode = "log"
+	// None writes nothing.
+	None Mode = "none"
+)
+
+const (
+	barWidth    = 30
+	barInterval = 200 * time.Millisecond
+	logInterval = 10 * time.Second
+)
+
+// Tracker counts the items and bytes done of a task. All methods can be called
+// concurrently and on a nil Tracker, which does nothing.
+type Tracker struct {
+	w        io.Writer
+	task     string
+	mode     Mode
+	interval time.Duration
+
+	mtx        sync.Mutex
+	unit       string
+	total      int
+	totalBytes int64
+	done       int
+	bytes      int64
+	start      time.Time
+	// width is the length of the last bar drawn.
+	width int
+
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// New returns a Tracker for task that writes to w.
+func New(w io.Writer, task string, mode Mode) (*Tracker, error) {
+	switch mode {
+	case Auto, "":
+		mode = Log
+		if isTerminal(w) {
+			mode = Bar
+		}
+	case Bar, Log, None:
+	default:
+		return nil, errors.Errorf("unknown progress mode %q", mode)
+	}
+
+	interval := logInterval
+	if mode == Bar {
+		interval = barInterval
+	}
+
+	return &Tracker{
+		w:        w,
+		task:     task,
+		mode:     mode,
+		interval: interval,
+	}, nil
+}
+
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// Start starts reporting. total is the number of items of unit, e.g. blocks,
+// and totalBytes their size, either is 0 if it is unknown.
+func (t *Tracker) Start(unit string, total int, totalBytes int64) {
+	if t == nil {
+		return
+	}
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if t.stop != nil {
+		return
+	}
+	t.unit, t.total, t.totalBytes = unit, total, totalBytes
+	t.start = time.Now()
+	t.stop = make(chan struct{})
+	t.stopped = make(chan struct{})
+
+	go t.run()
+}
+
+func (t *Tracker) run() {
+	defer close(t.stopped)
+	if t.mode == None {
+		<-t.stop
+		return
+	}
+
+	tick := time.NewTicker(t.interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-t.stop:
+			return
+		case <-tick.C:
+			t.mtx.Lock()
+			t.report()
+			t.mtx.Unlock()
+		}
+	}
+}
+
+// Add adds n items of the given size to the ones done.
+func (t *Tracker) Add(n int, bytes int64) {
+	if t == nil {
+		return
+	}
+
+	t.mtx.Lock()
+	t.done += n
+	t.bytes += bytes
+	t.mtx.Unlock()
+}
+
+// Summary is the result of a task.
+type Summary struct {
+	Task     string
+	Unit     string
+	Done     int
+	Bytes    int64
+	Duration time.Duration
+}
+
+func (s Summary) String() string {
+	secs := s.Duration.Seconds()
+	if secs <= 0 {
+		secs = 1e-9
+	}
+
+	str := fmt.Sprintf("%s: %d %s", s.Task, s.Done, s.Unit)
+	if s.Bytes > 0 {
+		str += ", " + FormatBytes(s.Bytes)
+	}
+	str += fmt.Sprintf(" in %s (", s.Duration.Round(time.Millisecond))
+	if s.Bytes > 0 {
+		str += FormatBytes(int64(float64(s.Bytes)/secs)) + "/s, "
+	}
+	return str + fmt.Sprintf("%.1f %s/s)", float64(s.Done)/secs, s.Unit)
+}
+
+// Finish stops reporting and writes the summary. It does nothing if the
+// Tracker was not started.
+func (t *Tracker) Finish() Summary {
+	if t == nil {
+		return Summary{}
+	}
+
+	t.mtx.Lock()
+	stop := t.stop
+	t.mtx.Unlock()
+	if stop == nil {
+		return Summary{}
+	}
+	close(stop)
+	<-t.stopped
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.stop = nil
+
+	s := Summary{
+		Task:     t.task,
+		Unit:     t.unit,
+		Done:     t.done,
+		Bytes:    t.bytes,
+		Duration: time.Since(t.start),
+	}
+	switch t.mode {
+	case Bar:
+		t.report()
+		fmt.Fprintln(t.w)
+		fmt.Fprintln(t.w, s)
+	case Log:
+		fmt.Fprintf(t.w, "ts=%s task=%s msg=%q\n", time.Now().UTC().Format(time.RFC3339), t.task, s)
+	}
+
+	return s
+}
+
+// report writes the current progress, t.mtx must be held.
+func (t *Tracker) report() {
+	elapsed := time.Since(t.start)
+	eta := t.eta(elapsed)
+
+	if t.mode == Log {
+		line := fmt.Sprintf("ts=%s task=%s %s=%d", time.Now().UTC().Format(time.RFC3339), t.task, t.unit, t.done)
+		if t.total > 0 {
+			line += fmt.Sprintf(" total_%s=%d", t.unit, t.total)
+		}
+		line += fmt.Sprintf(" bytes=%d", t.bytes)
+		if t.totalBytes > 0 {
+			line += fmt.Sprintf(" total_bytes=%d", t.totalBytes)
+		}
+		line += fmt.Sprintf(" elapsed=%s", elapsed.Round(time.Second))
+		if eta >= 0 {
+			line += fmt.Sprintf(" eta=%s", eta.Round(time.Second))
+		}
+		fmt.Fprintln(t.w, line)
+		return
+	}
+
+	line := t.task
+	if bar := t.bar(); bar != "" {
+		line += " " + bar
+	}
+	line += fmt.Sprintf(" %d", t.done)
+	if t.total > 0 {
+		line += fmt.Sprintf("/%d", t.total)
+	}
+	line += " " + t.unit
+	if t.bytes > 0 || t.totalBytes > 0 {
+		line += " " + FormatBytes(t.bytes)
+		if t.totalBytes > 0 {
+			line += "/" + FormatBytes(t.totalBytes)
+		}
+	}
+	if eta >= 0 {
+		line += " ETA " + eta.Round(time.Second).String()
+	} else {
+		line += " " + elapsed.Round(time.Second).String()
+	}
+
+	// Overwrite the rest of a longer previous line.
+	pad := t.width - len(line)
+	t.width = len(line)
+	if pad > 0 {
+		line += strings.Repeat(" ", pad)
+	}
+	fmt.Fprint(t.w, "\r"+line)
+}
+
+// fraction returns the part of the task done, by bytes if their total is
+// known, or -1 if it is unknown.
+func (t *Tracker) fraction() float64 {
+	var f float64
+	switch {
+	case t.totalBytes > 0:
+		f = float64(t.bytes) / float64(t.totalBytes)
+	case t.total > 0:
+		f = float64(t.done) / float64(t.total)
+	default:
+		return -1
+	}
+	if f > 1 {
+		f = 1
+	}
+	return f
+}
+
+// eta returns the estimated time left, or -1 if it is unknown.
+func (t *Tracker) eta(elapsed time.Duration) time.Duration {
+	f := t.fraction()
+	if f <= 0 {
+		return -1
+	}
+	return time.Duration(float64(elapsed) * (1 - f) / f)
+}
+
+func (t *Tracker) bar() string {
+	f := t.fraction()
+	if f < 0 {
+		return ""
+	}
+	n := int(f * barWidth)
+	return "[" + strings.Repeat("=", n) + strings.Repeat(" ", barWidth-n) + "]"
+}
+
+// FormatBytes formats n with a binary unit, e.g. 1.5 GiB.
+func FormatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
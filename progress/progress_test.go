@@ -0,0 +1,184 @@
+package progress
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFormatBytes(t *testing.T) {
+	cases := []struct {
+		n    int64
+		want string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1024, "1.0 KiB"},
+		{1536, "1.5 KiB"},
+		{5 << 20, "5.0 MiB"},
+		{3 << 30, "3.0 GiB"},
+		{1 << 50, "1.0 PiB"},
+	}
+	for _, c := range cases {
+		if got := FormatBytes(c.n); got != c.want {
+			t.Errorf("%d: got %q, want %q", c.n, got, c.want)
+		}
+	}
+}
+
+func TestSummary(t *testing.T) {
+	cases := []struct {
+		s    Summary
+		want string
+	}{
+		{
+			s:    Summary{Task: "dump", Unit: "blocks", Done: 4, Duration: 2 * time.Second},
+			want: "dump: 4 blocks in 2s (2.0 blocks/s)",
+		},
+		{
+			s:    Summary{Task: "dump", Unit: "blocks", Done: 4, Bytes: 4 << 20, Duration: 2 * time.Second},
+			want: "dump: 4 blocks, 4.0 MiB in 2s (2.0 MiB/s, 2.0 blocks/s)",
+		},
+		{
+			// A zero duration does not divide by zero.
+			s:    Summary{Task: "dump", Unit: "blocks"},
+			want: "dump: 0 blocks in 0s (0.0 blocks/s)",
+		},
+	}
+	for _, c := range cases {
+		if got := c.s.String(); got != c.want {
+			t.Errorf("got %q, want %q", got, c.want)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	cases := []struct {
+		mode Mode
+		want Mode
+		err  bool
+	}{
+		// A buffer is not a terminal.
+		{mode: Auto, want: Log},
+		{mode: "", want: Log},
+		{mode: Bar, want: Bar},
+		{mode: Log, want: Log},
+		{mode: None, want: None},
+		{mode: "fancy", err: true},
+	}
+	for _, c := range cases {
+		tr, err := New(&bytes.Buffer{}, "dump", c.mode)
+		switch {
+		case c.err && err == nil:
+			t.Errorf("%q: want an error", c.mode)
+		case !c.err && err != nil:
+			t.Errorf("%q: %v", c.mode, err)
+		case !c.err && tr.mode != c.want:
+			t.Errorf("%q: got mode %q, want %q", c.mode, tr.mode, c.want)
+		}
+	}
+}
+
+func TestTracker(t *testing.T) {
+	cases := []struct {
+		mode Mode
+		want []string
+	}{
+		{mode: None},
+		{mode: Log, want: []string{"task=dump", `msg="dump: 100 series, 100 B in`}},
+		{mode: Bar, want: []string{"\rdump [" + strings.Repeat("=", barWidth) + "] 100/100 series 100 B/100 B", "\ndump: 100 series, 100 B in"}},
+	}
+	for _, c := range cases {
+		var buf bytes.Buffer
+		tr, err := New(&buf, "dump", c.mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tr.Start("series", 100, 100)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 10; j++ {
+					tr.Add(1, 1)
+				}
+			}()
+		}
+		wg.Wait()
+
+		s := tr.Finish()
+		if s.Task != "dump" || s.Unit != "series" || s.Done != 100 || s.Bytes != 100 {
+			t.Errorf("%q: got summary %+v", c.mode, s)
+		}
+		out := buf.String()
+		if len(c.want) == 0 && out != "" {
+			t.Errorf("%q: got output %q, want none", c.mode, out)
+		}
+		for _, w := range c.want {
+			if !strings.Contains(out, w) {
+				t.Errorf("%q: output %q does not contain %q", c.mode, out, w)
+			}
+		}
+
+		// Finishing again is a no-op.
+		if s := tr.Finish(); s != (Summary{}) {
+			t.Errorf("%q: finished twice, got %+v", c.mode, s)
+		}
+	}
+}
+
+func TestNilTracker(t *testing.T) {
+	var tr *Tracker
+	tr.Start("blocks", 1, 0)
+	tr.Add(1, 0)
+	if s := tr.Finish(); s != (Summary{}) {
+		t.Errorf("got %+v", s)
+	}
+}
+
+func TestFinishNotStarted(t *testing.T) {
+	var buf bytes.Buffer
+	tr, err := New(&buf, "dump", Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := tr.Finish(); s != (Summary{}) || buf.Len() != 0 {
+		t.Errorf("got %+v, output %q", s, buf.String())
+	}
+}
+
+func TestETA(t *testing.T) {
+	cases := []struct {
+		total      int
+		totalBytes int64
+		done       int
+		bytes      int64
+		fraction   float64
+		eta        time.Duration
+		bar        string
+	}{
+		{fraction: -1, eta: -1},
+		{total: 4, done: 0, fraction: 0, eta: -1, bar: "[" + strings.Repeat(" ", barWidth) + "]"},
+		{total: 4, done: 1, fraction: 0.25, eta: 30 * time.Second, bar: "[" + strings.Repeat("=", 7) + strings.Repeat(" ", 23) + "]"},
+		// Bytes are preferred over items.
+		{total: 4, done: 1, totalBytes: 100, bytes: 50, fraction: 0.5, eta: 10 * time.Second, bar: "[" + strings.Repeat("=", 15) + strings.Repeat(" ", 15) + "]"},
+		// More than the total is done.
+		{total: 4, done: 5, fraction: 1, eta: 0, bar: "[" + strings.Repeat("=", barWidth) + "]"},
+	}
+	for i, c := range cases {
+		tr := &Tracker{total: c.total, totalBytes: c.totalBytes, done: c.done, bytes: c.bytes}
+		if got := tr.fraction(); got != c.fraction {
+			t.Errorf("%d: got fraction %v, want %v", i, got, c.fraction)
+		}
+		if got := tr.eta(10 * time.Second); got != c.eta {
+			t.Errorf("%d: got eta %v, want %v", i, got, c.eta)
+		}
+		if got := tr.bar(); got != c.bar {
+			t.Errorf("%d: got bar %q, want %q", i, got, c.bar)
+		}
+	}
+}
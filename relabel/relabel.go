@@ -0,0 +1,226 @@
+// Package relabel applies Prometheus style relabel_configs to label sets.
+package relabel
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pingcap/errors"
+	"github.com/prometheus/tsdb/labels"
+	"gopkg.in/yaml.v2"
+)
+
+// Action is the relabeling action to perform.
+type Action string
+
+const (
+	Replace   Action = "replace"
+	Keep      Action = "keep"
+	Drop      Action = "drop"
+	HashMod   Action = "hashmod"
+	LabelMap  Action = "labelmap"
+	LabelDrop Action = "labeldrop"
+	LabelKeep Action = "labelkeep"
+)
+
+var labelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// Config is a relabeling step, see
+// https://prometheus.io/docs/prometheus/latest/configuration/configuration/#relabel_config
+type Config struct {
+	SourceLabels []string `yaml:"source_labels,flow,omitempty"`
+	Separator    string   `yaml:"separator,omitempty"`
+	Regex        Regexp   `yaml:"regex,omitempty"`
+	Modulus      uint64   `yaml:"modulus,omitempty"`
+	TargetLabel  string   `yaml:"target_label,omitempty"`
+	Replacement  string   `yaml:"replacement,omitempty"`
+	Action       Action   `yaml:"action,omitempty"`
+}
+
+// UnmarshalYAML sets the defaults of Prometheus and validates the config.
+func (c *Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain Config
+	*c = Config{
+		Separator:   ";",
+		Regex:       MustNewRegexp("(.*)"),
+		Replacement: "$1",
+		Action:      Replace,
+	}
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+	c.Action = Action(strings.ToLower(string(c.Action)))
+
+	switch c.Action {
+	case Replace:
+		if c.TargetLabel == "" {
+			return errors.Errorf("relabel action %s requires target_label", c.Action)
+		}
+	case HashMod:
+		if c.TargetLabel == "" {
+			return errors.Errorf("relabel action %s requires target_label", c.Action)
+		}
+		if c.Modulus == 0 {
+			return errors.Errorf("relabel action %s requires a non-zero modulus", c.Action)
+		}
+	case LabelDrop, LabelKeep:
+		if len(c.SourceLabels) > 0 || c.TargetLabel != "" || c.Modulus != 0 {
+			return errors.Errorf("relabel action %s only takes regex", c.Action)
+		}
+	case Keep, Drop, LabelMap:
+	default:
+		return errors.Errorf("unknown relabel action %q", c.Action)
+	}
+
+	if c.Action == Replace && !strings.Contains(c.TargetLabel, "$") && !labelName.MatchString(c.TargetLabel) {
+		return errors.Errorf("%q is an invalid target_label", c.TargetLabel)
+	}
+	return nil
+}
+
+// Regexp is a regular expression that is anchored on both ends.
+type Regexp struct {
+	*regexp.Regexp
+	original string
+}
+
+// NewRegexp compiles an anchored regular expression.
+func NewRegexp(s string) (Regexp, error) {
+	re, err := regexp.Compile("^(?:" + s + ")$")
+	return Regexp{Regexp: re, original: s}, errors.Trace(err)
+}
+
+// MustNewRegexp is like NewRegexp but panics if s does not compile.
+func MustNewRegexp(s string) Regexp {
+	re, err := NewRegexp(s)
+	if err != nil {
+		panic(err)
+	}
+	return re
+}
+
+func (re *Regexp) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	r, err := NewRegexp(s)
+	if err != nil {
+		return err
+	}
+	*re = r
+	return nil
+}
+
+func (re Regexp) MarshalYAML() (interface{}, error) {
+	if re.Regexp != nil {
+		return re.original, nil
+	}
+	return nil, nil
+}
+
+// LoadFile reads the relabel_configs of a YAML file.
+func LoadFile(path string) ([]*Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var file struct {
+		RelabelConfigs []*Config `yaml:"relabel_configs"`
+	}
+	if err := yaml.UnmarshalStrict(b, &file); err != nil {
+		return nil, errors.Wrapf(err, "parse %s", path)
+	}
+
+	return file.RelabelConfigs, nil
+}
+
+// Process applies the configs to lset in order. It returns nil if the series
+// is dropped. lset is not modified.
+func Process(lset labels.Labels, cfgs ...*Config) labels.Labels {
+	m := lset.Map()
+	for _, cfg := range cfgs {
+		if !relabel(m, cfg) {
+			return nil
+		}
+	}
+
+	res := make(labels.Labels, 0, len(m))
+	for name, value := range m {
+		if value != "" {
+			res = append(res, labels.Label{Name: name, Value: value})
+		}
+	}
+	sort.Sort(res)
+
+	return res
+}
+
+func relabel(m map[string]string, cfg *Config) bool {
+	values := make([]string, 0, len(cfg.SourceLabels))
+	for _, name := range cfg.SourceLabels {
+		values = append(values, m[name])
+	}
+	val := strings.Join(values, cfg.Separator)
+
+	switch cfg.Action {
+	case Drop:
+		if cfg.Regex.MatchString(val) {
+			return false
+		}
+	case Keep:
+		if !cfg.Regex.MatchString(val) {
+			return false
+		}
+	case Replace:
+		indexes := cfg.Regex.FindStringSubmatchIndex(val)
+		if indexes == nil {
+			break
+		}
+		target := string(cfg.Regex.ExpandString(nil, cfg.TargetLabel, val, indexes))
+		if !labelName.MatchString(target) {
+			break
+		}
+		res := cfg.Regex.ExpandString(nil, cfg.Replacement, val, indexes)
+		if len(res) == 0 {
+			delete(m, target)
+			break
+		}
+		m[target] = string(res)
+	case HashMod:
+		sum := md5.Sum([]byte(val))
+		mod := binary.BigEndian.Uint64(sum[8:]) % cfg.Modulus
+		m[cfg.TargetLabel] = strconv.FormatUint(mod, 10)
+	case LabelMap:
+		// Only the labels present before the step are mapped.
+		mapped := map[string]string{}
+		for name, value := range m {
+			if cfg.Regex.MatchString(name) {
+				mapped[cfg.Regex.ReplaceAllString(name, cfg.Replacement)] = value
+			}
+		}
+		for name, value := range mapped {
+			m[name] = value
+		}
+	case LabelDrop:
+		for name := range m {
+			if cfg.Regex.MatchString(name) {
+				delete(m, name)
+			}
+		}
+	case LabelKeep:
+		for name := range m {
+			if !cfg.Regex.MatchString(name) {
+				delete(m, name)
+			}
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,118 @@
+package relabel
+
+import (
+	"testing"
+
+	"github.com/prometheus/tsdb/labels"
+	"gopkg.in/yaml.v2"
+)
+
+func parse(t *testing.T, s string) []*Config {
+	var cfgs []*Config
+	if err := yaml.UnmarshalStrict([]byte(s), &cfgs); err != nil {
+		t.Fatalf("parse %s: %v", s, err)
+	}
+	return cfgs
+}
+
+func TestProcess(t *testing.T) {
+	in := labels.FromStrings("__name__", "up", "job", "node", "instance", "a:9100")
+
+	cases := []struct {
+		name   string
+		config string
+		want   labels.Labels
+	}{
+		{
+			name:   "replace",
+			config: `[{source_labels: [instance], regex: "(.*):.*", target_label: host}]`,
+			want:   labels.FromStrings("__name__", "up", "job", "node", "instance", "a:9100", "host", "a"),
+		},
+		{
+			name:   "replace without match",
+			config: `[{source_labels: [job], regex: "prom", target_label: job, replacement: x}]`,
+			want:   in,
+		},
+		{
+			name:   "replace with an empty value removes the label",
+			config: `[{source_labels: [job], regex: ".*", target_label: instance, replacement: ""}]`,
+			want:   labels.FromStrings("__name__", "up", "job", "node"),
+		},
+		{
+			name:   "target label from the match",
+			config: `[{source_labels: [job], target_label: "${1}_name", replacement: x}]`,
+			want:   labels.FromStrings("__name__", "up", "job", "node", "instance", "a:9100", "node_name", "x"),
+		},
+		{
+			name:   "separator",
+			config: `[{source_labels: [job, instance], separator: "/", target_label: id}]`,
+			want:   labels.FromStrings("__name__", "up", "job", "node", "instance", "a:9100", "id", "node/a:9100"),
+		},
+		{
+			name:   "keep",
+			config: `[{source_labels: [job], regex: node, action: keep}]`,
+			want:   in,
+		},
+		{
+			name:   "keep is anchored",
+			config: `[{source_labels: [job], regex: nod, action: keep}]`,
+		},
+		{
+			name:   "drop",
+			config: `[{source_labels: [__name__], regex: "u.*", action: drop}]`,
+		},
+		{
+			name:   "hashmod",
+			config: `[{source_labels: [instance], modulus: 1, target_label: shard, action: hashmod}]`,
+			want:   labels.FromStrings("__name__", "up", "job", "node", "instance", "a:9100", "shard", "0"),
+		},
+		{
+			name:   "labelmap",
+			config: `[{regex: "(job|instance)", replacement: "orig_$1", action: labelmap}]`,
+			want:   labels.FromStrings("__name__", "up", "job", "node", "instance", "a:9100", "orig_job", "node", "orig_instance", "a:9100"),
+		},
+		{
+			name:   "labeldrop",
+			config: `[{regex: "inst.*", action: labeldrop}]`,
+			want:   labels.FromStrings("__name__", "up", "job", "node"),
+		},
+		{
+			name:   "labelkeep",
+			config: `[{regex: "__name__|job", action: labelkeep}]`,
+			want:   labels.FromStrings("__name__", "up", "job", "node"),
+		},
+		{
+			name: "steps in order",
+			config: `[{source_labels: [instance], regex: "(.*):.*", target_label: host},
+				{regex: instance, action: labeldrop},
+				{source_labels: [host], regex: b, action: drop}]`,
+			want: labels.FromStrings("__name__", "up", "job", "node", "host", "a"),
+		},
+	}
+	for _, c := range cases {
+		got := Process(in, parse(t, c.config)...)
+		if !got.Equals(c.want) {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		}
+	}
+	if !in.Equals(labels.FromStrings("__name__", "up", "job", "node", "instance", "a:9100")) {
+		t.Errorf("input modified: %v", in)
+	}
+}
+
+func TestConfigInvalid(t *testing.T) {
+	cases := []string{
+		`[{source_labels: [job]}]`,
+		`[{target_label: x, action: hashmod}]`,
+		`[{regex: x, target_label: y, action: labeldrop}]`,
+		`[{action: unknown}]`,
+		`[{target_label: "1x"}]`,
+		`[{regex: "(", target_label: x}]`,
+	}
+	for _, c := range cases {
+		var cfgs []*Config
+		if err := yaml.UnmarshalStrict([]byte(c), &cfgs); err == nil {
+			t.Errorf("%s: no error", c)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package replay
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+
+	"github.com/pingcap/errors"
+)
+
+// DashboardsDir is the directory of the dashboards in a replay directory.
+const DashboardsDir = "dashboards"
+
+// builtinDatasources are the datasources of Grafana itself, which are kept.
+var builtinDatasources = map[string]bool{"-- Grafana --": true, "grafana": true, "-- Dashboard --": true}
+
+// ReadDashboards reads the dashboard JSON files in dir ordered by file name.
+// Dashboards wrapped into the response of the Grafana API are unwrapped.
+func ReadDashboards(dir string) ([]map[string]interface{}, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	sort.Strings(paths)
+
+	boards := make([]map[string]interface{}, 0, len(paths))
+	for _, path := range paths {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		board, err := decodeDashboard(b)
+		if err != nil {
+			return nil, errors.Wrapf(err, "read dashboard %s", path)
+		}
+		boards = append(boards, board)
+	}
+	return boards, nil
+}
+
+// HasDashboards returns whether dir is a directory with dashboard JSON files.
+func HasDashboards(dir string) bool {
+	if _, err := os.Stat(dir); err != nil {
+		return false
+	}
+	paths, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	return len(paths) > 0
+}
+
+func decodeDashboard(b []byte) (map[string]interface{}, error) {
+	var board map[string]interface{}
+	if err := json.Unmarshal(b, &board); err != nil {
+		return nil, errors.Wrap(err, "decode dashboard")
+	}
+	if inner, ok := board["dashboard"].(map[string]interface{}); ok {
+		return inner, nil
+	}
+	return board, nil
+}
+
+// RewriteDatasources points every panel, target, annotation and template
+// variable of board to the datasource name. Panels using the default
+// datasource are pointed to it as well, the datasources of Grafana itself are
+// kept.
+func RewriteDatasources(board map[string]interface{}, name string) {
+	rewriteDatasources(board, name)
+
+	templating, _ := board["templating"].(map[string]interface{})
+	list, _ := templating["list"].([]interface{})
+	for _, v := range list {
+		v, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		switch v["type"] {
+		case "query":
+			if _, ok := v["datasource"]; !ok {
+				v["datasource"] = name
+			}
+		case "datasource":
+			// Datasource variables select the replay datasource only.
+			v["regex"] = "/^" + regexp.QuoteMeta(name) + "$/"
+			v["current"] = map[string]interface{}{"text": name, "value": name}
+			v["options"] = []interface{}{}
+		}
+	}
+}
+
+func rewriteDatasources(v interface{}, name string) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		ds, ok := v["datasource"]
+		_, panel := v["targets"]
+		if ok && !isBuiltinDatasource(ds) || !ok && panel {
+			v["datasource"] = name
+		}
+		for _, e := range v {
+			rewriteDatasources(e, name)
+		}
+	case []interface{}:
+		for _, e := range v {
+			rewriteDatasources(e, name)
+		}
+	}
+}
+
+// isBuiltinDatasource returns whether ds, a datasource name or reference,
+// is a datasource of Grafana itself.
+func isBuiltinDatasource(ds interface{}) bool {
+	switch ds := ds.(type) {
+	case string:
+		return builtinDatasources[ds]
+	case map[string]interface{}:
+		uid, _ := ds["uid"].(string)
+		return builtinDatasources[uid]
+	}
+	return false
+}
@@ -0,0 +1,89 @@
+package replay
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestRewriteDatasources(t *testing.T) {
+	const board = `{
+  "annotations": {"list": [
+    {"name": "Annotations & Alerts", "datasource": "-- Grafana --"},
+    {"name": "Deploys", "datasource": "prometheus", "expr": "deploys"}
+  ]},
+  "panels": [
+    {"id": 1, "datasource": "prometheus", "targets": [{"expr": "up"}]},
+    {"id": 2, "datasource": {"type": "prometheus", "uid": "P1"}, "targets": [{"expr": "up", "datasource": {"type": "prometheus", "uid": "P1"}}]},
+    {"id": 3, "targets": [{"expr": "up"}]},
+    {"id": 4, "datasource": null, "targets": [{"expr": "up"}]},
+    {"id": 5, "datasource": {"type": "datasource", "uid": "grafana"}, "targets": [{"queryType": "randomWalk"}]},
+    {"id": 6, "type": "row", "collapsed": true, "panels": [
+      {"id": 7, "datasource": "$ds", "targets": [{"expr": "up"}]}
+    ]},
+    {"id": 8, "type": "text"}
+  ],
+  "templating": {"list": [
+    {"name": "ds", "type": "datasource", "query": "prometheus", "current": {"text": "prod", "value": "prod"}, "options": [{"text": "prod", "value": "prod"}]},
+    {"name": "job", "type": "query", "datasource": "$ds", "query": "label_values(up, job)"},
+    {"name": "instance", "type": "query", "query": "label_values(up{job=\"$job\"}, instance)"},
+    {"name": "env", "type": "custom", "query": "prod,dev"}
+  ]}
+}`
+	const want = `{
+  "annotations": {"list": [
+    {"name": "Annotations & Alerts", "datasource": "-- Grafana --"},
+    {"name": "Deploys", "datasource": "replay", "expr": "deploys"}
+  ]},
+  "panels": [
+    {"id": 1, "datasource": "replay", "targets": [{"expr": "up"}]},
+    {"id": 2, "datasource": "replay", "targets": [{"expr": "up", "datasource": "replay"}]},
+    {"id": 3, "datasource": "replay", "targets": [{"expr": "up"}]},
+    {"id": 4, "datasource": "replay", "targets": [{"expr": "up"}]},
+    {"id": 5, "datasource": {"type": "datasource", "uid": "grafana"}, "targets": [{"queryType": "randomWalk"}]},
+    {"id": 6, "type": "row", "collapsed": true, "panels": [
+      {"id": 7, "datasource": "replay", "targets": [{"expr": "up"}]}
+    ]},
+    {"id": 8, "type": "text"}
+  ],
+  "templating": {"list": [
+    {"name": "ds", "type": "datasource", "query": "prometheus", "regex": "/^replay$/", "current": {"text": "replay", "value": "replay"}, "options": []},
+    {"name": "job", "type": "query", "datasource": "replay", "query": "label_values(up, job)"},
+    {"name": "instance", "type": "query", "datasource": "replay", "query": "label_values(up{job=\"$job\"}, instance)"},
+    {"name": "env", "type": "custom", "query": "prod,dev"}
+  ]}
+}`
+
+	var got, exp map[string]interface{}
+	if err := json.Unmarshal([]byte(board), &got); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(want), &exp); err != nil {
+		t.Fatal(err)
+	}
+	RewriteDatasources(got, "replay")
+	if !reflect.DeepEqual(got, exp) {
+		b, _ := json.MarshalIndent(got, "", "  ")
+		t.Errorf("got %s", b)
+	}
+}
+
+func TestDecodeDashboard(t *testing.T) {
+	cases := []string{
+		`{"title": "a"}`,
+		// The response of the Grafana API.
+		`{"meta": {"slug": "a"}, "dashboard": {"title": "a"}}`,
+	}
+	for _, c := range cases {
+		board, err := decodeDashboard([]byte(c))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if board["title"] != "a" {
+			t.Errorf("%s: got %v", c, board)
+		}
+	}
+	if _, err := decodeDashboard([]byte(`[`)); err == nil {
+		t.Errorf("invalid JSON not detected")
+	}
+}
@@ -0,0 +1,100 @@
+package replay
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/pingcap/errors"
+	"github.com/qiffang/prom-tools/grafana"
+)
+
+// Listen configures how the replay and record servers listen.
+type Listen struct {
+	Addr string
+	// CertFile and KeyFile serve HTTPS if set.
+	CertFile, KeyFile string
+	// User and Password or Token protect the API if set.
+	User, Password, Token string
+}
+
+// Check returns an error if the options do not go together.
+func (l Listen) Check() error {
+	if (l.CertFile == "") != (l.KeyFile == "") {
+		return errors.New("the TLS certificate and key must be set together")
+	}
+	if l.Token != "" && l.User != "" {
+		return errors.New("basic auth and a bearer token cannot be set together")
+	}
+	if (l.User == "") != (l.Password == "") {
+		return errors.New("the basic auth user and password must be set together")
+	}
+	return nil
+}
+
+// TLS reports whether the server serves HTTPS.
+func (l Listen) TLS() bool {
+	return l.CertFile != ""
+}
+
+// Auth reports whether the server requires credentials.
+func (l Listen) Auth() bool {
+	return l.User != "" || l.Token != ""
+}
+
+// URL returns the URL of the server, with 127.0.0.1 for an unspecified host.
+func (l Listen) URL() (string, error) {
+	host, port, err := net.SplitHostPort(l.Addr)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host = "127.0.0.1"
+	}
+
+	scheme := "http"
+	if l.TLS() {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s", scheme, net.JoinHostPort(host, port)), nil
+}
+
+// Authenticate reports whether req has the credentials the server requires.
+// If not, it writes an unauthorized error to w.
+func (l Listen) Authenticate(w http.ResponseWriter, req *http.Request) bool {
+	if l.Token != "" {
+		if equal(req.Header.Get("Authorization"), "Bearer "+l.Token) {
+			return true
+		}
+	} else {
+		user, pwd, ok := req.BasicAuth()
+		if !l.Auth() || ok && equal(user, l.User) && equal(pwd, l.Password) {
+			return true
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="prom-tools"`)
+	}
+	writeError(w, http.StatusUnauthorized, "unauthorized", errors.New("unauthorized"))
+	return false
+}
+
+func equal(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// Credentials sets the credentials the server requires on the datasource
+// grafana queries it with.
+func (l Listen) Credentials(ds *grafana.Datasource) {
+	switch {
+	case l.Token != "":
+		if ds.JSONData == nil {
+			ds.JSONData = map[string]interface{}{}
+		}
+		ds.JSONData["httpHeaderName1"] = "Authorization"
+		ds.SecureJSONData = map[string]string{"httpHeaderValue1": "Bearer " + l.Token}
+	case l.User != "":
+		ds.BasicAuth = true
+		ds.BasicAuthUser = l.User
+		ds.SecureJSONData = map[string]string{"basicAuthPassword": l.Password}
+	}
+}
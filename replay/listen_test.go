@@ -0,0 +1,149 @@
+package replay
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/qiffang/prom-tools/grafana"
+)
+
+func TestListenCheck(t *testing.T) {
+	cases := []struct {
+		name string
+		l    Listen
+		err  bool
+	}{
+		{name: "plain", l: Listen{Addr: ":8080"}},
+		{name: "tls", l: Listen{CertFile: "cert", KeyFile: "key"}},
+		{name: "cert without key", l: Listen{CertFile: "cert"}, err: true},
+		{name: "key without cert", l: Listen{KeyFile: "key"}, err: true},
+		{name: "basic auth", l: Listen{User: "u", Password: "p"}},
+		{name: "token", l: Listen{Token: "t"}},
+		{name: "user without password", l: Listen{User: "u"}, err: true},
+		{name: "password without user", l: Listen{Password: "p"}, err: true},
+		{name: "basic auth and token", l: Listen{User: "u", Password: "p", Token: "t"}, err: true},
+	}
+	for _, c := range cases {
+		if err := c.l.Check(); (err != nil) != c.err {
+			t.Errorf("%s: got error %v, want error %v", c.name, err, c.err)
+		}
+	}
+}
+
+func TestListenURL(t *testing.T) {
+	cases := []struct {
+		l    Listen
+		want string
+		err  bool
+	}{
+		{l: Listen{Addr: "0.0.0.0:8080"}, want: "http://127.0.0.1:8080"},
+		{l: Listen{Addr: ":8080"}, want: "http://127.0.0.1:8080"},
+		{l: Listen{Addr: "[::]:8080"}, want: "http://127.0.0.1:8080"},
+		{l: Listen{Addr: "[::1]:8080"}, want: "http://[::1]:8080"},
+		{l: Listen{Addr: "[fe80::1]:9090", CertFile: "cert", KeyFile: "key"}, want: "https://[fe80::1]:9090"},
+		{l: Listen{Addr: "replay.example.com:80"}, want: "http://replay.example.com:80"},
+		{l: Listen{Addr: "10.0.0.1:8080", CertFile: "cert", KeyFile: "key"}, want: "https://10.0.0.1:8080"},
+		{l: Listen{Addr: "8080"}, err: true},
+		{l: Listen{Addr: "::1:8080"}, err: true},
+	}
+	for _, c := range cases {
+		got, err := c.l.URL()
+		if c.err {
+			if err == nil {
+				t.Errorf("%s: got %s, want an error", c.l.Addr, got)
+			}
+			continue
+		}
+		if err != nil || got != c.want {
+			t.Errorf("%s: got %s, %v, want %s", c.l.Addr, got, err, c.want)
+		}
+	}
+}
+
+func TestListenAuthenticate(t *testing.T) {
+	basic := Listen{User: "user", Password: "pwd"}
+	bearer := Listen{Token: "token"}
+	cases := []struct {
+		name          string
+		l             Listen
+		user, pwd     string
+		authorization string
+		ok            bool
+	}{
+		{name: "no auth", l: Listen{}, ok: true},
+		{name: "basic", l: basic, user: "user", pwd: "pwd", ok: true},
+		{name: "basic wrong password", l: basic, user: "user", pwd: "other"},
+		{name: "basic wrong user", l: basic, user: "other", pwd: "pwd"},
+		{name: "basic missing", l: basic},
+		{name: "basic with a token", l: basic, authorization: "Bearer token"},
+		{name: "bearer", l: bearer, authorization: "Bearer token", ok: true},
+		{name: "bearer wrong token", l: bearer, authorization: "Bearer other"},
+		{name: "bearer without scheme", l: bearer, authorization: "token"},
+		{name: "bearer missing", l: bearer},
+		{name: "bearer with basic auth", l: bearer, user: "token", pwd: "token"},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", "/api/v1/query", nil)
+		if c.user != "" {
+			req.SetBasicAuth(c.user, c.pwd)
+		}
+		if c.authorization != "" {
+			req.Header.Set("Authorization", c.authorization)
+		}
+		w := httptest.NewRecorder()
+		if ok := c.l.Authenticate(w, req); ok != c.ok {
+			t.Errorf("%s: got %v, want %v", c.name, ok, c.ok)
+			continue
+		}
+		if c.ok {
+			if w.Code != http.StatusOK || w.Body.Len() != 0 {
+				t.Errorf("%s: accepted request got a response %d %s", c.name, w.Code, w.Body)
+			}
+			continue
+		}
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("%s: got status %d, want %d", c.name, w.Code, http.StatusUnauthorized)
+		}
+		if challenge := w.Header().Get("WWW-Authenticate"); (challenge != "") != (c.l.User != "") {
+			t.Errorf("%s: got WWW-Authenticate %q", c.name, challenge)
+		}
+	}
+}
+
+func TestListenCredentials(t *testing.T) {
+	cases := []struct {
+		name string
+		l    Listen
+		ds   grafana.Datasource
+		want grafana.Datasource
+	}{
+		{name: "no auth", want: grafana.Datasource{}},
+		{
+			name: "basic",
+			l:    Listen{User: "user", Password: "pwd"},
+			want: grafana.Datasource{
+				BasicAuth:      true,
+				BasicAuthUser:  "user",
+				SecureJSONData: map[string]string{"basicAuthPassword": "pwd"},
+			},
+		},
+		{
+			name: "bearer",
+			l:    Listen{Token: "token"},
+			ds:   grafana.Datasource{JSONData: map[string]interface{}{"tlsSkipVerify": true}},
+			want: grafana.Datasource{
+				JSONData:       map[string]interface{}{"tlsSkipVerify": true, "httpHeaderName1": "Authorization"},
+				SecureJSONData: map[string]string{"httpHeaderValue1": "Bearer token"},
+			},
+		},
+	}
+	for _, c := range cases {
+		ds := c.ds
+		c.l.Credentials(&ds)
+		if !reflect.DeepEqual(ds, c.want) {
+			t.Errorf("%s: got %+v, want %+v", c.name, ds, c.want)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package replay
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// varPattern matches the template variable syntaxes of Grafana: $var,
+// ${var}, ${var:format} and [[var]].
+var varPattern = regexp.MustCompile(`\$\{(\w+)(?::\w+)?\}|\[\[(\w+)(?::\w+)?\]\]|\$(\w+)`)
+
+// ExpandVars replaces the template variables in query with their values.
+// Unknown variables, e.g. the $__interval of Grafana, are left alone.
+func ExpandVars(query string, vars map[string]string) string {
+	if len(vars) == 0 {
+		return query
+	}
+	return varPattern.ReplaceAllStringFunc(query, func(v string) string {
+		m := varPattern.FindStringSubmatch(v)
+		for _, name := range m[1:] {
+			if value, ok := vars[name]; ok && name != "" {
+				return value
+			}
+		}
+		return v
+	})
+}
+
+// Normalize returns query with its template variables expanded, without
+// whitespace that does not separate words and with the label matchers of
+// every selector sorted, so that equivalent queries are equal.
+func Normalize(query string, vars map[string]string) string {
+	query = ExpandVars(query, vars)
+
+	var (
+		b strings.Builder
+		// selector is where the matchers of the current selector start in b.
+		selector = -1
+		space    bool
+	)
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case c == '"' || c == '\'' || c == '`':
+			end := stringEnd(query, i)
+			if space && b.Len() > 0 && !isPunct(lastByte(&b)) {
+				b.WriteByte(' ')
+			}
+			space = false
+			b.WriteString(query[i:end])
+			i = end - 1
+			continue
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			space = true
+			continue
+		}
+
+		if space && b.Len() > 0 && !isPunct(c) && !isPunct(lastByte(&b)) {
+			b.WriteByte(' ')
+		}
+		space = false
+
+		switch c {
+		case '{':
+			b.WriteByte(c)
+			selector = b.Len()
+		case '}':
+			if selector >= 0 {
+				matchers := sortMatchers(b.String()[selector:])
+				s := b.String()[:selector] + matchers
+				b.Reset()
+				b.WriteString(s)
+				selector = -1
+			}
+			b.WriteByte(c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	return b.String()
+}
+
+// sortMatchers sorts the comma separated matchers s, which has no whitespace
+// outside of strings.
+func sortMatchers(s string) string {
+	var (
+		matchers []string
+		start    int
+	)
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"', '\'', '`':
+			i = stringEnd(s, i) - 1
+		case ',':
+			matchers = append(matchers, s[start:i])
+			start = i + 1
+		}
+	}
+	matchers = append(matchers, s[start:])
+
+	res := matchers[:0]
+	for _, m := range matchers {
+		if m != "" {
+			res = append(res, m)
+		}
+	}
+	sort.Strings(res)
+	return strings.Join(res, ",")
+}
+
+// stringEnd returns the index after the string literal starting at i.
+func stringEnd(s string, i int) int {
+	quote := s[i]
+	for j := i + 1; j < len(s); j++ {
+		switch s[j] {
+		case '\\':
+			if quote != '`' {
+				j++
+			}
+		case quote:
+			return j + 1
+		}
+	}
+	return len(s)
+}
+
+func isPunct(c byte) bool {
+	return strings.IndexByte("(){}[],=!~+-*/%^<>", c) >= 0
+}
+
+func lastByte(b *strings.Builder) byte {
+	s := b.String()
+	return s[len(s)-1]
+}
+
+// distance returns the Levenshtein distance of a and b.
+func distance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
@@ -0,0 +1,73 @@
+package replay
+
+import "testing"
+
+func TestExpandVars(t *testing.T) {
+	vars := map[string]string{"job": "node", "instance": "db-1"}
+	cases := []struct {
+		in, want string
+	}{
+		{`up{job="$job"}`, `up{job="node"}`},
+		{`up{job="${job}"}`, `up{job="node"}`},
+		{`up{job="${job:regex}"}`, `up{job="node"}`},
+		{`up{job="[[job]]"}`, `up{job="node"}`},
+		{`up{job="$job",instance="$instance"}`, `up{job="node",instance="db-1"}`},
+		{`rate(up[$__interval])`, `rate(up[$__interval])`},
+		{`up{job="$jobs"}`, `up{job="$jobs"}`},
+		{`up`, `up`},
+	}
+	for _, c := range cases {
+		if got := ExpandVars(c.in, vars); got != c.want {
+			t.Errorf("%s: got %s, want %s", c.in, got, c.want)
+		}
+	}
+	if got := ExpandVars(`up{job="$job"}`, nil); got != `up{job="$job"}` {
+		t.Errorf("without vars: got %s", got)
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	vars := map[string]string{"job": "node"}
+	cases := []struct {
+		in, want string
+	}{
+		{`up`, `up`},
+		{` sum ( rate ( up [5m] ) ) by ( job ) `, `sum(rate(up[5m]))by(job)`},
+		{`sum by (job) (up)`, `sum by(job)(up)`},
+		{`up{job="node",instance="a"}`, `up{instance="a",job="node"}`},
+		{`up{ job = "node" , instance =~ "a" , }`, `up{instance=~"a",job="node"}`},
+		{`up{job="$job"}`, `up{job="node"}`},
+		// Whitespace and commas in strings are kept.
+		{`up{b="x, y",a="}"}`, `up{a="}",b="x, y"}`},
+		{`up{b='x\' y',a="z"}`, `up{a="z",b='x\' y'}`},
+		{"up{b=`x\\`,a=\"z\"}", "up{a=\"z\",b=`x\\`}"},
+		{`a{y="1",x="2"} / on(x) b{y="1",x="2"}`, `a{x="2",y="1"}/on(x)b{x="2",y="1"}`},
+		{`up offset 5m`, `up offset 5m`},
+		{`up == bool 1`, `up==bool 1`},
+		{`up{job="node"`, `up{job="node"`},
+	}
+	for _, c := range cases {
+		if got := Normalize(c.in, vars); got != c.want {
+			t.Errorf("%s: got %s, want %s", c.in, got, c.want)
+		}
+	}
+}
+
+func TestDistance(t *testing.T) {
+	cases := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"up", "", 2},
+		{"", "up", 2},
+		{"up", "up", 0},
+		{"up[5m]", "up[1m]", 1},
+		{"kitten", "sitting", 3},
+	}
+	for _, c := range cases {
+		if got := distance(c.a, c.b); got != c.want {
+			t.Errorf("%q %q: got %d, want %d", c.a, c.b, got, c.want)
+		}
+	}
+}
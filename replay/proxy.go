@@ -0,0 +1,107 @@
+package replay
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pingcap/errors"
+	"github.com/prometheus/common/log"
+)
+
+// apiPrefix is the path of the Prometheus HTTP API that Proxy forwards.
+const apiPrefix = "/api/v1/"
+
+// Proxy forwards requests of the Prometheus HTTP API to Upstream and records
+// the successful responses with Recorder.
+type Proxy struct {
+	Upstream *url.URL
+	Recorder *Recorder
+	Client   *http.Client
+	// DropAuth keeps the Authorization header from the upstream, when the
+	// credentials of the proxy are not the ones of the upstream.
+	DropAuth bool
+}
+
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !strings.HasPrefix(req.URL.Path, apiPrefix) {
+		http.NotFound(w, req)
+		return
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_data", err)
+		return
+	}
+
+	u := *p.Upstream
+	u.Path = strings.TrimSuffix(u.Path, "/") + req.URL.Path
+	u.RawQuery = req.URL.RawQuery
+	up, err := http.NewRequest(req.Method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_data", err)
+		return
+	}
+	for _, h := range []string{"Accept", "Authorization", "Content-Type"} {
+		if h == "Authorization" && p.DropAuth {
+			continue
+		}
+		if v := req.Header.Get(h); v != "" {
+			up.Header.Set(h, v)
+		}
+	}
+
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(up)
+	if err != nil {
+		log.Errorf("proxy request %s failed: %v", u.String(), err)
+		writeError(w, http.StatusBadGateway, "unavailable", err)
+		return
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Errorf("read upstream response of %s failed: %v", u.String(), err)
+		writeError(w, http.StatusBadGateway, "unavailable", err)
+		return
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "" {
+		w.Header().Set("Content-Type", ct)
+	}
+	w.WriteHeader(resp.StatusCode)
+	w.Write(respBody)
+
+	if resp.StatusCode != http.StatusOK {
+		return
+	}
+	params := req.URL.Query()
+	if strings.HasPrefix(req.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		if form, err := url.ParseQuery(string(body)); err == nil {
+			for k, vs := range form {
+				params[k] = append(params[k], vs...)
+			}
+		}
+	}
+	endpoint := strings.TrimPrefix(req.URL.Path, apiPrefix)
+	if err := p.Recorder.Record(endpoint, params, respBody); err != nil {
+		log.Errorf("record response of %s failed: %v", req.URL, err)
+	}
+}
+
+// writeError writes an error response of the Prometheus HTTP API.
+func writeError(w http.ResponseWriter, code int, typ string, err error) {
+	b, jerr := json.Marshal(Response{Status: "error", ErrorType: typ, Error: errors.Cause(err).Error()})
+	if jerr != nil {
+		http.Error(w, err.Error(), code)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(b)
+}
@@ -0,0 +1,159 @@
+package replay
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/common/model"
+)
+
+// stubPrometheus answers query, query_range, series and label values requests
+// with fixed data and reports the Authorization headers it got.
+func stubPrometheus(t *testing.T, auth *[]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		*auth = append(*auth, req.Header.Get("Authorization"))
+		if err := req.ParseForm(); err != nil {
+			t.Error(err)
+		}
+
+		var data string
+		switch req.URL.Path {
+		case "/prom/api/v1/query":
+			data = `{"resultType":"vector","result":[{"metric":{"__name__":"up","instance":"a"},"value":[100,"1"]}]}`
+		case "/prom/api/v1/query_range":
+			if req.Form.Get("query") != "up" {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, `{"status":"error","errorType":"bad_data","error":"unknown query"}`)
+				return
+			}
+			data = `{"resultType":"matrix","result":[{"metric":{"__name__":"up","instance":"a"},"values":[[100,"2"],[200,"3"]]}]}`
+		case "/prom/api/v1/series":
+			data = `[{"__name__":"up","instance":"a"}]`
+		case "/prom/api/v1/label/instance/values":
+			data = `["a"]`
+		default:
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"status":"success","data":%s}`, data)
+	}))
+}
+
+func TestProxy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var auth []string
+	prom := stubPrometheus(t, &auth)
+	defer prom.Close()
+	upstream, err := url.Parse(prom.URL + "/prom/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewRecorder(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := httptest.NewServer(&Proxy{Upstream: upstream, Recorder: r, DropAuth: true})
+	defer proxy.Close()
+
+	requests := []struct {
+		method, path, form string
+		code               int
+	}{
+		{method: "GET", path: "/api/v1/query?query=up&time=100", code: http.StatusOK},
+		// Grafana posts range queries as a form.
+		{method: "POST", path: "/api/v1/query_range", form: "query=up&start=100&end=200&step=100", code: http.StatusOK},
+		{method: "GET", path: "/api/v1/series?match%5B%5D=up&start=100&end=200", code: http.StatusOK},
+		{method: "GET", path: "/api/v1/label/instance/values", code: http.StatusOK},
+		// Errors are passed on but not recorded.
+		{method: "POST", path: "/api/v1/query_range", form: "query=down&start=100&end=200&step=100", code: http.StatusBadRequest},
+		{method: "GET", path: "/api/v1/unknown", code: http.StatusNotFound},
+		{method: "GET", path: "/metrics", code: http.StatusNotFound},
+	}
+	for _, c := range requests {
+		req, err := http.NewRequest(c.method, proxy.URL+c.path, strings.NewReader(c.form))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer recorder")
+		if c.form != "" {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != c.code {
+			t.Errorf("%s %s: got status %d, want %d", c.method, c.path, resp.StatusCode, c.code)
+		}
+	}
+	for _, a := range auth {
+		if a != "" {
+			t.Errorf("Authorization %q of the recorder passed upstream", a)
+		}
+	}
+
+	idx, err := readIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]*Entry{}
+	for _, e := range idx.Entries {
+		got[e.Endpoint] = e
+	}
+	if len(idx.Entries) != 3 || got["query_range"] == nil || got["series"] == nil || got["label/instance/values"] == nil {
+		t.Fatalf("got index entries %v, want the merged query, series and label values", got)
+	}
+	if q := got["query_range"]; q.Query != "up" || q.Params.Get("step") != "100" {
+		t.Errorf("got query entry %q with params %v, want up with the ones of the range query", q.Query, q.Params)
+	}
+	if m := got["series"].Params["match[]"]; len(m) != 1 || m[0] != "up" {
+		t.Errorf("got series params %v, want match[] up", got["series"].Params)
+	}
+
+	// The samples of the range query win at the timestamp of the query.
+	data, err := ReadQueryFile(filepath.Join(dir, got["query_range"].File))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, ok := data.Result.(model.Matrix)
+	if !ok || len(m) != 1 {
+		t.Fatalf("got merged result %v, want one series", data.Result)
+	}
+	want := []model.SamplePair{{Timestamp: 100000, Value: 2}, {Timestamp: 200000, Value: 3}}
+	if len(m[0].Values) != len(want) {
+		t.Fatalf("got samples %v, want %v", m[0].Values, want)
+	}
+	for i := range want {
+		if !m[0].Values[i].Equal(&want[i]) {
+			t.Errorf("got samples %v, want %v", m[0].Values, want)
+			break
+		}
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, got["label/instance/values"].File))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp Response
+	if err := json.Unmarshal(b, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if string(resp.Data) != `["a"]` {
+		t.Errorf("got label values %s, want [\"a\"]", resp.Data)
+	}
+}
@@ -0,0 +1,224 @@
+package replay
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pingcap/errors"
+	"github.com/prometheus/common/model"
+)
+
+// responsesDir is the directory of the recorded responses in a replay
+// directory.
+const responsesDir = "responses"
+
+// volatileParams change with every request of the same data and are not part
+// of the key of a recorded response.
+var volatileParams = map[string]bool{"start": true, "end": true, "time": true, "step": true, "timeout": true, "_": true}
+
+// Recorder saves responses into a replay directory and keeps its index up to
+// date, responses are added to the ones recorded before.
+type Recorder struct {
+	dir string
+
+	mtx   sync.Mutex
+	idx   *Index
+	byKey map[string]*Entry
+}
+
+// NewRecorder returns a Recorder for dir, which is created if it does not
+// exist.
+func NewRecorder(dir string) (*Recorder, error) {
+	if err := os.MkdirAll(filepath.Join(dir, responsesDir), 0777); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	r := &Recorder{
+		dir:   dir,
+		idx:   &Index{},
+		byKey: map[string]*Entry{},
+	}
+	if _, err := os.Stat(filepath.Join(dir, IndexName)); err == nil {
+		if r.idx, err = readIndex(dir); err != nil {
+			return nil, err
+		}
+	}
+	for _, e := range r.idx.Entries {
+		r.byKey[recordKey(e.Endpoint, e.Query, e.Params)] = e
+	}
+
+	return r, nil
+}
+
+// recordKey identifies the responses that hold the same data. Query and range
+// query responses of the same query are merged.
+func recordKey(endpoint, query string, params url.Values) string {
+	if (&Entry{Endpoint: endpoint}).IsQuery() {
+		return "query " + Normalize(query, nil)
+	}
+
+	names := make([]string, 0, len(params))
+	for name := range params {
+		if !volatileParams[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString(endpoint)
+	for _, name := range names {
+		values := append([]string(nil), params[name]...)
+		sort.Strings(values)
+		fmt.Fprintf(&b, " %s=%q", name, values)
+	}
+	return b.String()
+}
+
+// Record saves the response body of a request to endpoint, the path below
+// /api/v1/, with the request parameters. Only successful responses are saved.
+// The samples of a query are merged into the ones recorded for it before.
+// The index is rewritten with every response, so that the directory can be
+// replayed whenever recording stops. That is cheap for the requests of people
+// looking at dashboards, not for recording a large number of them.
+func (r *Recorder) Record(endpoint string, params url.Values, body []byte) error {
+	var resp Response
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return errors.Wrap(err, "decode response")
+	}
+	if resp.Status != "success" {
+		return nil
+	}
+
+	query := params.Get("query")
+	key := recordKey(endpoint, query, params)
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	e, ok := r.byKey[key]
+	if !ok {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		e = &Entry{
+			Endpoint: endpoint,
+			Query:    query,
+			File:     filepath.Join(responsesDir, fmt.Sprintf("%016x.json", h.Sum64())),
+		}
+	}
+	// The entry describes the last request.
+	e.Endpoint, e.Params = endpoint, params
+
+	if ok && e.IsQuery() {
+		merged, err := r.merge(e, resp.Data)
+		if err != nil {
+			return err
+		}
+		if body, err = json.Marshal(Response{Status: "success", Data: merged}); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	if err := writeFile(filepath.Join(r.dir, e.File), body); err != nil {
+		return err
+	}
+	if !ok {
+		r.byKey[key] = e
+		r.idx.Entries = append(r.idx.Entries, e)
+	}
+
+	b, err := json.MarshalIndent(r.idx, "", "  ")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return writeFile(filepath.Join(r.dir, IndexName), b)
+}
+
+// merge returns the samples of the response of e merged with the ones of
+// data.
+func (r *Recorder) merge(e *Entry, data []byte) ([]byte, error) {
+	prev, err := ReadQueryFile(filepath.Join(r.dir, e.File))
+	if err != nil {
+		return nil, err
+	}
+	var cur QueryData
+	if err := json.Unmarshal(data, &cur); err != nil {
+		return nil, errors.Wrap(err, "decode query data")
+	}
+
+	v := Merge(prev.Result, cur.Result)
+	b, err := json.Marshal(QueryData{ResultType: v.Type(), Result: v})
+	return b, errors.Trace(err)
+}
+
+// Merge merges the samples of the matrices or vectors a and b into a matrix,
+// the samples of b win at the same timestamp. If either is a scalar or a
+// string b is returned.
+func Merge(a, b model.Value) model.Value {
+	if !isSeries(a) || !isSeries(b) {
+		return b
+	}
+
+	series := map[model.Fingerprint]map[model.Time]model.SampleValue{}
+	metrics := map[model.Fingerprint]model.Metric{}
+	add := func(m model.Metric, t model.Time, v model.SampleValue) {
+		fp := m.Fingerprint()
+		if _, ok := series[fp]; !ok {
+			series[fp] = map[model.Time]model.SampleValue{}
+			metrics[fp] = m
+		}
+		series[fp][t] = v
+	}
+	for _, v := range []model.Value{a, b} {
+		switch v := v.(type) {
+		case model.Matrix:
+			for _, ss := range v {
+				for _, p := range ss.Values {
+					add(ss.Metric, p.Timestamp, p.Value)
+				}
+			}
+		case model.Vector:
+			for _, s := range v {
+				add(s.Metric, s.Timestamp, s.Value)
+			}
+		}
+	}
+
+	res := make(model.Matrix, 0, len(series))
+	for fp, samples := range series {
+		ss := &model.SampleStream{Metric: metrics[fp]}
+		for t, v := range samples {
+			ss.Values = append(ss.Values, model.SamplePair{Timestamp: t, Value: v})
+		}
+		sort.Slice(ss.Values, func(i, j int) bool { return ss.Values[i].Timestamp < ss.Values[j].Timestamp })
+		res = append(res, ss)
+	}
+	sort.Sort(res)
+
+	return res
+}
+
+func isSeries(v model.Value) bool {
+	switch v.(type) {
+	case model.Matrix, model.Vector:
+		return true
+	}
+	return false
+}
+
+// writeFile replaces the file path atomically.
+func writeFile(path string, b []byte) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0666); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(os.Rename(tmp, path))
+}
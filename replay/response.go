@@ -0,0 +1,84 @@
+// Package replay serves captured Prometheus HTTP API responses, so that
+// dashboards can be looked at without the Prometheus they were captured from.
+package replay
+
+import (
+	"encoding/json"
+	"io/ioutil"
+
+	"github.com/pingcap/errors"
+	"github.com/prometheus/common/model"
+)
+
+// Response is the envelope of every Prometheus HTTP API response.
+type Response struct {
+	Status    string          `json:"status"`
+	Data      json.RawMessage `json:"data,omitempty"`
+	ErrorType string          `json:"errorType,omitempty"`
+	Error     string          `json:"error,omitempty"`
+}
+
+// QueryData is the data of a query or query_range response.
+type QueryData struct {
+	ResultType model.ValueType `json:"resultType"`
+	Result     model.Value     `json:"result"`
+}
+
+// UnmarshalJSON decodes the result into the type given by the result type.
+func (d *QueryData) UnmarshalJSON(b []byte) error {
+	var raw struct {
+		ResultType model.ValueType `json:"resultType"`
+		Result     json.RawMessage `json:"result"`
+	}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return errors.Trace(err)
+	}
+
+	var err error
+	switch raw.ResultType {
+	case model.ValMatrix:
+		var m model.Matrix
+		err = json.Unmarshal(raw.Result, &m)
+		d.Result = m
+	case model.ValVector:
+		var v model.Vector
+		err = json.Unmarshal(raw.Result, &v)
+		d.Result = v
+	case model.ValScalar:
+		s := &model.Scalar{}
+		err = json.Unmarshal(raw.Result, s)
+		d.Result = s
+	case model.ValString:
+		s := &model.String{}
+		err = json.Unmarshal(raw.Result, s)
+		d.Result = s
+	default:
+		return errors.Errorf("unknown result type %q", raw.ResultType)
+	}
+	d.ResultType = raw.ResultType
+
+	return errors.Trace(err)
+}
+
+// ReadQueryFile reads a saved query or query_range response.
+func ReadQueryFile(path string) (*QueryData, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var r Response
+	if err := json.Unmarshal(b, &r); err != nil {
+		return nil, errors.Wrapf(err, "decode %s", path)
+	}
+	if r.Status != "success" {
+		return nil, errors.Errorf("%s: response has status %q: %s", path, r.Status, r.Error)
+	}
+
+	var d QueryData
+	if err := json.Unmarshal(r.Data, &d); err != nil {
+		return nil, errors.Wrapf(err, "decode data of %s", path)
+	}
+
+	return &d, nil
+}
@@ -0,0 +1,183 @@
+package replay
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/tsdb/labels"
+	"github.com/qiffang/prom-tools/selector"
+)
+
+// Metadata describes a metric as the metadata endpoint does.
+type Metadata struct {
+	Type string `json:"type"`
+	Help string `json:"help"`
+	Unit string `json:"unit"`
+}
+
+// SeriesSet holds the series of the loaded responses, it answers the series,
+// labels, label values and metadata endpoints.
+type SeriesSet struct {
+	series map[model.Fingerprint]model.Metric
+}
+
+// NewSeriesSet returns an empty SeriesSet.
+func NewSeriesSet() *SeriesSet {
+	return &SeriesSet{series: map[model.Fingerprint]model.Metric{}}
+}
+
+// Add adds the series of a query result.
+func (s *SeriesSet) Add(v model.Value) {
+	switch v := v.(type) {
+	case model.Matrix:
+		for _, ss := range v {
+			s.AddMetric(ss.Metric)
+		}
+	case model.Vector:
+		for _, sample := range v {
+			s.AddMetric(sample.Metric)
+		}
+	}
+}
+
+// AddMetric adds a series.
+func (s *SeriesSet) AddMetric(m model.Metric) {
+	if len(m) == 0 {
+		return
+	}
+	s.series[m.Fingerprint()] = m
+}
+
+// Select returns the series that match any of the selectors, all series if
+// there are none, ordered by their labels.
+func (s *SeriesSet) Select(selectors ...string) ([]model.Metric, error) {
+	sets := make([][]labels.Matcher, 0, len(selectors))
+	for _, sel := range selectors {
+		ms, err := selector.Parse(sel)
+		if err != nil {
+			return nil, err
+		}
+		sets = append(sets, ms)
+	}
+
+	var res []model.Metric
+	for _, m := range s.series {
+		if len(sets) == 0 {
+			res = append(res, m)
+			continue
+		}
+		lset := toLabels(m)
+		for _, ms := range sets {
+			if selector.Matches(ms, lset) {
+				res = append(res, m)
+				break
+			}
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Before(res[j]) })
+
+	return res, nil
+}
+
+// LabelNames returns the sorted label names of the selected series.
+func (s *SeriesSet) LabelNames(selectors ...string) ([]string, error) {
+	series, err := s.Select(selectors...)
+	if err != nil {
+		return nil, err
+	}
+
+	set := map[string]struct{}{}
+	for _, m := range series {
+		for name := range m {
+			set[string(name)] = struct{}{}
+		}
+	}
+	return sortedKeys(set), nil
+}
+
+// LabelValues returns the sorted values of the label name of the selected
+// series.
+func (s *SeriesSet) LabelValues(name string, selectors ...string) ([]string, error) {
+	series, err := s.Select(selectors...)
+	if err != nil {
+		return nil, err
+	}
+
+	set := map[string]struct{}{}
+	for _, m := range series {
+		if v, ok := m[model.LabelName(name)]; ok {
+			set[string(v)] = struct{}{}
+		}
+	}
+	return sortedKeys(set), nil
+}
+
+// Metadata returns the metadata of the metrics, or of the given one. Responses
+// carry no metadata, the type is guessed from the metric name as the
+// Prometheus naming conventions describe it and help is empty.
+func (s *SeriesSet) Metadata(metric string) map[string][]Metadata {
+	names := map[string]struct{}{}
+	for _, m := range s.series {
+		if name, ok := m[model.MetricNameLabel]; ok {
+			names[string(name)] = struct{}{}
+		}
+	}
+
+	res := map[string][]Metadata{}
+	for name := range names {
+		family, typ := metricType(name, names)
+		if metric != "" && family != metric {
+			continue
+		}
+		res[family] = []Metadata{{Type: typ}}
+	}
+	return res
+}
+
+// metricType returns the metric family of the series name and its type.
+func metricType(name string, names map[string]struct{}) (string, string) {
+	has := func(n string) bool {
+		_, ok := names[n]
+		return ok
+	}
+
+	for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+		if !strings.HasSuffix(name, suffix) {
+			continue
+		}
+		family := strings.TrimSuffix(name, suffix)
+		if has(family + "_bucket") {
+			return family, "histogram"
+		}
+		if has(family+"_sum") && has(family+"_count") {
+			return family, "summary"
+		}
+	}
+	switch {
+	case strings.HasSuffix(name, "_total"):
+		return name, "counter"
+	case has(name+"_sum") && has(name+"_count"):
+		// The quantiles of a summary.
+		return name, "summary"
+	}
+	return name, "unknown"
+}
+
+func toLabels(m model.Metric) labels.Labels {
+	lset := make(labels.Labels, 0, len(m))
+	for name, value := range m {
+		lset = append(lset, labels.Label{Name: string(name), Value: string(value)})
+	}
+	sort.Sort(lset)
+	return lset
+}
+
+func sortedKeys(set map[string]struct{}) []string {
+	res := make([]string, 0, len(set))
+	for k := range set {
+		res = append(res, k)
+	}
+	sort.Strings(res)
+	return res
+}
@@ -0,0 +1,458 @@
+package replay
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+)
+
+var (
+	labelValuesPattern = regexp.MustCompile(`^label_values\((?:(.*),\s*)?(\w+)\)$`)
+	metricsPattern     = regexp.MustCompile(`^metrics\((.*)\)$`)
+	queryResultPattern = regexp.MustCompile(`^query_result\((.*)\)$`)
+)
+
+// Snapshotter runs the queries of dashboards against a Prometheus and records
+// the responses, so that the dashboards can be replayed.
+type Snapshotter struct {
+	Prometheus *url.URL
+	Client     *http.Client
+	Recorder   *Recorder
+	Start, End time.Time
+	// Step is the resolution of the range queries.
+	Step time.Duration
+}
+
+// SnapshotStats counts the queries of a dashboard.
+type SnapshotStats struct {
+	Queries int
+	Failed  int
+}
+
+// Dashboard records the responses of all panel queries of the dashboard JSON
+// raw, for every value of its first template variable and for the current
+// values of the variables. The dashboard is saved as name.
+func (s *Snapshotter) Dashboard(name string, raw []byte) (SnapshotStats, error) {
+	var stats SnapshotStats
+
+	board, err := decodeDashboard(raw)
+	if err != nil {
+		return stats, err
+	}
+	dir := filepath.Join(s.Recorder.dir, DashboardsDir)
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return stats, errors.Trace(err)
+	}
+	if err := writeFile(filepath.Join(dir, name+".json"), raw); err != nil {
+		return stats, err
+	}
+
+	var exprs []string
+	walkTargets(board, func(target map[string]interface{}) {
+		if expr, ok := target["expr"].(string); ok && expr != "" {
+			exprs = append(exprs, expr)
+		}
+	})
+
+	queried := map[string]bool{}
+	for _, vars := range s.variableSets(templateVars(board)) {
+		for _, expr := range exprs {
+			query := ExpandVars(expr, vars)
+			if queried[query] {
+				continue
+			}
+			queried[query] = true
+
+			stats.Queries++
+			params := url.Values{
+				"query": {query},
+				"start": {formatTime(s.Start)},
+				"end":   {formatTime(s.End)},
+				"step":  {strconv.FormatFloat(s.Step.Seconds(), 'f', -1, 64)},
+			}
+			if _, err := s.get("query_range", params); err != nil {
+				log.Warnf("query %q of dashboard %s failed: %v", query, name, err)
+				stats.Failed++
+			}
+		}
+	}
+
+	return stats, nil
+}
+
+// walkTargets calls fn for every query target of the panels in v.
+func walkTargets(v interface{}, fn func(map[string]interface{})) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if targets, ok := v["targets"].([]interface{}); ok {
+			for _, t := range targets {
+				if t, ok := t.(map[string]interface{}); ok {
+					fn(t)
+				}
+			}
+		}
+		for k, e := range v {
+			if k != "templating" {
+				walkTargets(e, fn)
+			}
+		}
+	case []interface{}:
+		for _, e := range v {
+			walkTargets(e, fn)
+		}
+	}
+}
+
+// templateVar is a template variable of a dashboard.
+type templateVar struct {
+	Name       string      `json:"name"`
+	Type       string      `json:"type"`
+	Query      interface{} `json:"query"`
+	Regex      string      `json:"regex"`
+	Multi      bool        `json:"multi"`
+	IncludeAll bool        `json:"includeAll"`
+	AllValue   string      `json:"allValue"`
+	Current    struct {
+		Value interface{} `json:"value"`
+	} `json:"current"`
+}
+
+func (v *templateVar) query() string {
+	switch q := v.Query.(type) {
+	case string:
+		return q
+	case map[string]interface{}:
+		// Newer Grafana releases wrap the query.
+		if s, ok := q["query"].(string); ok {
+			return s
+		}
+	}
+	return ""
+}
+
+// current returns the selected values of v.
+func (v *templateVar) current() []string {
+	switch c := v.Current.Value.(type) {
+	case string:
+		return []string{c}
+	case []interface{}:
+		var res []string
+		for _, e := range c {
+			if s, ok := e.(string); ok {
+				res = append(res, s)
+			}
+		}
+		return res
+	}
+	return nil
+}
+
+func templateVars(board map[string]interface{}) []*templateVar {
+	templating, _ := board["templating"].(map[string]interface{})
+	b, err := json.Marshal(templating["list"])
+	if err != nil {
+		return nil
+	}
+	var vars []*templateVar
+	if err := json.Unmarshal(b, &vars); err != nil {
+		log.Warnf("template variables cannot be read: %v", err)
+		return nil
+	}
+
+	// Variables whose queries use fewer variables are resolved first.
+	sort.SliceStable(vars, func(i, j int) bool {
+		return strings.Count(vars[i].query(), "$") < strings.Count(vars[j].query(), "$")
+	})
+	return vars
+}
+
+// variableSets returns the values of the variables to query the dashboard
+// with: the current values and every value of the first variable.
+func (s *Snapshotter) variableSets(vars []*templateVar) []map[string]string {
+	sets := []map[string]string{s.resolve(vars, nil)}
+	if len(vars) == 0 {
+		return sets
+	}
+
+	first := vars[0]
+	values, err := s.values(first, s.builtins())
+	if err != nil {
+		log.Warnf("values of variable %s cannot be queried: %v", first.Name, err)
+		return sets
+	}
+	for _, v := range values {
+		sets = append(sets, s.resolve(vars, map[string][]string{first.Name: {v}}))
+	}
+	return sets
+}
+
+// resolve returns the value of every variable, the fixed ones or the current
+// values if they are among the possible ones, all values otherwise.
+func (s *Snapshotter) resolve(vars []*templateVar, fixed map[string][]string) map[string]string {
+	res := s.builtins()
+	for _, v := range vars {
+		selected, ok := fixed[v.Name]
+		all := false
+		if !ok {
+			values, err := s.values(v, res)
+			if err != nil {
+				log.Warnf("values of variable %s cannot be queried: %v", v.Name, err)
+			}
+			selected, all = pick(v, values)
+		}
+		res[v.Name] = format(v, selected, all)
+	}
+	return res
+}
+
+// pick selects the current values of v if possible, all is set if that is
+// the All option.
+func pick(v *templateVar, values []string) (selected []string, all bool) {
+	current := v.current()
+	if len(current) == 1 && current[0] == "$__all" {
+		return values, true
+	}
+	var res []string
+	for _, c := range current {
+		for _, value := range values {
+			if c == value {
+				res = append(res, c)
+				break
+			}
+		}
+	}
+	switch {
+	case len(res) > 0:
+		return res, false
+	case len(values) == 0:
+		return current, false
+	case v.IncludeAll:
+		return values, true
+	}
+	return values[:1], false
+}
+
+var (
+	// regularEscaper and specialRegexEscaper escape variable values as the
+	// Prometheus datasource of Grafana does, for string literals and for
+	// regular expressions in string literals.
+	regularEscaper      = strings.NewReplacer(`\`, `\\`, `'`, `\\'`)
+	specialRegexEscaper = strings.NewReplacer(
+		`\`, `\\\\`,
+		`$`, `\\$`, `^`, `\\^`, `*`, `\\*`, `{`, `\\{`, `}`, `\\}`, `[`, `\\[`, `]`, `\\]`,
+		`'`, `\\'`, `+`, `\\+`, `?`, `\\?`, `.`, `\\.`, `(`, `\\(`, `)`, `\\)`, `|`, `\\|`,
+	)
+)
+
+// format formats the selected values of v as Grafana does for Prometheus
+// queries. The all value of v replaces them if all is set.
+func format(v *templateVar, values []string, all bool) string {
+	if all && v.AllValue != "" {
+		return v.AllValue
+	}
+	if !v.Multi && !v.IncludeAll {
+		if len(values) == 0 {
+			return ""
+		}
+		return regularEscaper.Replace(values[0])
+	}
+	quoted := make([]string, 0, len(values))
+	for _, value := range values {
+		quoted = append(quoted, specialRegexEscaper.Replace(value))
+	}
+	if len(quoted) == 1 {
+		return quoted[0]
+	}
+	return "(" + strings.Join(quoted, "|") + ")"
+}
+
+// builtins returns the global variables of Grafana for the time range.
+func (s *Snapshotter) builtins() map[string]string {
+	r := s.End.Sub(s.Start)
+	return map[string]string{
+		"__interval":      model.Duration(s.Step).String(),
+		"__interval_ms":   strconv.FormatInt(int64(s.Step/time.Millisecond), 10),
+		"__rate_interval": model.Duration(4 * s.Step).String(),
+		"__range":         model.Duration(r).String(),
+		"__range_s":       strconv.FormatInt(int64(r/time.Second), 10),
+		"__range_ms":      strconv.FormatInt(int64(r/time.Millisecond), 10),
+	}
+}
+
+// values returns the possible values of v with the variables it uses set to
+// vars. The responses of the queries are recorded.
+func (s *Snapshotter) values(v *templateVar, vars map[string]string) ([]string, error) {
+	query := strings.TrimSpace(ExpandVars(v.query(), vars))
+
+	var values []string
+	switch v.Type {
+	case "custom":
+		for _, value := range strings.Split(query, ",") {
+			values = append(values, strings.TrimSpace(value))
+		}
+	case "constant", "textbox":
+		values = []string{query}
+	case "interval":
+		values = v.current()
+	case "query":
+		var err error
+		if values, err = s.queryValues(query); err != nil {
+			return nil, err
+		}
+	default:
+		return v.current(), nil
+	}
+
+	if v.Regex == "" {
+		return values, nil
+	}
+	re, err := regexp.Compile(strings.Trim(v.Regex, "/"))
+	if err != nil {
+		return nil, errors.Wrapf(err, "regex of variable %s", v.Name)
+	}
+	var res []string
+	seen := map[string]bool{}
+	for _, value := range values {
+		m := re.FindStringSubmatch(value)
+		if m == nil {
+			continue
+		}
+		if len(m) > 1 {
+			value = m[1]
+		}
+		if !seen[value] {
+			seen[value] = true
+			res = append(res, value)
+		}
+	}
+	return res, nil
+}
+
+// queryValues runs a variable query of the Prometheus datasource.
+func (s *Snapshotter) queryValues(query string) ([]string, error) {
+	timeParams := url.Values{
+		"start": {formatTime(s.Start)},
+		"end":   {formatTime(s.End)},
+	}
+
+	if m := labelValuesPattern.FindStringSubmatch(query); m != nil {
+		if m[1] == "" {
+			var values []string
+			err := s.getData("label/"+m[2]+"/values", timeParams, &values)
+			return values, err
+		}
+		params := timeParams
+		params.Set("match[]", m[1])
+		var series []model.Metric
+		if err := s.getData("series", params, &series); err != nil {
+			return nil, err
+		}
+		set := map[string]struct{}{}
+		for _, m2 := range series {
+			if v, ok := m2[model.LabelName(m[2])]; ok {
+				set[string(v)] = struct{}{}
+			}
+		}
+		return sortedKeys(set), nil
+	}
+
+	if m := metricsPattern.FindStringSubmatch(query); m != nil {
+		var names []string
+		if err := s.getData("label/__name__/values", timeParams, &names); err != nil {
+			return nil, err
+		}
+		re, err := regexp.Compile(m[1])
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		var res []string
+		for _, n := range names {
+			if re.MatchString(n) {
+				res = append(res, n)
+			}
+		}
+		return res, nil
+	}
+
+	if m := queryResultPattern.FindStringSubmatch(query); m != nil {
+		b, err := s.get("query", url.Values{"query": {m[1]}, "time": {formatTime(s.End)}})
+		if err != nil {
+			return nil, err
+		}
+		d, err := decodeQueryData(b)
+		if err != nil {
+			return nil, err
+		}
+		var res []string
+		if vec, ok := d.Result.(model.Vector); ok {
+			for _, sample := range vec {
+				res = append(res, fmt.Sprintf("%s %s %d", sample.Metric, sample.Value, sample.Timestamp.Unix()*1000))
+			}
+		}
+		return res, nil
+	}
+
+	return nil, errors.Errorf("unsupported variable query %q", query)
+}
+
+func decodeQueryData(b []byte) (*QueryData, error) {
+	var r Response
+	if err := json.Unmarshal(b, &r); err != nil {
+		return nil, errors.Trace(err)
+	}
+	var d QueryData
+	return &d, errors.Trace(json.Unmarshal(r.Data, &d))
+}
+
+// getData requests endpoint and decodes the data of the response into v.
+func (s *Snapshotter) getData(endpoint string, params url.Values, v interface{}) error {
+	b, err := s.get(endpoint, params)
+	if err != nil {
+		return err
+	}
+	var r Response
+	if err := json.Unmarshal(b, &r); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(json.Unmarshal(r.Data, v))
+}
+
+// get requests endpoint of the Prometheus API and records the response.
+func (s *Snapshotter) get(endpoint string, params url.Values) ([]byte, error) {
+	u := *s.Prometheus
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/api/v1/" + endpoint
+	u.RawQuery = params.Encode()
+
+	resp, err := s.Client.Get(u.String())
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("%s: %s", resp.Status, b)
+	}
+
+	return b, s.Recorder.Record(endpoint, params, b)
+}
+
+// formatTime formats t as Unix seconds for the HTTP API.
+func formatTime(t time.Time) string {
+	return strconv.FormatFloat(float64(t.UnixNano())/1e9, 'f', -1, 64)
+}
@@ -0,0 +1,293 @@
+package replay
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// variablesPrometheus answers the requests of variable queries and logs the
+// range queries it gets.
+type variablesPrometheus struct {
+	mtx     sync.Mutex
+	queries []string
+}
+
+func (p *variablesPrometheus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var data string
+	switch r.URL.Path {
+	case "/api/v1/label/job/values":
+		data = `["node","prom"]`
+	case "/api/v1/label/__name__/values":
+		data = `["node_load1","node_load5","up"]`
+	case "/api/v1/series":
+		if r.URL.Query().Get("match[]") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		data = `[{"__name__":"up","instance":"10.0.0.1:9100"},{"__name__":"up","instance":"10.0.0.2:9100"},{"__name__":"up"}]`
+	case "/api/v1/query":
+		data = `{"resultType":"vector","result":[{"metric":{"__name__":"up","job":"node"},"value":[100,"1"]}]}`
+	case "/api/v1/query_range":
+		p.mtx.Lock()
+		p.queries = append(p.queries, r.URL.Query().Get("query"))
+		p.mtx.Unlock()
+		if strings.Contains(r.URL.Query().Get("query"), "fail") {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"status":"error","errorType":"bad_data","error":"failed"}`)
+			return
+		}
+		data = `{"resultType":"matrix","result":[]}`
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	fmt.Fprintf(w, `{"status":"success","data":%s}`, data)
+}
+
+// testSnapshotter returns a Snapshotter of the Prometheus p that records into
+// a temporary directory, which is removed by the returned function.
+func testSnapshotter(t *testing.T, p http.Handler) (*Snapshotter, func()) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(p)
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewRecorder(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Snapshotter{
+		Prometheus: u,
+		Client:     srv.Client(),
+		Recorder:   r,
+		Start:      time.Unix(0, 0),
+		End:        time.Unix(3600, 0),
+		Step:       time.Minute,
+	}
+	return s, func() {
+		srv.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestQueryValues(t *testing.T) {
+	s, done := testSnapshotter(t, &variablesPrometheus{})
+	defer done()
+
+	cases := []struct {
+		query string
+		want  []string
+		err   bool
+	}{
+		{query: "label_values(job)", want: []string{"node", "prom"}},
+		{query: `label_values(up{job="node"}, instance)`, want: []string{"10.0.0.1:9100", "10.0.0.2:9100"}},
+		{query: "metrics(node_.*)", want: []string{"node_load1", "node_load5"}},
+		{query: "query_result(up)", want: []string{`up{job="node"} 1 100000`}},
+		{query: "label_names()", err: true},
+	}
+	for _, c := range cases {
+		got, err := s.queryValues(c.query)
+		if c.err {
+			if err == nil {
+				t.Errorf("%s: no error", c.query)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.query, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %q, want %q", c.query, got, c.want)
+		}
+	}
+}
+
+func TestPick(t *testing.T) {
+	values := []string{"a", "b", "c"}
+	cases := []struct {
+		name    string
+		v       templateVar
+		values  []string
+		want    []string
+		wantAll bool
+	}{
+		{name: "all", v: withCurrent(templateVar{IncludeAll: true}, "$__all"), values: values, want: values, wantAll: true},
+		{name: "current", v: withCurrent(templateVar{}, "b"), values: values, want: []string{"b"}},
+		{name: "some current", v: withCurrent(templateVar{Multi: true}, "a", "x", "c"), values: values, want: []string{"a", "c"}},
+		{name: "gone with all", v: withCurrent(templateVar{IncludeAll: true}, "x"), values: values, want: values, wantAll: true},
+		{name: "gone", v: withCurrent(templateVar{}, "x"), values: values, want: []string{"a"}},
+		{name: "no values", v: withCurrent(templateVar{}, "x"), want: []string{"x"}},
+	}
+	for _, c := range cases {
+		got, all := pick(&c.v, c.values)
+		if !reflect.DeepEqual(got, c.want) || all != c.wantAll {
+			t.Errorf("%s: got %q %v, want %q %v", c.name, got, all, c.want, c.wantAll)
+		}
+	}
+}
+
+func withCurrent(v templateVar, values ...string) templateVar {
+	if len(values) == 1 {
+		v.Current.Value = values[0]
+		return v
+	}
+	current := make([]interface{}, 0, len(values))
+	for _, value := range values {
+		current = append(current, value)
+	}
+	v.Current.Value = current
+	return v
+}
+
+func TestFormat(t *testing.T) {
+	cases := []struct {
+		name   string
+		v      templateVar
+		values []string
+		all    bool
+		want   string
+	}{
+		{name: "single", values: []string{`a'b\c.d`}, want: `a\\'b\\c.d`},
+		{name: "single without values", want: ""},
+		{name: "multi", v: templateVar{Multi: true}, values: []string{"10.0.0.1", "b"}, want: `(10\\.0\\.0\\.1|b)`},
+		{name: "multi one value", v: templateVar{Multi: true}, values: []string{"a.b"}, want: `a\\.b`},
+		{name: "special", v: templateVar{Multi: true}, values: []string{`$^*{}[]'+?.()|\`}, want: `\\$\\^\\*\\{\\}\\[\\]\\'\\+\\?\\.\\(\\)\\|\\\\`},
+		{name: "all", v: templateVar{IncludeAll: true, AllValue: ".*"}, values: []string{"a", "b"}, all: true, want: ".*"},
+		{name: "all without all value", v: templateVar{IncludeAll: true}, values: []string{"a", "b"}, all: true, want: "(a|b)"},
+		// The all value is only used for All, not for several selected values.
+		{name: "selected with all value", v: templateVar{IncludeAll: true, Multi: true, AllValue: ".*"}, values: []string{"a", "b"}, want: "(a|b)"},
+		{name: "one selected with all value", v: templateVar{IncludeAll: true, AllValue: ".*"}, values: []string{"a"}, want: "a"},
+	}
+	for _, c := range cases {
+		if got := format(&c.v, c.values, c.all); got != c.want {
+			t.Errorf("%s: got %s, want %s", c.name, got, c.want)
+		}
+	}
+}
+
+// testVars are a job and the instances of it, without the port.
+func testVars(instance ...string) []*templateVar {
+	job := withCurrent(templateVar{Name: "job", Type: "query", Query: "label_values(job)"}, "prom")
+	inst := withCurrent(templateVar{
+		Name:       "instance",
+		Type:       "query",
+		Query:      map[string]interface{}{"query": `label_values(up{job="$job"}, instance)`},
+		Regex:      "/(.*):9100/",
+		Multi:      true,
+		IncludeAll: true,
+		AllValue:   ".*",
+	}, instance...)
+	return []*templateVar{&job, &inst}
+}
+
+func TestResolve(t *testing.T) {
+	s, done := testSnapshotter(t, &variablesPrometheus{})
+	defer done()
+
+	cases := []struct {
+		instance []string
+		want     string
+	}{
+		{instance: []string{"$__all"}, want: ".*"},
+		{instance: []string{"10.0.0.1"}, want: `10\\.0\\.0\\.1`},
+		{instance: []string{"10.0.0.1", "10.0.0.2"}, want: `(10\\.0\\.0\\.1|10\\.0\\.0\\.2)`},
+		{instance: []string{"10.0.0.9"}, want: ".*"},
+	}
+	for _, c := range cases {
+		got := s.resolve(testVars(c.instance...), nil)
+		if got["job"] != "prom" || got["instance"] != c.want || got["__interval"] != "1m" {
+			t.Errorf("%v: got job %s, instance %s and interval %s, want prom, %s and 1m",
+				c.instance, got["job"], got["instance"], got["__interval"], c.want)
+		}
+	}
+
+	got := s.resolve(testVars("$__all"), map[string][]string{"job": {"node"}})
+	if got["job"] != "node" {
+		t.Errorf("got job %s, want the fixed node", got["job"])
+	}
+}
+
+func TestVariableSets(t *testing.T) {
+	s, done := testSnapshotter(t, &variablesPrometheus{})
+	defer done()
+
+	var got []string
+	for _, set := range s.variableSets(testVars("10.0.0.2")) {
+		got = append(got, set["job"]+" "+set["instance"])
+	}
+	// The current values first, then every job with the current instance.
+	want := []string{`prom 10\\.0\\.0\\.2`, `node 10\\.0\\.0\\.2`, `prom 10\\.0\\.0\\.2`}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	if sets := s.variableSets(nil); len(sets) != 1 || sets[0]["__range"] != "1h" {
+		t.Errorf("got %v without variables, want the builtins", sets)
+	}
+}
+
+func TestSnapshotDashboard(t *testing.T) {
+	p := &variablesPrometheus{}
+	s, done := testSnapshotter(t, p)
+	defer done()
+
+	const board = `{
+  "title": "Node",
+  "panels": [
+    {"targets": [{"expr": "rate(up{job=\"$job\",instance=~\"$instance\"}[$__interval])"}]},
+    {"type": "row", "panels": [{"targets": [{"expr": "fail{job=\"$job\"}"}, {"refId": "B"}]}]}
+  ],
+  "templating": {"list": [
+    {"name": "instance", "type": "query", "query": "label_values(up{job=\"$job\"}, instance)", "regex": "/(.*):9100/",
+     "multi": true, "includeAll": true, "allValue": ".*", "current": {"value": "$__all"}},
+    {"name": "job", "type": "query", "query": "label_values(job)", "current": {"value": "prom"}}
+  ]}
+}`
+	stats, err := s.Dashboard("node", []byte(board))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Queries != 4 || stats.Failed != 2 {
+		t.Errorf("got %d queries and %d failed, want 4 and 2", stats.Queries, stats.Failed)
+	}
+
+	sort.Strings(p.queries)
+	want := []string{
+		`fail{job="node"}`,
+		`fail{job="prom"}`,
+		`rate(up{job="node",instance=~".*"}[1m])`,
+		`rate(up{job="prom",instance=~".*"}[1m])`,
+	}
+	if !reflect.DeepEqual(p.queries, want) {
+		t.Errorf("got queries %q, want %q", p.queries, want)
+	}
+
+	if _, err := os.Stat(filepath.Join(s.Recorder.dir, DashboardsDir, "node.json")); err != nil {
+		t.Errorf("dashboard not saved: %v", err)
+	}
+	store, err := OpenStore(s.Recorder.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range want[2:] {
+		if store.Lookup(q) == nil {
+			t.Errorf("response of %s not recorded", q)
+		}
+	}
+}
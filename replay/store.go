@@ -0,0 +1,182 @@
+package replay
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pingcap/errors"
+	"github.com/prometheus/common/log"
+)
+
+// IndexName is the name of the index file of a replay directory.
+const IndexName = "index.json"
+
+// Index maps queries to the files with their responses.
+type Index struct {
+	// Vars are the values of the template variables used in the queries.
+	Vars    map[string]string `json:"vars,omitempty"`
+	Entries []*Entry          `json:"entries"`
+}
+
+// Entry is a saved response.
+type Entry struct {
+	// Endpoint is the path of the API endpoint below /api/v1/, e.g.
+	// label/job/values. Empty for queries.
+	Endpoint string `json:"endpoint,omitempty"`
+	Query    string `json:"query,omitempty"`
+	// Params are the parameters of the request the response was recorded
+	// for.
+	Params url.Values `json:"params,omitempty"`
+	// File is the path of the response, relative to the directory.
+	File string `json:"file"`
+}
+
+// IsQuery returns whether e is the response of a query or range query.
+func (e *Entry) IsQuery() bool {
+	return e.Endpoint == "" || e.Endpoint == "query" || e.Endpoint == "query_range"
+}
+
+// Store looks up the saved responses of a replay directory by query.
+type Store struct {
+	dir     string
+	vars    map[string]string
+	entries map[string]*Entry
+	// others are the responses of other endpoints.
+	others []*Entry
+
+	mtx sync.Mutex
+	// fuzzy caches the fuzzy matches of queries without an entry.
+	fuzzy map[string]*Entry
+}
+
+// OpenStore opens the replay directory dir. Without an index file every JSON
+// file of dir is a response to the query that is its file name.
+func OpenStore(dir string) (*Store, error) {
+	idx, err := readIndex(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Store{
+		dir:     dir,
+		vars:    idx.Vars,
+		entries: make(map[string]*Entry, len(idx.Entries)),
+		fuzzy:   map[string]*Entry{},
+	}
+	for _, e := range idx.Entries {
+		if !e.IsQuery() {
+			s.others = append(s.others, e)
+			continue
+		}
+		key := Normalize(e.Query, s.vars)
+		if prev, ok := s.entries[key]; ok {
+			log.Warnf("queries %q and %q are the same, %s is not used", prev.Query, e.Query, e.File)
+			continue
+		}
+		s.entries[key] = e
+	}
+
+	return s, nil
+}
+
+func readIndex(dir string) (*Index, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, IndexName))
+	if os.IsNotExist(err) {
+		return scanDir(dir)
+	}
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var idx Index
+	if err := json.Unmarshal(b, &idx); err != nil {
+		return nil, errors.Wrapf(err, "decode %s", IndexName)
+	}
+	return &idx, nil
+}
+
+// scanDir returns an index of the JSON files in dir named after their query.
+// Subdirectories, e.g. the dashboards, are not read.
+func scanDir(dir string) (*Index, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	idx := &Index{}
+	for _, fi := range files {
+		if fi.IsDir() || filepath.Ext(fi.Name()) != ".json" {
+			continue
+		}
+		idx.Entries = append(idx.Entries, &Entry{
+			Query: strings.TrimSuffix(fi.Name(), ".json"),
+			File:  fi.Name(),
+		})
+	}
+	return idx, nil
+}
+
+// Others returns the entries of endpoints other than the query ones.
+func (s *Store) Others() []*Entry {
+	return s.others
+}
+
+// Entries returns the entries of queries ordered by query.
+func (s *Store) Entries() []*Entry {
+	res := make([]*Entry, 0, len(s.entries))
+	for _, e := range s.entries {
+		res = append(res, e)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Query < res[j].Query })
+	return res
+}
+
+// Path returns the path of the response file of e.
+func (s *Store) Path(e *Entry) string {
+	return filepath.Join(s.dir, e.File)
+}
+
+// Lookup returns the entry of query. If there is none, the entry of the most
+// similar query is returned with a warning, or nil if no query is similar.
+func (s *Store) Lookup(query string) *Entry {
+	key := Normalize(query, s.vars)
+	if e, ok := s.entries[key]; ok {
+		return e
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if e, ok := s.fuzzy[key]; ok {
+		return e
+	}
+
+	var (
+		best     *Entry
+		bestDist int
+	)
+	for k, e := range s.entries {
+		d := distance(key, k)
+		if best == nil || d < bestDist || d == bestDist && e.Query < best.Query {
+			best, bestDist = e, d
+		}
+	}
+	// Accept matches that differ in at most a third of the query, e.g. in a
+	// range or a variable.
+	if best != nil && bestDist*3 > len(key) {
+		best = nil
+	}
+	if best != nil {
+		log.Warnf("no response saved for %q, replaying the one of %q", query, best.Query)
+	} else {
+		log.Warnf("no response saved for %q", query)
+	}
+	s.fuzzy[key] = best
+
+	return best
+}
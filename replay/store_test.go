@@ -0,0 +1,68 @@
+package replay
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpenStoreWithoutIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, fn := range []string{
+		"up.json",
+		"rate(http_requests_total[5m]).json",
+		"notes.txt",
+		filepath.Join("dashboards", "node.json"),
+		filepath.Join("nested.json", "x.json"),
+	} {
+		path := filepath.Join(dir, fn)
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte("{}"), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s, err := OpenStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, e := range s.Entries() {
+		got = append(got, e.Query+" "+e.File)
+	}
+	want := []string{"rate(http_requests_total[5m]) rate(http_requests_total[5m]).json", "up up.json"}
+	if len(got) != len(want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("got %q, want %q", got[i], want[i])
+		}
+	}
+
+	cases := []struct {
+		query, want string
+	}{
+		{"up", "up"},
+		{" up ", "up"},
+		{"rate(http_requests_total[1m])", "rate(http_requests_total[5m])"},
+		{"node_cpu_seconds_total", ""},
+	}
+	for _, c := range cases {
+		e := s.Lookup(c.query)
+		switch {
+		case c.want == "" && e != nil:
+			t.Errorf("%q: got %q, want none", c.query, e.Query)
+		case c.want != "" && (e == nil || e.Query != c.want):
+			t.Errorf("%q: got %v, want %q", c.query, e, c.want)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package replay
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/prometheus/common/model"
+)
+
+// lookbackDelta is how far Prometheus looks back for the sample of a series
+// at an evaluation time.
+const lookbackDelta = 5 * time.Minute
+
+// MaxPoints is the most steps per series Prometheus evaluates for a range
+// query.
+const MaxPoints = 11000
+
+// CheckRange returns an error for the range queries Prometheus rejects: steps
+// below a millisecond, the resolution of sample timestamps, and more than
+// MaxPoints steps.
+func CheckRange(start, end model.Time, step time.Duration) error {
+	if step < time.Millisecond {
+		return errors.New("zero or negative query resolution step widths are not accepted. Try a positive integer")
+	}
+	if end.Sub(start)/step > MaxPoints {
+		return errors.Errorf("exceeded maximum resolution of %d points per timeseries. Try decreasing the query resolution (?step=XX)", MaxPoints)
+	}
+	return nil
+}
+
+// Range evaluates v at every step from start to end like a range query
+// evaluates a selector: each step gets the latest sample at or before it
+// within the lookback delta. Saved instant results are treated as series of
+// one sample, scalars and strings are returned unchanged. Ranges rejected by
+// CheckRange have no steps.
+func Range(v model.Value, start, end model.Time, step time.Duration) model.Value {
+	var series []*model.SampleStream
+	switch v := v.(type) {
+	case model.Matrix:
+		series = v
+	case model.Vector:
+		for _, s := range v {
+			series = append(series, &model.SampleStream{
+				Metric: s.Metric,
+				Values: []model.SamplePair{{Timestamp: s.Timestamp, Value: s.Value}},
+			})
+		}
+	default:
+		return v
+	}
+
+	res := model.Matrix{}
+	if CheckRange(start, end, step) != nil {
+		return res
+	}
+	for _, ss := range series {
+		var (
+			values []model.SamplePair
+			i      int
+		)
+		for t := start; !t.After(end); t = t.Add(step) {
+			for i < len(ss.Values) && !ss.Values[i].Timestamp.After(t) {
+				i++
+			}
+			if i == 0 || t.Sub(ss.Values[i-1].Timestamp) > lookbackDelta {
+				continue
+			}
+			values = append(values, model.SamplePair{Timestamp: t, Value: ss.Values[i-1].Value})
+		}
+		if len(values) > 0 {
+			res = append(res, &model.SampleStream{Metric: ss.Metric, Values: values})
+		}
+	}
+
+	return res
+}
+
+// Instant evaluates v at ts: every series gets the sample nearest to ts,
+// reported at ts.
+func Instant(v model.Value, ts model.Time) model.Value {
+	switch v := v.(type) {
+	case model.Matrix:
+		res := make(model.Vector, 0, len(v))
+		for _, ss := range v {
+			if len(ss.Values) == 0 {
+				continue
+			}
+			p := nearest(ss.Values, ts)
+			res = append(res, &model.Sample{Metric: ss.Metric, Value: p.Value, Timestamp: ts})
+		}
+		return res
+	case model.Vector:
+		res := make(model.Vector, 0, len(v))
+		for _, s := range v {
+			res = append(res, &model.Sample{Metric: s.Metric, Value: s.Value, Timestamp: ts})
+		}
+		return res
+	case *model.Scalar:
+		return &model.Scalar{Value: v.Value, Timestamp: ts}
+	}
+	return v
+}
+
+// nearest returns the sample of values, which are sorted by time, that is
+// nearest to ts.
+func nearest(values []model.SamplePair, ts model.Time) model.SamplePair {
+	i := sort.Search(len(values), func(i int) bool {
+		return !values[i].Timestamp.Before(ts)
+	})
+	switch {
+	case i == 0:
+		return values[0]
+	case i == len(values):
+		return values[i-1]
+	case ts.Sub(values[i-1].Timestamp) <= values[i].Timestamp.Sub(ts):
+		return values[i-1]
+	}
+	return values[i]
+}
+
+// ParseTime parses a time parameter of the HTTP API, a Unix timestamp in
+// seconds or an RFC3339 timestamp.
+func ParseTime(s string) (model.Time, error) {
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		sec, frac := math.Modf(f)
+		return model.TimeFromUnixNano(int64(sec)*int64(time.Second) + int64(frac*float64(time.Second))), nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return 0, errors.Errorf("cannot parse %q to a valid timestamp", s)
+	}
+	return model.TimeFromUnixNano(t.UnixNano()), nil
+}
+
+// ParseDuration parses a step parameter of the HTTP API, seconds or a
+// duration such as 30s.
+func ParseDuration(s string) (time.Duration, error) {
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Duration(f * float64(time.Second)), nil
+	}
+	d, err := model.ParseDuration(s)
+	if err != nil {
+		return 0, errors.Errorf("cannot parse %q to a valid duration", s)
+	}
+	return time.Duration(d), nil
+}
+
+// Bounds returns the times of the first and the last sample of v, ok is false
+// if it has none.
+func Bounds(v model.Value) (min, max model.Time, ok bool) {
+	add := func(t model.Time) {
+		if !ok || t.Before(min) {
+			min = t
+		}
+		if !ok || t.After(max) {
+			max = t
+		}
+		ok = true
+	}
+
+	switch v := v.(type) {
+	case model.Matrix:
+		for _, ss := range v {
+			if len(ss.Values) > 0 {
+				add(ss.Values[0].Timestamp)
+				add(ss.Values[len(ss.Values)-1].Timestamp)
+			}
+		}
+	case model.Vector:
+		for _, s := range v {
+			add(s.Timestamp)
+		}
+	case *model.Scalar:
+		add(v.Timestamp)
+	}
+	return min, max, ok
+}
+
+// Span is the time range of the samples of several values.
+type Span struct {
+	Min, Max model.Time
+	// OK is false as long as no samples were added.
+	OK bool
+}
+
+// Add extends s by the samples of v.
+func (s *Span) Add(v model.Value) {
+	min, max, ok := Bounds(v)
+	if !ok {
+		return
+	}
+	if !s.OK || min.Before(s.Min) {
+		s.Min = min
+	}
+	if !s.OK || max.After(s.Max) {
+		s.Max = max
+	}
+	s.OK = true
+}
+
+// Offset returns the offset that shifts the last sample to t, zero if there
+// are no samples.
+func (s Span) Offset(t model.Time) time.Duration {
+	if !s.OK {
+		return 0
+	}
+	return t.Sub(s.Max)
+}
+
+// Dashboard returns the from and to times of a dashboard that shows the
+// samples shifted by offset.
+func (s Span) Dashboard(offset time.Duration) (from, to string) {
+	format := func(t model.Time) string {
+		return t.Add(offset).Time().UTC().Format(time.RFC3339)
+	}
+	return format(s.Min), format(s.Max)
+}
+
+// Shift moves every sample of v by offset in place.
+func Shift(v model.Value, offset time.Duration) {
+	switch v := v.(type) {
+	case model.Matrix:
+		for _, ss := range v {
+			for i := range ss.Values {
+				ss.Values[i].Timestamp = ss.Values[i].Timestamp.Add(offset)
+			}
+		}
+	case model.Vector:
+		for _, s := range v {
+			s.Timestamp = s.Timestamp.Add(offset)
+		}
+	case *model.Scalar:
+		v.Timestamp = v.Timestamp.Add(offset)
+	case *model.String:
+		v.Timestamp = v.Timestamp.Add(offset)
+	}
+}
@@ -0,0 +1,189 @@
+package replay
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestBounds(t *testing.T) {
+	cases := []struct {
+		name     string
+		v        model.Value
+		min, max model.Time
+		ok       bool
+	}{
+		{
+			name: "matrix",
+			v: model.Matrix{
+				{Values: []model.SamplePair{{Timestamp: 3000}, {Timestamp: 9000}}},
+				{Values: []model.SamplePair{{Timestamp: 1000}, {Timestamp: 5000}}},
+				{},
+			},
+			min: 1000, max: 9000, ok: true,
+		},
+		{
+			name: "vector",
+			v:    model.Vector{{Timestamp: 4000}, {Timestamp: 2000}},
+			min:  2000, max: 4000, ok: true,
+		},
+		{name: "scalar", v: &model.Scalar{Timestamp: 7000}, min: 7000, max: 7000, ok: true},
+		{name: "empty matrix", v: model.Matrix{{}}},
+		{name: "empty vector", v: model.Vector{}},
+		{name: "string", v: &model.String{Timestamp: 7000}},
+	}
+	for _, c := range cases {
+		min, max, ok := Bounds(c.v)
+		if ok != c.ok || ok && (min != c.min || max != c.max) {
+			t.Errorf("%s: got [%d, %d] %v, want [%d, %d] %v", c.name, min, max, ok, c.min, c.max, c.ok)
+		}
+	}
+}
+
+func TestShift(t *testing.T) {
+	cases := []struct {
+		name string
+		v    model.Value
+		want model.Value
+	}{
+		{
+			name: "matrix",
+			v:    model.Matrix{{Values: []model.SamplePair{{Timestamp: 1000, Value: 1}, {Timestamp: 2000, Value: 2}}}},
+			want: model.Matrix{{Values: []model.SamplePair{{Timestamp: 61000, Value: 1}, {Timestamp: 62000, Value: 2}}}},
+		},
+		{
+			name: "vector",
+			v:    model.Vector{{Timestamp: 1000, Value: 1}},
+			want: model.Vector{{Timestamp: 61000, Value: 1}},
+		},
+		{name: "scalar", v: &model.Scalar{Timestamp: 1000}, want: &model.Scalar{Timestamp: 61000}},
+		{name: "string", v: &model.String{Timestamp: 1000}, want: &model.String{Timestamp: 61000}},
+	}
+	for _, c := range cases {
+		Shift(c.v, time.Minute)
+		if !reflect.DeepEqual(c.v, c.want) {
+			t.Errorf("%s: got %v, want %v", c.name, c.v, c.want)
+		}
+	}
+}
+
+func TestSpan(t *testing.T) {
+	var s Span
+	if s.Offset(5000) != 0 {
+		t.Errorf("empty span has an offset")
+	}
+	s.Add(model.Vector{})
+	s.Add(model.Matrix{{Values: []model.SamplePair{{Timestamp: 3000}, {Timestamp: 9000}}}})
+	s.Add(model.Vector{{Timestamp: 1000}})
+	s.Add(&model.String{Timestamp: 20000})
+	if !s.OK || s.Min != 1000 || s.Max != 9000 {
+		t.Fatalf("got span %+v, want [1000, 9000]", s)
+	}
+
+	cases := []struct {
+		to       model.Time
+		offset   time.Duration
+		from, at string
+	}{
+		{to: 9000, from: "1970-01-01T00:00:01Z", at: "1970-01-01T00:00:09Z"},
+		{to: 69000, offset: time.Minute, from: "1970-01-01T00:01:01Z", at: "1970-01-01T00:01:09Z"},
+		{to: 8000, offset: -time.Second, from: "1970-01-01T00:00:00Z", at: "1970-01-01T00:00:08Z"},
+	}
+	for _, c := range cases {
+		offset := s.Offset(c.to)
+		if offset != c.offset {
+			t.Errorf("rebase to %d: got offset %s, want %s", c.to, offset, c.offset)
+		}
+		from, to := s.Dashboard(offset)
+		if from != c.from || to != c.at {
+			t.Errorf("rebase to %d: got dashboard from %s to %s, want %s to %s", c.to, from, to, c.from, c.at)
+		}
+	}
+}
+
+func TestCheckRange(t *testing.T) {
+	cases := []struct {
+		start, end model.Time
+		step       time.Duration
+		err        bool
+	}{
+		{start: 0, end: 3600000, step: 15 * time.Second},
+		{start: 0, end: 0, step: time.Millisecond},
+		{start: 0, end: 11000, step: time.Millisecond},
+		{start: 0, end: 11001, step: time.Millisecond, err: true},
+		{start: 0, end: 11000 * 15000, step: 15 * time.Second},
+		{start: 0, end: 11001 * 15000, step: 15 * time.Second, err: true},
+		{start: 0, end: 1000, step: 0, err: true},
+		{start: 0, end: 1000, step: -time.Second, err: true},
+		// Timestamps are milliseconds, a smaller step would never advance.
+		{start: 0, end: 1000, step: 500 * time.Microsecond, err: true},
+	}
+	for _, c := range cases {
+		err := CheckRange(c.start, c.end, c.step)
+		if c.err != (err != nil) {
+			t.Errorf("[%d, %d] step %v: got error %v, want error %v", c.start, c.end, c.step, err, c.err)
+		}
+	}
+}
+
+func TestRange(t *testing.T) {
+	metric := model.Metric{"__name__": "up"}
+	matrix := model.Matrix{{
+		Metric: metric,
+		Values: []model.SamplePair{{Timestamp: 10000, Value: 1}, {Timestamp: 40000, Value: 2}, {Timestamp: 900000, Value: 3}},
+	}}
+
+	cases := []struct {
+		name       string
+		v          model.Value
+		start, end model.Time
+		step       time.Duration
+		want       model.Value
+	}{
+		{
+			name: "latest sample within lookback",
+			v:    matrix, start: 0, end: 60000, step: 20 * time.Second,
+			want: model.Matrix{{Metric: metric, Values: []model.SamplePair{{Timestamp: 20000, Value: 1}, {Timestamp: 40000, Value: 2}, {Timestamp: 60000, Value: 2}}}},
+		},
+		{
+			name: "stale after lookback",
+			v:    matrix, start: 300000, end: 400000, step: 50 * time.Second,
+			want: model.Matrix{{Metric: metric, Values: []model.SamplePair{{Timestamp: 300000, Value: 2}}}},
+		},
+		{
+			name: "no samples",
+			v:    matrix, start: 400000, end: 500000, step: time.Minute,
+			want: model.Matrix{},
+		},
+		{
+			name:  "vector",
+			v:     model.Vector{{Metric: metric, Timestamp: 30000, Value: 5}},
+			start: 0, end: 60000, step: 30 * time.Second,
+			want: model.Matrix{{Metric: metric, Values: []model.SamplePair{{Timestamp: 30000, Value: 5}, {Timestamp: 60000, Value: 5}}}},
+		},
+		{
+			name:  "scalar unchanged",
+			v:     &model.Scalar{Timestamp: 1000, Value: 1},
+			start: 0, end: 60000, step: time.Second,
+			want: &model.Scalar{Timestamp: 1000, Value: 1},
+		},
+		{
+			name: "step below a millisecond",
+			v:    matrix, start: 0, end: 60000, step: time.Microsecond,
+			want: model.Matrix{},
+		},
+		{
+			name: "too many points",
+			v:    matrix, start: 0, end: 900000, step: time.Millisecond,
+			want: model.Matrix{},
+		},
+	}
+	for _, c := range cases {
+		got := Range(c.v, c.start, c.end, c.step)
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+// Package selector parses PromQL series selectors.
+package selector
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/pingcap/errors"
+	"github.com/prometheus/tsdb/labels"
+)
+
+// Parse parses a series selector such as `up{job="node",instance=~"db-.*"}`
+// into label matchers.
+func Parse(s string) ([]labels.Matcher, error) {
+	p := &selectorParser{s: strings.TrimSpace(s)}
+
+	var ms []labels.Matcher
+	if name := p.name(); name != "" {
+		ms = append(ms, labels.NewEqualMatcher("__name__", name))
+	}
+
+	if p.consume("{") {
+		for !p.consume("}") {
+			m, err := p.matcher()
+			if err != nil {
+				return nil, errors.Wrapf(err, "parse selector %q", s)
+			}
+			ms = append(ms, m)
+
+			if !p.consume(",") && !strings.HasPrefix(p.rest(), "}") {
+				return nil, errors.Errorf("parse selector %q: expected , or } at %d", s, p.pos)
+			}
+		}
+	}
+	if p.rest() != "" {
+		return nil, errors.Errorf("parse selector %q: unexpected %q", s, p.rest())
+	}
+	if len(ms) == 0 {
+		return nil, errors.Errorf("empty selector")
+	}
+
+	return ms, nil
+}
+
+// Matches returns whether lset is selected by all matchers of ms.
+func Matches(ms []labels.Matcher, lset labels.Labels) bool {
+	for _, m := range ms {
+		if !m.Matches(lset.Get(m.Name())) {
+			return false
+		}
+	}
+	return true
+}
+
+type selectorParser struct {
+	s   string
+	pos int
+}
+
+func (p *selectorParser) rest() string {
+	return strings.TrimLeftFunc(p.s[p.pos:], unicode.IsSpace)
+}
+
+func (p *selectorParser) skipSpace() {
+	p.pos = len(p.s) - len(p.rest())
+}
+
+func (p *selectorParser) consume(tok string) bool {
+	p.skipSpace()
+	if strings.HasPrefix(p.s[p.pos:], tok) {
+		p.pos += len(tok)
+		return true
+	}
+	return false
+}
+
+// name reads a metric or label name. Colons are allowed in metric names only,
+// which is checked by the callers.
+func (p *selectorParser) name() string {
+	p.skipSpace()
+	start := p.pos
+	for p.pos < len(p.s) {
+		c := p.s[p.pos]
+		if c == '_' || c == ':' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || p.pos > start && c >= '0' && c <= '9' {
+			p.pos++
+			continue
+		}
+		break
+	}
+	return p.s[start:p.pos]
+}
+
+func (p *selectorParser) matcher() (labels.Matcher, error) {
+	name := p.name()
+	if name == "" || strings.Contains(name, ":") {
+		return nil, errors.Errorf("invalid label name at %d", p.pos)
+	}
+
+	var op string
+	for _, o := range []string{"=~", "!~", "!=", "="} {
+		if p.consume(o) {
+			op = o
+			break
+		}
+	}
+	if op == "" {
+		return nil, errors.Errorf("expected =, !=, =~ or !~ after %s", name)
+	}
+
+	value, err := p.str()
+	if err != nil {
+		return nil, err
+	}
+
+	switch op {
+	case "=":
+		return labels.NewEqualMatcher(name, value), nil
+	case "!=":
+		return labels.Not(labels.NewEqualMatcher(name, value)), nil
+	}
+	m, err := labels.NewRegexpMatcher(name, "^(?:"+value+")$")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if op == "!~" {
+		return labels.Not(m), nil
+	}
+	return m, nil
+}
+
+// str reads a quoted string with Go escapes.
+func (p *selectorParser) str() (string, error) {
+	p.skipSpace()
+	if p.pos >= len(p.s) {
+		return "", errors.Errorf("expected quoted string at %d", p.pos)
+	}
+
+	quote := p.s[p.pos]
+	if quote != '"' && quote != '\'' && quote != '`' {
+		return "", errors.Errorf("expected quoted string at %d", p.pos)
+	}
+	for end := p.pos + 1; end < len(p.s); end++ {
+		switch p.s[end] {
+		case '\\':
+			if quote != '`' {
+				end++
+			}
+		case quote:
+			lit := p.s[p.pos : end+1]
+			if quote == '\'' {
+				// strconv only unquotes single characters in single quotes.
+				lit = doubleQuote(lit[1 : len(lit)-1])
+			}
+			s, err := strconv.Unquote(lit)
+			if err != nil {
+				return "", errors.Wrapf(err, "invalid string at %d", p.pos)
+			}
+			p.pos = end + 1
+			return s, nil
+		}
+	}
+	return "", errors.Errorf("unterminated string at %d", p.pos)
+}
+
+// doubleQuote turns the content of a single quoted string into a double
+// quoted one.
+func doubleQuote(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\' && i+1 < len(s):
+			i++
+			if s[i] != '\'' {
+				b.WriteByte(c)
+			}
+			b.WriteByte(s[i])
+		case c == '"':
+			b.WriteString(`\"`)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
@@ -0,0 +1,126 @@
+package selector
+
+import (
+	"testing"
+
+	"github.com/prometheus/tsdb/labels"
+)
+
+func TestParse(t *testing.T) {
+	cases := []struct {
+		in      string
+		match   []labels.Labels
+		nomatch []labels.Labels
+		err     bool
+	}{
+		{
+			in:      "up",
+			match:   []labels.Labels{labels.FromStrings("__name__", "up", "job", "node")},
+			nomatch: []labels.Labels{labels.FromStrings("__name__", "down")},
+		},
+		{
+			in:      "job:up:sum",
+			match:   []labels.Labels{labels.FromStrings("__name__", "job:up:sum")},
+			nomatch: []labels.Labels{labels.FromStrings("__name__", "job")},
+		},
+		{
+			in:      ` up { job = "node" , instance =~ "db-.*", } `,
+			match:   []labels.Labels{labels.FromStrings("__name__", "up", "job", "node", "instance", "db-1")},
+			nomatch: []labels.Labels{labels.FromStrings("__name__", "up", "job", "node", "instance", "web-db-1")},
+		},
+		{
+			in:      `{job!="node",env!~"dev|test"}`,
+			match:   []labels.Labels{labels.FromStrings("job", "prometheus", "env", "prod"), labels.FromStrings("env", "devel")},
+			nomatch: []labels.Labels{labels.FromStrings("job", "node"), labels.FromStrings("env", "test")},
+		},
+		{
+			// Missing labels are empty.
+			in:      `{job=""}`,
+			match:   []labels.Labels{labels.FromStrings("__name__", "up")},
+			nomatch: []labels.Labels{labels.FromStrings("job", "node")},
+		},
+		{in: "", err: true},
+		{in: "{}", err: true},
+		{in: "up{", err: true},
+		{in: "up}", err: true},
+		{in: `up{job}`, err: true},
+		{in: `up{job=node}`, err: true},
+		{in: `up{job:name="node"}`, err: true},
+		{in: `up{job="node" instance="a"}`, err: true},
+		{in: `up{job=~"("}`, err: true},
+		{in: `up{job="node"`, err: true},
+		{in: `up{job="node}`, err: true},
+		{in: `up{job="\q"}`, err: true},
+		{in: "1up", err: true},
+	}
+	for _, c := range cases {
+		ms, err := Parse(c.in)
+		if c.err {
+			if err == nil {
+				t.Errorf("%q: want an error", c.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", c.in, err)
+			continue
+		}
+		for _, lset := range c.match {
+			if !Matches(ms, lset) {
+				t.Errorf("%q does not match %s", c.in, lset)
+			}
+		}
+		for _, lset := range c.nomatch {
+			if Matches(ms, lset) {
+				t.Errorf("%q matches %s", c.in, lset)
+			}
+		}
+	}
+}
+
+func TestQuotes(t *testing.T) {
+	cases := []struct {
+		in   string
+		want string
+	}{
+		{`"node"`, "node"},
+		{`'node'`, "node"},
+		{"`node`", "node"},
+		{`""`, ""},
+		{`"a\"b"`, `a"b`},
+		{`'a\'b'`, `a'b`},
+		{`'a"b'`, `a"b`},
+		{`"a'b"`, `a'b`},
+		{`'a\"b'`, `a"b`},
+		{`"a\\b"`, `a\b`},
+		{`'a\\b'`, `a\b`},
+		{"`a\\b`", `a\b`},
+		{"`a\\`", `a\`},
+		{`"a\nb"`, "a\nb"},
+		{`'a\tb'`, "a\tb"},
+		{`"é"`, "é"},
+		{`"a,b}"`, "a,b}"},
+	}
+	for _, c := range cases {
+		ms, err := Parse("{l=" + c.in + "}")
+		if err != nil {
+			t.Errorf("%s: %v", c.in, err)
+			continue
+		}
+		if len(ms) != 1 || !ms[0].Matches(c.want) || ms[0].Matches(c.want+"x") {
+			t.Errorf("%s: does not match %q exactly", c.in, c.want)
+		}
+	}
+}
+
+func TestRegexpAnchored(t *testing.T) {
+	ms, err := Parse(`{l=~"a|b"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for v, want := range map[string]bool{"a": true, "b": true, "ab": false, "xa": false, "bx": false} {
+		if got := ms[0].Matches(v); got != want {
+			t.Errorf("%q: got %v, want %v", v, got, want)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+// Package timeparse parses the timestamps given to the command line tools.
+package timeparse
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/prometheus/common/model"
+)
+
+// secondsThreshold separates Unix timestamps in seconds from ones in
+// milliseconds. In milliseconds it is March 1973, in seconds the year 5138.
+const secondsThreshold = 1e11
+
+var layouts = []string{
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04",
+	"2006-01-02T15:04",
+	"2006-01-02",
+}
+
+// Parser parses timestamps into milliseconds since the epoch. It accepts
+//
+//   - RFC3339 timestamps, e.g. 2019-06-28T06:00:00Z
+//   - dates and times without a zone, e.g. 2019-06-28 14:00:00, in Location
+//   - Unix timestamps in seconds or milliseconds, told apart by their size
+//   - now, optionally with an offset, e.g. now-6h or now+1d
+type Parser struct {
+	Now time.Time
+	// Location is used for timestamps without a zone, UTC if nil.
+	Location *time.Location
+	// Warnf is called when a timestamp is ambiguous.
+	Warnf func(format string, args ...interface{})
+}
+
+// New returns a Parser for the current time in the time zone tz, which is a
+// name of the IANA database such as Asia/Shanghai, Local or empty for UTC.
+func New(tz string, warnf func(format string, args ...interface{})) (*Parser, error) {
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return nil, errors.Wrapf(err, "load time zone %q", tz)
+	}
+
+	return &Parser{
+		Now:      time.Now(),
+		Location: loc,
+		Warnf:    warnf,
+	}, nil
+}
+
+// Parse returns s in milliseconds since the epoch.
+func (p *Parser) Parse(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, errors.Errorf("empty timestamp")
+	}
+
+	if strings.HasPrefix(s, "now") {
+		offset := strings.TrimSpace(s[len("now"):])
+		if offset == "" {
+			return Millis(p.Now), nil
+		}
+
+		sign := time.Duration(1)
+		switch offset[0] {
+		case '-':
+			sign = -1
+		case '+':
+		default:
+			return 0, errors.Errorf("invalid timestamp %q, expected now-<duration> or now+<duration>", s)
+		}
+		d, err := ParseDuration(offset[1:])
+		if err != nil {
+			return 0, errors.Wrapf(err, "invalid timestamp %q", s)
+		}
+		return Millis(p.Now.Add(sign * d)), nil
+	}
+
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		if n == math.MinInt64 || n == math.MaxInt64 || n <= -secondsThreshold || n >= secondsThreshold {
+			return n, nil
+		}
+		p.warnf("timestamp %d is interpreted as Unix seconds (%s), append 000 for milliseconds", n, time.Unix(n, 0).UTC().Format(time.RFC3339))
+		return n * 1000, nil
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		p.warnf("timestamp %s is interpreted as Unix seconds", s)
+		return int64(math.Round(f * 1000)), nil
+	}
+
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return Millis(t), nil
+	}
+	loc := p.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+	for _, layout := range layouts {
+		if t, err := time.ParseInLocation(layout, s, loc); err == nil {
+			return Millis(t), nil
+		}
+	}
+
+	return 0, errors.Errorf("invalid timestamp %q, expected RFC3339, 2006-01-02 15:04:05, Unix seconds or milliseconds or now-<duration>", s)
+}
+
+func (p *Parser) warnf(format string, args ...interface{}) {
+	if p.Warnf != nil {
+		p.Warnf(format, args...)
+	}
+}
+
+// ParseDuration parses Prometheus durations such as 6h, 2d or 1w as well as
+// Go durations such as 1h30m.
+func ParseDuration(s string) (time.Duration, error) {
+	if d, err := model.ParseDuration(s); err == nil {
+		return time.Duration(d), nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, errors.Errorf("invalid duration %q", s)
+	}
+	return d, nil
+}
+
+// Millis returns t in milliseconds since the epoch.
+func Millis(t time.Time) int64 {
+	return t.Unix()*1000 + int64(t.Nanosecond())/int64(time.Millisecond)
+}
+
+// Range parses a time range given by its minimum and maximum or by its length
+// up to now. An empty minimum or maximum leaves the range open on that side.
+func (p *Parser) Range(min, max, last string) (int64, int64, error) {
+	if last != "" {
+		if min != "" || max != "" {
+			return 0, 0, errors.Errorf("a range up to now cannot be combined with a minimum or maximum time")
+		}
+		d, err := ParseDuration(last)
+		if err != nil {
+			return 0, 0, err
+		}
+		return Millis(p.Now.Add(-d)), Millis(p.Now), nil
+	}
+
+	mint, maxt := int64(math.MinInt64), int64(math.MaxInt64)
+	var err error
+	if min != "" {
+		if mint, err = p.Parse(min); err != nil {
+			return 0, 0, err
+		}
+	}
+	if max != "" {
+		if maxt, err = p.Parse(max); err != nil {
+			return 0, 0, err
+		}
+	}
+	if mint > maxt {
+		return 0, 0, errors.Errorf("minimum time %d is after maximum time %d", mint, maxt)
+	}
+
+	return mint, maxt, nil
+}
@@ -0,0 +1,121 @@
+package timeparse
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+var now = time.Date(2019, 6, 28, 12, 0, 0, 0, time.UTC)
+
+func TestParse(t *testing.T) {
+	shanghai, err := time.LoadLocation("Asia/Shanghai")
+	if err != nil {
+		t.Skip(err)
+	}
+
+	cases := []struct {
+		in   string
+		loc  *time.Location
+		want int64
+		warn bool
+		err  bool
+	}{
+		{in: "2019-06-28T06:00:00Z", want: 1561701600000},
+		{in: "2019-06-28T14:00:00+08:00", want: 1561701600000},
+		{in: "2019-06-28T06:00:00.123Z", want: 1561701600123},
+		{in: "2019-06-28 06:00:00", want: 1561701600000},
+		{in: "2019-06-28 14:00:00", loc: shanghai, want: 1561701600000},
+		{in: "2019-06-28T06:00", want: 1561701600000},
+		{in: "2019-06-28", want: 1561680000000},
+		{in: " 2019-06-28 ", want: 1561680000000},
+		{in: "1561701600000", want: 1561701600000},
+		{in: "1561701600", want: 1561701600000, warn: true},
+		{in: "1561701600.5", want: 1561701600500, warn: true},
+		{in: "-9223372036854775808", want: math.MinInt64},
+		{in: "9223372036854775807", want: math.MaxInt64},
+		{in: "now", want: 1561723200000},
+		{in: "now-6h", want: 1561701600000},
+		{in: "now+1d", want: 1561809600000},
+		{in: "now-1h30m", want: 1561717800000},
+		{in: "now*2", err: true},
+		{in: "now-6x", err: true},
+		{in: "", err: true},
+		{in: "yesterday", err: true},
+		{in: "2019-13-01", err: true},
+	}
+	for _, c := range cases {
+		var warned bool
+		p := &Parser{Now: now, Location: c.loc, Warnf: func(string, ...interface{}) { warned = true }}
+
+		got, err := p.Parse(c.in)
+		switch {
+		case c.err && err == nil:
+			t.Errorf("%q: got %d, want an error", c.in, got)
+		case !c.err && err != nil:
+			t.Errorf("%q: %v", c.in, err)
+		case !c.err && got != c.want:
+			t.Errorf("%q: got %d, want %d", c.in, got, c.want)
+		}
+		if warned != c.warn {
+			t.Errorf("%q: warned %v, want %v", c.in, warned, c.warn)
+		}
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	cases := []struct {
+		in   string
+		want time.Duration
+		err  bool
+	}{
+		{in: "6h", want: 6 * time.Hour},
+		{in: "2d", want: 48 * time.Hour},
+		{in: "1w", want: 7 * 24 * time.Hour},
+		{in: "1h30m", want: 90 * time.Minute},
+		{in: "1.5h", want: 90 * time.Minute},
+		{in: "", err: true},
+		{in: "6", err: true},
+	}
+	for _, c := range cases {
+		got, err := ParseDuration(c.in)
+		switch {
+		case c.err && err == nil:
+			t.Errorf("%q: got %v, want an error", c.in, got)
+		case !c.err && err != nil:
+			t.Errorf("%q: %v", c.in, err)
+		case !c.err && got != c.want:
+			t.Errorf("%q: got %v, want %v", c.in, got, c.want)
+		}
+	}
+}
+
+func TestRange(t *testing.T) {
+	cases := []struct {
+		min, max, last string
+		mint, maxt     int64
+		err            bool
+	}{
+		{mint: math.MinInt64, maxt: math.MaxInt64},
+		{min: "2019-06-28", mint: 1561680000000, maxt: math.MaxInt64},
+		{max: "2019-06-28", mint: math.MinInt64, maxt: 1561680000000},
+		{last: "6h", mint: 1561701600000, maxt: 1561723200000},
+		{min: "now-1h", max: "now", mint: 1561719600000, maxt: 1561723200000},
+		{min: "now", max: "now-1h", err: true},
+		{min: "now-1h", last: "6h", err: true},
+		{last: "6", err: true},
+		{min: "x", err: true},
+	}
+	for _, c := range cases {
+		p := &Parser{Now: now}
+		mint, maxt, err := p.Range(c.min, c.max, c.last)
+		switch {
+		case c.err && err == nil:
+			t.Errorf("%q %q %q: got [%d, %d], want an error", c.min, c.max, c.last, mint, maxt)
+		case !c.err && err != nil:
+			t.Errorf("%q %q %q: %v", c.min, c.max, c.last, err)
+		case !c.err && (mint != c.mint || maxt != c.maxt):
+			t.Errorf("%q %q %q: got [%d, %d], want [%d, %d]", c.min, c.max, c.last, mint, maxt, c.mint, c.maxt)
+		}
+	}
+}